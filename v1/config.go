@@ -34,6 +34,8 @@ type ConfigFile struct {
 	Config          Config    `json:"config"`
 	ContainerConfig Config    `json:"container_config"`
 	OSVersion       string    `json:"osversion"`
+	OSFeatures      []string  `json:"os.features,omitempty"`
+	Variant         string    `json:"variant,omitempty"`
 }
 
 // History is one entry of a list recording how this container image was built.
@@ -0,0 +1,39 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package empty
+
+import (
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	im, err := Index.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if got, want := len(im.Manifests), 0; got != want {
+		t.Fatalf("num manifests; got %v, want %v", got, want)
+	}
+	raw, err := Index.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	if got, want := string(raw), `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`; got != want {
+		t.Errorf("RawManifest; got %s, want %s", got, want)
+	}
+	if _, err := Index.Digest(); err != nil {
+		t.Errorf("Digest: %v", err)
+	}
+}
@@ -58,3 +58,27 @@ func TestManifestWithBadHash(t *testing.T) {
 		t.Errorf("Expected error parsing manifest, but got: %v", bad)
 	}
 }
+
+func TestGoodIndexManifest(t *testing.T) {
+	got, err := ParseIndexManifest(strings.NewReader(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [{
+    "mediaType": "application/vnd.oci.image.manifest.v1+json",
+    "size": 7143,
+    "digest": "sha256:deadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+    "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}
+  }]
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing index manifest: %v", err)
+	}
+
+	if got, want := len(got.Manifests), 1; got != want {
+		t.Fatalf("len(ParseIndexManifest().Manifests); got %v, want %v", got, want)
+	}
+	want := &Platform{Architecture: "arm", OS: "linux", Variant: "v7"}
+	if diff := cmp.Diff(want, got.Manifests[0].Platform); diff != "" {
+		t.Errorf("ParseIndexManifest().Manifests[0].Platform; (-want +got) %s", diff)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/tarball"
+)
+
+// AppendDir appends a layer holding the contents of dir to base, with a
+// history entry created by createdBy. It is the inverse of ExtractTo, so that
+// tools can extract an image, change it on disk, and append the result.
+//
+// The layer is reproducible: entries are sorted, owned by root, have their
+// modification time set to the Unix epoch, and have normalized modes (0755
+// for directories and executables, 0644 for other files). Symlinks are kept
+// as symlinks, and other special files are skipped.
+func AppendDir(base v1.Image, dir string, createdBy string) (v1.Image, error) {
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeDirTar(dir, pw))
+		}()
+		return pr, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Append(base, Addendum{
+		Layer: layer,
+		History: v1.History{
+			CreatedBy: createdBy,
+			Created:   v1.Time{Time: time.Now()},
+		},
+	})
+}
+
+// writeDirTar writes the contents of dir to w as a tar archive.
+func writeDirTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// filepath.Walk visits the entries of each directory in lexical order.
+	if err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		header := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			ModTime: time.Unix(0, 0),
+		}
+		switch {
+		case fi.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case fi.Mode()&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Mode = 0777
+			if header.Linkname, err = os.Readlink(name); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Mode = 0644
+			if fi.Mode()&0111 != 0 {
+				header.Mode = 0755
+			}
+			header.Size = fi.Size()
+		default:
+			return nil
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, header.Size)
+		return err
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1/empty"
+)
+
+func TestAppendDir(t *testing.T) {
+	src, cleanup := tempDir(t)
+	defer cleanup()
+	for name, contents := range map[string]string{
+		"etc/config": "config",
+		"bin/tool":   "#!/bin/sh",
+		"empty":      "",
+	} {
+		target := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(target, []byte(contents), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "bin", "tool"), 0700); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := os.Symlink("../etc/config", filepath.Join(src, "bin", "config")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	img, err := AppendDir(empty.Image, src, "COPY . /")
+	if err != nil {
+		t.Fatalf("AppendDir: %v", err)
+	}
+	history := getConfigFile(t, img).History
+	if len(history) != 1 || history[0].CreatedBy != "COPY . /" {
+		t.Errorf("History = %v, want one entry created by %q", history, "COPY . /")
+	}
+
+	headers, _ := readEntries(t, Extract(img))
+	want := []string{"bin/", "bin/config", "bin/tool", "empty", "etc/", "etc/config"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	modes := map[string]int64{}
+	for _, hdr := range headers {
+		modes[hdr.Name] = hdr.Mode
+	}
+	wantModes := map[string]int64{
+		"bin/":       0755,
+		"bin/config": 0777,
+		"bin/tool":   0755,
+		"empty":      0644,
+		"etc/":       0755,
+		"etc/config": 0644,
+	}
+	if diff := cmp.Diff(modes, wantModes); diff != "" {
+		t.Errorf("modes (-got, +want) %s", diff)
+	}
+
+	// Round-trip through ExtractTo.
+	dst, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dst, nil); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if diff := cmp.Diff(readDir(t, dst), readDir(t, src)); diff != "" {
+		t.Errorf("round-trip (-got, +want) %s", diff)
+	}
+	if got, err := os.Readlink(filepath.Join(dst, "bin", "config")); err != nil || got != "../etc/config" {
+		t.Errorf("Readlink(bin/config) = %q, %v; want %q", got, err, "../etc/config")
+	}
+
+	// The layer is reproducible.
+	again, err := AppendDir(empty.Image, src, "COPY . /")
+	if err != nil {
+		t.Fatalf("AppendDir: %v", err)
+	}
+	if diff := cmp.Diff(getManifest(t, again).Layers, getManifest(t, img).Layers); diff != "" {
+		t.Errorf("layers differ between runs (-got, +want) %s", diff)
+	}
+}
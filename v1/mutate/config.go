@@ -0,0 +1,671 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// ConfigDelta returns the set of v1.Config field names whose values differ
+// between base and derived, e.g. {"Env": true} when derived only changed its
+// environment. Fields are compared by value, so a nil slice and an empty
+// slice are considered different.
+func ConfigDelta(base, derived v1.Image) (map[string]bool, error) {
+	bcf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	dcf, err := derived.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	bv := reflect.ValueOf(bcf.Config)
+	dv := reflect.ValueOf(dcf.Config)
+	changed := map[string]bool{}
+	for i := 0; i < bv.NumField(); i++ {
+		if !reflect.DeepEqual(bv.Field(i).Interface(), dv.Field(i).Interface()) {
+			changed[bv.Type().Field(i).Name] = true
+		}
+	}
+	return changed, nil
+}
+
+// EntrypointForOS sets the entrypoint of base to windows if its config file
+// declares the "windows" OS, and to posix otherwise.
+//
+// Shell-form entrypoints differ between platforms, so callers are expected
+// to provide e.g. []string{"/bin/sh", "-c", cmd} for posix and
+// []string{"cmd", "/S", "/C", cmd} for windows.
+func EntrypointForOS(base v1.Image, posix []string, windows []string) (v1.Image, error) {
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		if cf.OS == "windows" {
+			cf.Config.Entrypoint = windows
+		} else {
+			cf.Config.Entrypoint = posix
+		}
+	})
+}
+
+// EnvFromReader merges the dotenv-style KEY=VALUE lines read from r into the
+// environment of base. Existing variables are updated in place and new ones
+// are appended in the order they are read.
+//
+// Blank lines and lines starting with # are ignored, an optional "export "
+// prefix is allowed, and values may be wrapped in single quotes (taken
+// literally) or double quotes (which support Go escape sequences).
+func EnvFromReader(base v1.Image, r io.Reader) (v1.Image, error) {
+	var updates []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		updates = append(updates, kv)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Env = mergeEnv(cfg.Env, updates)
+	})
+}
+
+// parseEnvLine parses a single dotenv line into KEY=VALUE form.
+func parseEnvLine(line string) (string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", fmt.Errorf("expected KEY=VALUE, got %q", line)
+	}
+	key := strings.TrimSpace(line[:i])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", fmt.Errorf("invalid variable name %q", key)
+	}
+	value := strings.TrimSpace(line[i+1:])
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		value = value[1 : len(value)-1]
+	} else if len(value) >= 1 && value[0] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value for %s: %s", key, value)
+		}
+		value = unquoted
+	}
+	return key + "=" + value, nil
+}
+
+// mergeEnv merges updates, in KEY=VALUE form, into env. Variables already in
+// env keep their position, and new ones are appended in order.
+func mergeEnv(env []string, updates []string) []string {
+	merged := append([]string{}, env...)
+	index := make(map[string]int, len(merged))
+	for i, kv := range merged {
+		if _, ok := index[envKey(kv)]; !ok {
+			index[envKey(kv)] = i
+		}
+	}
+	for _, kv := range updates {
+		key := envKey(kv)
+		if i, ok := index[key]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+// envKey returns the name of the variable in a KEY=VALUE string.
+func envKey(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
+}
+
+// LayerLabels merges the provided label maps onto the labels of base. Maps
+// are applied in order, so later maps win over earlier ones, and all of them
+// win over the labels base already has.
+func LayerLabels(base v1.Image, maps ...map[string]string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		if cfg.Labels == nil {
+			cfg.Labels = map[string]string{}
+		}
+		for _, m := range maps {
+			for k, v := range m {
+				cfg.Labels[k] = v
+			}
+		}
+	})
+}
+
+// EnsureLabel sets the label key to value unless base already has that label,
+// in which case its value is kept and base itself is returned. This suits
+// default labels that values set by users should win over.
+func EnsureLabel(base v1.Image, key, value string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		if _, ok := cfg.Labels[key]; ok {
+			return
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = map[string]string{}
+		}
+		cfg.Labels[key] = value
+	})
+}
+
+// ValidateConfigSize returns an error if the serialized config file of img is
+// larger than limit bytes, naming the entries that contribute the most to its
+// size. A limit of zero or less means no limit.
+//
+// This helps diagnose images rejected by registries that cap the size of
+// config blobs.
+func ValidateConfigSize(img v1.Image, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if int64(len(raw)) <= limit {
+		return nil
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	contributors := configContributors(cf)
+	if len(contributors) > maxConfigContributors {
+		contributors = contributors[:maxConfigContributors]
+	}
+	names := make([]string, 0, len(contributors))
+	for _, c := range contributors {
+		names = append(names, fmt.Sprintf("%s (%d bytes)", c.name, c.size))
+	}
+	return fmt.Errorf("config is %d bytes, exceeding the limit of %d; largest contributors: %s",
+		len(raw), limit, strings.Join(names, ", "))
+}
+
+// maxConfigContributors is the number of entries named by ValidateConfigSize.
+const maxConfigContributors = 3
+
+type configContributor struct {
+	name string
+	size int
+}
+
+// configContributors returns the variable-sized entries of cf, largest first.
+func configContributors(cf *v1.ConfigFile) []configContributor {
+	var cs []configContributor
+	for _, kv := range cf.Config.Env {
+		cs = append(cs, configContributor{fmt.Sprintf("Env %s", envKey(kv)), len(kv)})
+	}
+	for k, v := range cf.Config.Labels {
+		cs = append(cs, configContributor{fmt.Sprintf("label %s", k), len(k) + len(v)})
+	}
+	for i, h := range cf.History {
+		cs = append(cs, configContributor{fmt.Sprintf("history %d", i), len(h.CreatedBy) + len(h.Comment)})
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].size != cs[j].size {
+			return cs[i].size > cs[j].size
+		}
+		return cs[i].name < cs[j].name
+	})
+	return cs
+}
+
+// AppendOnBuild adds triggers to the ONBUILD instructions of base, after the
+// ones it already has, skipping any trigger that is already present.
+func AppendOnBuild(base v1.Image, triggers ...string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		seen := make(map[string]bool, len(cfg.OnBuild))
+		for _, trigger := range cfg.OnBuild {
+			seen[trigger] = true
+		}
+		for _, trigger := range triggers {
+			if !seen[trigger] {
+				seen[trigger] = true
+				cfg.OnBuild = append(cfg.OnBuild, trigger)
+			}
+		}
+	})
+}
+
+// CanonicalConfigJSON returns img's config file as indented JSON with sorted
+// keys, whose diffs are easy to review, e.g. in golden tests. It is only a
+// presentation of the config: the image's config digest is still computed
+// over its usual compact encoding.
+func CanonicalConfigJSON(img v1.Image) ([]byte, error) {
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	// Keep numbers exactly as they were, rather than as float64.
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("parsing config file: %v", err)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// inspectConfig holds the fields of the Config section of `docker inspect`
+// output that ConfigFromDockerInspect applies.
+type inspectConfig struct {
+	Env          []string
+	Cmd          []string
+	Entrypoint   []string
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
+	ExposedPorts map[string]struct{}
+	Volumes      map[string]struct{}
+}
+
+// ConfigFromDockerInspect replaces the Env, Cmd, Entrypoint, WorkingDir, User,
+// Labels, ExposedPorts and Volumes of base's config with those of the
+// `docker inspect` output of a container or image, e.g. to replicate an
+// existing container's configuration onto a new image. The output may be the
+// usual array of one object, or the object itself.
+//
+// The fields are read from the object's Config, or from its ContainerConfig
+// if it has no Config. Other fields, such as Hostname, are specific to a
+// container and are ignored.
+func ConfigFromDockerInspect(base v1.Image, inspectJSON []byte) (v1.Image, error) {
+	type inspect struct {
+		Config          *inspectConfig
+		ContainerConfig *inspectConfig
+	}
+	var objs []inspect
+	if err := json.Unmarshal(inspectJSON, &objs); err != nil {
+		var obj inspect
+		if err := json.Unmarshal(inspectJSON, &obj); err != nil {
+			return nil, fmt.Errorf("parsing docker inspect output: %v", err)
+		}
+		objs = []inspect{obj}
+	}
+	if len(objs) != 1 {
+		return nil, fmt.Errorf("docker inspect output has %d objects, want 1", len(objs))
+	}
+	ic := objs[0].Config
+	if ic == nil {
+		ic = objs[0].ContainerConfig
+	}
+	if ic == nil {
+		return nil, errors.New("docker inspect output has no Config or ContainerConfig")
+	}
+
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Env = ic.Env
+		cfg.Cmd = ic.Cmd
+		cfg.Entrypoint = ic.Entrypoint
+		cfg.WorkingDir = ic.WorkingDir
+		cfg.User = ic.User
+		cfg.Labels = ic.Labels
+		cfg.ExposedPorts = ic.ExposedPorts
+		cfg.Volumes = ic.Volumes
+	})
+}
+
+// DefaultSecretPatterns match the environment variables that RedactEnv
+// removes when it isn't given any patterns.
+var DefaultSecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^[^=]*(SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|PRIVATE_?KEY|CREDENTIALS?)[^=]*=`),
+}
+
+// RedactEnv removes the entries of base's Env that match any of patterns, or
+// DefaultSecretPatterns if none are given, e.g. to keep secrets used during a
+// build out of a published image. Patterns are matched against the whole
+// KEY=value entry, so they can look at keys, values, or both.
+//
+// It returns the keys of the removed entries, so that callers can warn about
+// them.
+func RedactEnv(base v1.Image, patterns ...*regexp.Regexp) (v1.Image, []string, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultSecretPatterns
+	}
+	var redacted []string
+	img, err := mutateConfig(base, func(cfg *v1.Config) {
+		var env []string
+		for _, kv := range cfg.Env {
+			if matchesAny(patterns, kv) {
+				redacted = append(redacted, envKey(kv))
+			} else {
+				env = append(env, kv)
+			}
+		}
+		if len(redacted) > 0 {
+			cfg.Env = env
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, redacted, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserNumeric sets the user of base to the numeric "uid:gid", which unlike a
+// user name doesn't need to be resolved through /etc/passwd when a container
+// starts, e.g. in distroless images.
+func UserNumeric(base v1.Image, uid, gid int) (v1.Image, error) {
+	if uid < 0 || gid < 0 {
+		return nil, fmt.Errorf("invalid user %d:%d: ids must be non-negative", uid, gid)
+	}
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.User = fmt.Sprintf("%d:%d", uid, gid)
+	})
+}
+
+// UserByName sets the user of base to the numeric "uid:gid" of the user
+// named username in the image's /etc/passwd, so that, unlike with the name,
+// starting a container doesn't depend on looking it up.
+//
+// This flattens the image until it finds /etc/passwd, so it can be expensive.
+func UserByName(base v1.Image, username string) (v1.Image, error) {
+	var passwd []byte
+	if err := walkFlattened(base, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg || cleanPath(header.Name) != "etc/passwd" {
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		passwd = b
+		return errStopWalk
+	}); err != nil && err != errStopWalk {
+		return nil, err
+	}
+	if passwd == nil {
+		return nil, errors.New("image has no /etc/passwd")
+	}
+
+	for n, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != username {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("/etc/passwd line %d: invalid uid %q", n+1, fields[2])
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("/etc/passwd line %d: invalid gid %q", n+1, fields[3])
+		}
+		return UserNumeric(base, uid, gid)
+	}
+	return nil, fmt.Errorf("user %q not found in /etc/passwd", username)
+}
+
+// errStopWalk stops walkFlattened early without reporting an error.
+var errStopWalk = errors.New("stop walk")
+
+// NonRootUser is the numeric user and group of the "nonroot" user of
+// distroless images.
+const NonRootUser = "65532:65532"
+
+// StaticBinary configures base to run a single static binary, e.g. a Go
+// program on top of scratch or distroless. It sets the Entrypoint to
+// entrypoint and the User to NonRootUser, and clears the Cmd, Shell, OnBuild
+// and Healthcheck. The rest of the config, such as Env and Labels, is kept.
+func StaticBinary(base v1.Image, entrypoint []string) (v1.Image, error) {
+	if len(entrypoint) == 0 {
+		return nil, errors.New("entrypoint must not be empty")
+	}
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Entrypoint = append([]string(nil), entrypoint...)
+		cfg.Cmd = nil
+		cfg.User = NonRootUser
+		cfg.Shell = nil
+		cfg.OnBuild = nil
+		cfg.Healthcheck = nil
+	})
+}
+
+// ValidateLabels returns an error naming the labels of img whose keys don't
+// start with any of allowedPrefixes, e.g. to enforce that every label is
+// under "com.example.". It doesn't change img.
+func ValidateLabels(img v1.Image, allowedPrefixes []string) error {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	var offending []string
+	for key := range cf.Config.Labels {
+		allowed := false
+		for _, prefix := range allowedPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			offending = append(offending, key)
+		}
+	}
+	if len(offending) > 0 {
+		sort.Strings(offending)
+		return fmt.Errorf("labels without an allowed prefix %q: %s", allowedPrefixes, strings.Join(offending, ", "))
+	}
+	return nil
+}
+
+// CopyConfigFields copies the named fields of src's config, e.g. "Env" or
+// "Entrypoint", into dst's config, leaving dst's other fields alone. Fields
+// are named as in v1.Config, and unknown names are an error.
+func CopyConfigFields(dst, src v1.Image, fields ...string) (v1.Image, error) {
+	scf, err := src.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	from := reflect.ValueOf(scf.Config.DeepCopy()).Elem()
+	for _, field := range fields {
+		if !from.FieldByName(field).IsValid() {
+			return nil, fmt.Errorf("unknown config field %q", field)
+		}
+	}
+
+	return mutateConfig(dst, func(cfg *v1.Config) {
+		to := reflect.ValueOf(cfg).Elem()
+		for _, field := range fields {
+			to.FieldByName(field).Set(from.FieldByName(field))
+		}
+	})
+}
+
+// armArchitectures maps the variants of ARM to their architecture.
+var armArchitectures = map[string]string{
+	"v5": "arm",
+	"v6": "arm",
+	"v7": "arm",
+	"v8": "arm64",
+}
+
+// ArmVariant sets the variant of base's platform to the given ARM variant,
+// one of v5, v6, v7 or v8, along with the matching architecture: "arm64" for
+// v8, and "arm" otherwise.
+func ArmVariant(base v1.Image, variant string) (v1.Image, error) {
+	arch, ok := armArchitectures[variant]
+	if !ok {
+		return nil, fmt.Errorf("unknown arm variant %q, want one of v5, v6, v7 or v8", variant)
+	}
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		cf.Architecture = arch
+		cf.Variant = variant
+	})
+}
+
+// Architecture sets the architecture of base's platform, e.g. "arm64".
+func Architecture(base v1.Image, arch string) (v1.Image, error) {
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		cf.Architecture = arch
+	})
+}
+
+// OS sets the operating system of base's platform, e.g. "windows".
+func OS(base v1.Image, os string) (v1.Image, error) {
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		cf.OS = os
+	})
+}
+
+// Platform sets the architecture, operating system, OS version, OS features
+// and variant of base's platform to those of p. Its CPU features have no
+// equivalent in the config file, and are ignored.
+func Platform(base v1.Image, p v1.Platform) (v1.Image, error) {
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		cf.Architecture = p.Architecture
+		cf.OS = p.OS
+		cf.OSVersion = p.OSVersion
+		cf.OSFeatures = append([]string(nil), p.OSFeatures...)
+		cf.Variant = p.Variant
+	})
+}
+
+// ConfigPerArch sets the config of base to the entry of overrides for its
+// architecture, e.g. to use a platform-specific entrypoint when building the
+// same image for several architectures. Keys are architectures, such as
+// "amd64", optionally with a variant, such as "arm/v7", which is preferred
+// when it matches. The entry for "" is the default for other architectures.
+func ConfigPerArch(base v1.Image, overrides map[string]v1.Config) (v1.Image, error) {
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{cf.Architecture, ""}
+	if cf.Variant != "" {
+		keys = append([]string{cf.Architecture + "/" + cf.Variant}, keys...)
+	}
+	for _, key := range keys {
+		if cfg, ok := overrides[key]; ok {
+			return Config(base, *cfg.DeepCopy())
+		}
+	}
+	return nil, fmt.Errorf("no config for architecture %q, and no default", cf.Architecture)
+}
+
+// ClearEnv removes every environment variable from base's config, e.g. for
+// hardened images that must not inherit any environment from their base.
+func ClearEnv(base v1.Image) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Env = nil
+	})
+}
+
+// Entrypoint sets the entrypoint of base's config.
+func Entrypoint(base v1.Image, entrypoint []string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Entrypoint = append([]string(nil), entrypoint...)
+	})
+}
+
+// Cmd sets the command of base's config, i.e. the default arguments to its
+// entrypoint.
+func Cmd(base v1.Image, cmd []string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Cmd = append([]string(nil), cmd...)
+	})
+}
+
+// WorkingDir sets the working directory of base's config.
+func WorkingDir(base v1.Image, dir string) (v1.Image, error) {
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.WorkingDir = dir
+	})
+}
+
+// Env merges env into the environment of base's config. Existing variables
+// are updated in place, and new ones are appended sorted by name.
+func Env(base v1.Image, env map[string]string) (v1.Image, error) {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	updates := make([]string, 0, len(keys))
+	for _, k := range keys {
+		updates = append(updates, k+"="+env[k])
+	}
+	return mutateConfig(base, func(cfg *v1.Config) {
+		cfg.Env = mergeEnv(cfg.Env, updates)
+	})
+}
+
+// mutateConfigFile returns base with its config file changed by fn, which
+// is given a copy. If fn changes nothing, base itself is returned.
+func mutateConfigFile(base v1.Image, fn func(*v1.ConfigFile)) (v1.Image, error) {
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	changed := cf.DeepCopy()
+	fn(changed)
+	if reflect.DeepEqual(cf, changed) {
+		return base, nil
+	}
+	return configFile(base, m, changed)
+}
+
+// mutateConfig returns an image like base, but whose config has been changed
+// by fn. fn is given a copy of base's config, so it may change it freely.
+func mutateConfig(base v1.Image, fn func(*v1.Config)) (v1.Image, error) {
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg := cf.Config.DeepCopy()
+	fn(cfg)
+	return Config(base, *cfg)
+}
@@ -0,0 +1,989 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+)
+
+func TestConfigDelta(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cfg := getConfigFile(t, base).Config.DeepCopy()
+	cfg.Env = []string{"FOO=bar"}
+	cfg.User = "nobody"
+	derived, err := Config(base, *cfg)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		base, derived v1.Image
+		want          map[string]bool
+	}{{
+		name:    "unchanged",
+		base:    base,
+		derived: base,
+		want:    map[string]bool{},
+	}, {
+		name:    "env and user",
+		base:    base,
+		derived: derived,
+		want:    map[string]bool{"Env": true, "User": true},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ConfigDelta(tc.base, tc.derived)
+			if err != nil {
+				t.Fatalf("ConfigDelta: %v", err)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("ConfigDelta (-got, +want) %s", diff)
+			}
+		})
+	}
+}
+
+func TestEntrypointForOS(t *testing.T) {
+	posix := []string{"/bin/sh", "-c", "app"}
+	windows := []string{"cmd", "/S", "/C", "app.exe"}
+
+	for _, tc := range []struct {
+		os   string
+		want []string
+	}{
+		{"linux", posix},
+		{"", posix},
+		{"windows", windows},
+	} {
+		t.Run(tc.os, func(t *testing.T) {
+			img, err := random.Image(100, 1)
+			if err != nil {
+				t.Fatalf("random.Image: %v", err)
+			}
+			cf := getConfigFile(t, img).DeepCopy()
+			cf.OS = tc.os
+			base := &configFileImage{Image: img, configFile: cf}
+
+			img, err = EntrypointForOS(base, posix, windows)
+			if err != nil {
+				t.Fatalf("EntrypointForOS: %v", err)
+			}
+			if diff := cmp.Diff(getConfigFile(t, img).Config.Entrypoint, tc.want); diff != "" {
+				t.Errorf("Entrypoint (-got, +want) %s", diff)
+			}
+			cn, err := img.ConfigName()
+			if err != nil {
+				t.Fatalf("ConfigName: %v", err)
+			}
+			if got := getManifest(t, img).Config.Digest; got != cn {
+				t.Errorf("manifest config digest = %v, want %v", got, cn)
+			}
+		})
+	}
+}
+
+// configFileImage overrides the config file of the wrapped image.
+type configFileImage struct {
+	v1.Image
+	configFile *v1.ConfigFile
+}
+
+func (i *configFileImage) ConfigFile() (*v1.ConfigFile, error) {
+	return i.configFile, nil
+}
+
+func TestEnvFromReader(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cfg := getConfigFile(t, img).Config.DeepCopy()
+	cfg.Env = []string{"PATH=/bin", "HOME=/root"}
+	base, err := Config(img, *cfg)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	dotenv := `# comment
+
+HOME=/home/app
+export MODE=prod
+GREETING="hello\tworld"
+LITERAL='$HOME\n'
+EMPTY=
+`
+	result, err := EnvFromReader(base, strings.NewReader(dotenv))
+	if err != nil {
+		t.Fatalf("EnvFromReader: %v", err)
+	}
+	want := []string{
+		"PATH=/bin",
+		"HOME=/home/app",
+		"MODE=prod",
+		"GREETING=hello\tworld",
+		`LITERAL=$HOME\n`,
+		"EMPTY=",
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config.Env, want); diff != "" {
+		t.Errorf("Env (-got, +want) %s", diff)
+	}
+}
+
+func TestEnvFromReaderErrors(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	for _, tc := range []struct {
+		dotenv string
+		want   string
+	}{
+		{"A=1\nnot a variable\n", "line 2: "},
+		{"=value\n", "line 1: "},
+		{"\n\nQUOTED=\"unterminated\n", "line 3: "},
+	} {
+		_, err := EnvFromReader(base, strings.NewReader(tc.dotenv))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("EnvFromReader(%q) = %v, want error starting with %q", tc.dotenv, err, tc.want)
+		}
+	}
+}
+
+func TestLayerLabels(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cfg := getConfigFile(t, img).Config.DeepCopy()
+	cfg.Labels = map[string]string{"base": "base", "team": "base"}
+	base, err := Config(img, *cfg)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := LayerLabels(base,
+		map[string]string{"org": "org", "team": "org", "build": "org"},
+		map[string]string{"team": "team", "build": "team"},
+		map[string]string{"build": "build"},
+	)
+	if err != nil {
+		t.Fatalf("LayerLabels: %v", err)
+	}
+	want := map[string]string{
+		"base":  "base",
+		"org":   "org",
+		"team":  "team",
+		"build": "build",
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config.Labels, want); diff != "" {
+		t.Errorf("Labels (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(getConfigFile(t, base).Config.Labels, cfg.Labels); diff != "" {
+		t.Errorf("base labels were modified (-got, +want) %s", diff)
+	}
+}
+
+func TestValidateConfigSize(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cfg := getConfigFile(t, img).Config.DeepCopy()
+	cfg.Env = []string{"PATH=/bin", "HUGE=" + strings.Repeat("x", 4096)}
+	cfg.Labels = map[string]string{"big": strings.Repeat("y", 2048)}
+	img, err = Config(img, *cfg)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	if err := ValidateConfigSize(img, 0); err != nil {
+		t.Errorf("ValidateConfigSize(0) = %v", err)
+	}
+	if err := ValidateConfigSize(img, 1<<20); err != nil {
+		t.Errorf("ValidateConfigSize(1MiB) = %v", err)
+	}
+
+	err = ValidateConfigSize(img, 1024)
+	if err == nil {
+		t.Fatal("ValidateConfigSize(1KiB) = nil, want error")
+	}
+	msg := err.Error()
+	first, second := strings.Index(msg, "Env HUGE"), strings.Index(msg, "label big")
+	if first < 0 || second < first {
+		t.Errorf("ValidateConfigSize(1KiB) = %q, want Env HUGE then label big", msg)
+	}
+}
+
+func TestAppendOnBuild(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{OnBuild: []string{"ADD . /app", "RUN make"}})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := AppendOnBuild(base, "RUN make", "RUN make test", "RUN make test")
+	if err != nil {
+		t.Fatalf("AppendOnBuild: %v", err)
+	}
+	want := []string{"ADD . /app", "RUN make", "RUN make test"}
+	if diff := cmp.Diff(getConfigFile(t, result).Config.OnBuild, want); diff != "" {
+		t.Errorf("OnBuild (-got, +want) %s", diff)
+	}
+
+	baseDigest, err := base.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	gotDigest, err := result.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	if gotDigest == baseDigest {
+		t.Error("AppendOnBuild didn't change the config digest")
+	}
+	if got := getManifest(t, result).Config.Digest; got != gotDigest {
+		t.Errorf("manifest config digest = %v, want %v", got, gotDigest)
+	}
+}
+
+func TestCanonicalConfigJSON(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	img, err = Config(img, v1.Config{
+		Labels: map[string]string{"zebra": "z", "apple": "a", "mango": "m"},
+		Env:    []string{"B=2", "A=1"},
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	digest, err := img.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+
+	first, err := CanonicalConfigJSON(img)
+	if err != nil {
+		t.Fatalf("CanonicalConfigJSON: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		got, err := CanonicalConfigJSON(img)
+		if err != nil {
+			t.Fatalf("CanonicalConfigJSON: %v", err)
+		}
+		if diff := cmp.Diff(string(got), string(first)); diff != "" {
+			t.Fatalf("CanonicalConfigJSON is not deterministic (-got, +want) %s", diff)
+		}
+	}
+
+	s := string(first)
+	if a, m, z := strings.Index(s, `"apple"`), strings.Index(s, `"mango"`), strings.Index(s, `"zebra"`); !(a < m && m < z) {
+		t.Errorf("labels are not sorted:\n%s", s)
+	}
+	if !strings.Contains(s, "\n  \"config\": {") {
+		t.Errorf("CanonicalConfigJSON is not indented:\n%s", s)
+	}
+	if got, err := img.ConfigName(); err != nil || got != digest {
+		t.Errorf("ConfigName() = %v, %v; want %v", got, err, digest)
+	}
+}
+
+func TestConfigFromDockerInspect(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{
+		Env:        []string{"OLD=1"},
+		Hostname:   "base",
+		StopSignal: "SIGTERM",
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	inspect := `[{
+		"Id": "abc123",
+		"Config": {
+			"Hostname": "container",
+			"User": "app",
+			"Env": ["PATH=/usr/bin", "MODE=prod"],
+			"Cmd": ["--serve"],
+			"Entrypoint": ["/app"],
+			"WorkingDir": "/srv",
+			"Labels": {"team": "infra"},
+			"ExposedPorts": {"8080/tcp": {}},
+			"Volumes": {"/data": {}}
+		}
+	}]`
+	result, err := ConfigFromDockerInspect(base, []byte(inspect))
+	if err != nil {
+		t.Fatalf("ConfigFromDockerInspect: %v", err)
+	}
+	want := v1.Config{
+		Hostname:     "base",
+		StopSignal:   "SIGTERM",
+		User:         "app",
+		Env:          []string{"PATH=/usr/bin", "MODE=prod"},
+		Cmd:          []string{"--serve"},
+		Entrypoint:   []string{"/app"},
+		WorkingDir:   "/srv",
+		Labels:       map[string]string{"team": "infra"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		Volumes:      map[string]struct{}{"/data": {}},
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+
+	// A single object with only a ContainerConfig works too.
+	result, err = ConfigFromDockerInspect(base, []byte(`{"ContainerConfig": {"User": "nobody"}}`))
+	if err != nil {
+		t.Fatalf("ConfigFromDockerInspect: %v", err)
+	}
+	if got, want := getConfigFile(t, result).Config.User, "nobody"; got != want {
+		t.Errorf("User = %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{`not json`, `[]`, `[{"Id": "abc"}]`} {
+		if _, err := ConfigFromDockerInspect(base, []byte(bad)); err == nil {
+			t.Errorf("ConfigFromDockerInspect(%s) = nil error, want error", bad)
+		}
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{Env: []string{
+		"PATH=/bin",
+		"AWS_SECRET_ACCESS_KEY=abc",
+		"GITHUB_TOKEN=ghp_xyz",
+		"db_password=hunter2",
+		"MODE=prod",
+		"DATABASE_URL=postgres://user:pass@db/app",
+	}})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		patterns     []*regexp.Regexp
+		wantEnv      []string
+		wantRedacted []string
+	}{{
+		name:         "default patterns",
+		wantEnv:      []string{"PATH=/bin", "MODE=prod", "DATABASE_URL=postgres://user:pass@db/app"},
+		wantRedacted: []string{"AWS_SECRET_ACCESS_KEY", "GITHUB_TOKEN", "db_password"},
+	}, {
+		name:         "custom patterns",
+		patterns:     []*regexp.Regexp{regexp.MustCompile(`://[^/]*:[^/]*@`), regexp.MustCompile(`^MODE=`)},
+		wantEnv:      []string{"PATH=/bin", "AWS_SECRET_ACCESS_KEY=abc", "GITHUB_TOKEN=ghp_xyz", "db_password=hunter2"},
+		wantRedacted: []string{"MODE", "DATABASE_URL"},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			result, redacted, err := RedactEnv(base, test.patterns...)
+			if err != nil {
+				t.Fatalf("RedactEnv: %v", err)
+			}
+			if diff := cmp.Diff(redacted, test.wantRedacted); diff != "" {
+				t.Errorf("redacted (-got, +want) %s", diff)
+			}
+			if diff := cmp.Diff(getConfigFile(t, result).Config.Env, test.wantEnv); diff != "" {
+				t.Errorf("Env (-got, +want) %s", diff)
+			}
+			if got := getManifest(t, result).Config.Digest; got == getManifest(t, base).Config.Digest {
+				t.Error("RedactEnv didn't change the config digest")
+			}
+		})
+	}
+
+	clean, err := Config(img, v1.Config{Env: []string{"PATH=/bin"}})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	result, redacted, err := RedactEnv(clean)
+	if err != nil {
+		t.Fatalf("RedactEnv: %v", err)
+	}
+	if result != clean || redacted != nil {
+		t.Errorf("RedactEnv of a clean image = %v, %v; want it unchanged", result, redacted)
+	}
+}
+
+func TestUserNumeric(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{User: "root", WorkingDir: "/app"})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := UserNumeric(base, 65532, 65532)
+	if err != nil {
+		t.Fatalf("UserNumeric: %v", err)
+	}
+	want := v1.Config{User: "65532:65532", WorkingDir: "/app"}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	if got := getManifest(t, result).Config.Digest; got == getManifest(t, base).Config.Digest {
+		t.Error("UserNumeric didn't change the config digest")
+	}
+
+	if _, err := UserNumeric(base, 0, 0); err != nil {
+		t.Errorf("UserNumeric(0, 0) = %v", err)
+	}
+	for _, ids := range [][2]int{{-1, 0}, {0, -1}} {
+		if _, err := UserNumeric(base, ids[0], ids[1]); err == nil {
+			t.Errorf("UserNumeric(%d, %d) = nil error, want error", ids[0], ids[1])
+		}
+	}
+}
+
+func TestUserByName(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("etc/passwd", "root:x:0:0:root:/root:/bin/sh\nold:x:1:1::/:/bin/false\n")),
+		tarLayer(t, regularFile("etc/passwd", "root:x:0:0:root:/root:/bin/sh\napp:x:1000:2000:App:/home/app:/bin/sh\nbad:x:x:1::/:/bin/false\n")),
+	)
+
+	result, err := UserByName(img, "app")
+	if err != nil {
+		t.Fatalf("UserByName: %v", err)
+	}
+	if got, want := getConfigFile(t, result).Config.User, "1000:2000"; got != want {
+		t.Errorf("User = %q, want %q", got, want)
+	}
+
+	// Users that were removed by a later layer are not found.
+	for _, name := range []string{"old", "missing", "bad"} {
+		if _, err := UserByName(img, name); err == nil {
+			t.Errorf("UserByName(%q) = nil error, want error", name)
+		}
+	}
+
+	if _, err := UserByName(imageFromLayers(t, tarLayer(t, regularFile("etc/group", "root:x:0:"))), "root"); err == nil {
+		t.Error("UserByName without /etc/passwd = nil error, want error")
+	}
+}
+
+func TestStaticBinary(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{
+		Entrypoint:  []string{"/bin/sh", "-c"},
+		Cmd:         []string{"echo hi"},
+		User:        "root",
+		Shell:       []string{"/bin/bash", "-c"},
+		OnBuild:     []string{"RUN make"},
+		Healthcheck: &v1.HealthConfig{Test: []string{"CMD", "true"}},
+		Env:         []string{"PATH=/bin"},
+		Labels:      map[string]string{"app": "server"},
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := StaticBinary(base, []string{"/server", "--port=8080"})
+	if err != nil {
+		t.Fatalf("StaticBinary: %v", err)
+	}
+	want := v1.Config{
+		Entrypoint: []string{"/server", "--port=8080"},
+		User:       NonRootUser,
+		Env:        []string{"PATH=/bin"},
+		Labels:     map[string]string{"app": "server"},
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	if got := getManifest(t, result).Config.Digest; got == getManifest(t, base).Config.Digest {
+		t.Error("StaticBinary didn't change the config digest")
+	}
+
+	if _, err := StaticBinary(base, nil); err == nil {
+		t.Error("StaticBinary(nil) = nil error, want error")
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	prefixes := []string{"com.example.", "org.opencontainers.image."}
+
+	for _, test := range []struct {
+		name    string
+		labels  map[string]string
+		wantErr string
+	}{{
+		name: "no labels",
+	}, {
+		name: "conforming",
+		labels: map[string]string{
+			"com.example.team":                 "infra",
+			"org.opencontainers.image.version": "1.0",
+		},
+	}, {
+		name: "non-conforming",
+		labels: map[string]string{
+			"com.example.team": "infra",
+			"maintainer":       "me",
+			"com.other.team":   "other",
+		},
+		wantErr: `labels without an allowed prefix ["com.example." "org.opencontainers.image."]: com.other.team, maintainer`,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := Config(img, v1.Config{Labels: test.labels})
+			if err != nil {
+				t.Fatalf("Config: %v", err)
+			}
+			err = ValidateLabels(img, prefixes)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.wantErr {
+				t.Errorf("ValidateLabels() = %q, want %q", got, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyConfigFields(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	dst, err := Config(img, v1.Config{
+		Env:        []string{"DST=1"},
+		Entrypoint: []string{"/dst"},
+		User:       "dst",
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	src, err := Config(img, v1.Config{
+		Env:        []string{"SRC=1"},
+		Entrypoint: []string{"/src"},
+		User:       "src",
+		WorkingDir: "/src",
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := CopyConfigFields(dst, src, "Env", "Entrypoint")
+	if err != nil {
+		t.Fatalf("CopyConfigFields: %v", err)
+	}
+	want := v1.Config{
+		Env:        []string{"SRC=1"},
+		Entrypoint: []string{"/src"},
+		User:       "dst",
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	if got := getManifest(t, result).Config.Digest; got == getManifest(t, dst).Config.Digest {
+		t.Error("CopyConfigFields didn't change the config digest")
+	}
+
+	// The copied fields don't alias src's config.
+	getConfigFile(t, result).Config.Env[0] = "CHANGED=1"
+	if got := getConfigFile(t, src).Config.Env[0]; got != "SRC=1" {
+		t.Errorf("src Env = %q, want it unchanged", got)
+	}
+
+	if _, err := CopyConfigFields(dst, src, "Env", "Bogus"); err == nil {
+		t.Error("CopyConfigFields(Bogus) = nil error, want error")
+	}
+}
+
+func TestArmVariant(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	for variant, arch := range map[string]string{
+		"v5": "arm",
+		"v6": "arm",
+		"v7": "arm",
+		"v8": "arm64",
+	} {
+		img, err := ArmVariant(base, variant)
+		if err != nil {
+			t.Fatalf("ArmVariant(%s): %v", variant, err)
+		}
+		cf := getConfigFile(t, img)
+		if cf.Architecture != arch || cf.Variant != variant {
+			t.Errorf("ArmVariant(%s) = %s/%s, want %s/%s", variant, cf.Architecture, cf.Variant, arch, variant)
+		}
+		digest, err := img.ConfigName()
+		if err != nil {
+			t.Fatalf("ConfigName: %v", err)
+		}
+		if got := getManifest(t, img).Config.Digest; got != digest {
+			t.Errorf("manifest config digest = %v, want %v", got, digest)
+		}
+		if again, err := ArmVariant(img, variant); err != nil || again != img {
+			t.Errorf("ArmVariant(%s) twice = %v, %v; want the image unchanged", variant, again, err)
+		}
+	}
+
+	for _, variant := range []string{"", "v9", "7", "armv7"} {
+		if _, err := ArmVariant(base, variant); err == nil {
+			t.Errorf("ArmVariant(%q) = nil error, want error", variant)
+		}
+	}
+}
+
+func TestClearEnv(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{Env: []string{"PATH=/bin", "HOME=/root"}, User: "app"})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	result, err := ClearEnv(base)
+	if err != nil {
+		t.Fatalf("ClearEnv: %v", err)
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, v1.Config{User: "app"}); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	raw, err := result.RawConfigFile()
+	if err != nil {
+		t.Fatalf("RawConfigFile: %v", err)
+	}
+	var parsed struct {
+		Config struct {
+			Env []string
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(parsed.Config.Env) != 0 {
+		t.Errorf("serialized Env = %v, want none", parsed.Config.Env)
+	}
+	if got := getManifest(t, result).Config.Digest; got == getManifest(t, base).Config.Digest {
+		t.Error("ClearEnv didn't change the config digest")
+	}
+}
+
+func TestConfigSetters(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{
+		Entrypoint: []string{"/old"},
+		Env:        []string{"PATH=/bin", "HOME=/root", "LANG=C"},
+		User:       "app",
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	entrypoint := []string{"/app", "--serve"}
+	result, err := Entrypoint(base, entrypoint)
+	if err != nil {
+		t.Fatalf("Entrypoint: %v", err)
+	}
+	entrypoint[0] = "/changed"
+	if result, err = Cmd(result, []string{"--port", "8080"}); err != nil {
+		t.Fatalf("Cmd: %v", err)
+	}
+	if result, err = WorkingDir(result, "/srv"); err != nil {
+		t.Fatalf("WorkingDir: %v", err)
+	}
+	if result, err = Env(result, map[string]string{"HOME": "/home/app", "ZONE": "eu", "DEBUG": "1"}); err != nil {
+		t.Fatalf("Env: %v", err)
+	}
+
+	want := v1.Config{
+		Entrypoint: []string{"/app", "--serve"},
+		Cmd:        []string{"--port", "8080"},
+		WorkingDir: "/srv",
+		Env:        []string{"PATH=/bin", "HOME=/home/app", "LANG=C", "DEBUG=1", "ZONE=eu"},
+		User:       "app",
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(getConfigFile(t, base).Config.Entrypoint, []string{"/old"}); diff != "" {
+		t.Errorf("base Entrypoint changed (-got, +want) %s", diff)
+	}
+}
+
+func TestConfigUnchanged(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{
+		Entrypoint: []string{"/app"},
+		Env:        []string{"PATH=/bin"},
+		WorkingDir: "/srv",
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	for name, mutate := range map[string]func() (v1.Image, error){
+		"Config":      func() (v1.Image, error) { return Config(base, *getConfigFile(t, base).Config.DeepCopy()) },
+		"Entrypoint":  func() (v1.Image, error) { return Entrypoint(base, []string{"/app"}) },
+		"WorkingDir":  func() (v1.Image, error) { return WorkingDir(base, "/srv") },
+		"Env":         func() (v1.Image, error) { return Env(base, map[string]string{"PATH": "/bin"}) },
+		"Annotations": func() (v1.Image, error) { return Annotations(base, map[string]string{"missing": ""}) },
+		"MediaType": func() (v1.Image, error) {
+			mt, err := base.MediaType()
+			if err != nil {
+				return nil, err
+			}
+			return MediaType(base, mt)
+		},
+	} {
+		result, err := mutate()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result != base {
+			t.Errorf("%s without changes returned a new image", name)
+		}
+	}
+
+	result, err := Cmd(base, []string{"--help"})
+	if err != nil {
+		t.Fatalf("Cmd: %v", err)
+	}
+	if result == base {
+		t.Error("Cmd with a change returned base")
+	}
+}
+
+func TestConfigPerArch(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	withPlatform := func(arch, variant string) v1.Image {
+		cf := getConfigFile(t, img).DeepCopy()
+		cf.Architecture, cf.Variant = arch, variant
+		result, err := configFile(img, getManifest(t, img), cf)
+		if err != nil {
+			t.Fatalf("configFile: %v", err)
+		}
+		return result
+	}
+	overrides := map[string]v1.Config{
+		"amd64":  {Entrypoint: []string{"/app-amd64"}},
+		"arm64":  {Entrypoint: []string{"/app-arm64"}},
+		"arm/v7": {Entrypoint: []string{"/app-armv7"}},
+		"":       {Entrypoint: []string{"/app"}},
+	}
+
+	for _, tc := range []struct {
+		arch, variant string
+		want          string
+	}{
+		{"amd64", "", "/app-amd64"},
+		{"arm64", "v8", "/app-arm64"},
+		{"arm", "v7", "/app-armv7"},
+		{"arm", "v6", "/app"},
+		{"s390x", "", "/app"},
+	} {
+		result, err := ConfigPerArch(withPlatform(tc.arch, tc.variant), overrides)
+		if err != nil {
+			t.Fatalf("ConfigPerArch(%s/%s): %v", tc.arch, tc.variant, err)
+		}
+		if got := getConfigFile(t, result).Config.Entrypoint; len(got) != 1 || got[0] != tc.want {
+			t.Errorf("ConfigPerArch(%s/%s) entrypoint = %v, want [%s]", tc.arch, tc.variant, got, tc.want)
+		}
+	}
+
+	delete(overrides, "")
+	if _, err := ConfigPerArch(withPlatform("s390x", ""), overrides); err == nil {
+		t.Error("ConfigPerArch without a match or default: got nil error")
+	}
+}
+
+func TestEnsureLabel(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := EnsureLabel(img, "team", "user")
+	if err != nil {
+		t.Fatalf("EnsureLabel (absent): %v", err)
+	}
+	if diff := cmp.Diff(getConfigFile(t, base).Config.Labels, map[string]string{"team": "user"}); diff != "" {
+		t.Errorf("Labels (-got, +want) %s", diff)
+	}
+
+	result, err := EnsureLabel(base, "team", "default")
+	if err != nil {
+		t.Fatalf("EnsureLabel (present): %v", err)
+	}
+	if result != base {
+		t.Error("EnsureLabel with a present key didn't return base")
+	}
+	if got, want := getConfigFile(t, result).Config.Labels["team"], "user"; got != want {
+		t.Errorf("Labels[team] = %q, want %q", got, want)
+	}
+
+	// A present label with an empty value is kept, too.
+	empty, err := LayerLabels(img, map[string]string{"team": ""})
+	if err != nil {
+		t.Fatalf("LayerLabels: %v", err)
+	}
+	if result, err := EnsureLabel(empty, "team", "default"); err != nil || result != empty {
+		t.Errorf("EnsureLabel (empty value) = %v, %v; want base", result, err)
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	arm, err := Architecture(img, "arm64")
+	if err != nil {
+		t.Fatalf("Architecture: %v", err)
+	}
+	windows, err := OS(arm, "windows")
+	if err != nil {
+		t.Fatalf("OS: %v", err)
+	}
+	cf := getConfigFile(t, windows)
+	if cf.Architecture != "arm64" || cf.OS != "windows" {
+		t.Errorf("platform = %s/%s, want windows/arm64", cf.OS, cf.Architecture)
+	}
+	if got := getConfigFile(t, img).Architecture; got == "arm64" {
+		t.Error("Architecture modified base")
+	}
+	if result, err := OS(windows, "windows"); err != nil || result != windows {
+		t.Errorf("OS (unchanged) = %v, %v; want base", result, err)
+	}
+
+	p := v1.Platform{
+		Architecture: "amd64",
+		OS:           "windows",
+		OSVersion:    "10.0.17763.1039",
+		OSFeatures:   []string{"win32k"},
+		Variant:      "v2",
+	}
+	result, err := Platform(windows, p)
+	if err != nil {
+		t.Fatalf("Platform: %v", err)
+	}
+	cf = getConfigFile(t, result)
+	got := v1.Platform{
+		Architecture: cf.Architecture,
+		OS:           cf.OS,
+		OSVersion:    cf.OSVersion,
+		OSFeatures:   cf.OSFeatures,
+		Variant:      cf.Variant,
+	}
+	if diff := cmp.Diff(got, p); diff != "" {
+		t.Errorf("Platform (-got, +want) %s", diff)
+	}
+	rcfg, err := result.RawConfigFile()
+	if err != nil {
+		t.Fatalf("RawConfigFile: %v", err)
+	}
+	want, _, err := v1.SHA256(bytes.NewReader(rcfg))
+	if err != nil {
+		t.Fatalf("SHA256: %v", err)
+	}
+	if got := getManifest(t, result).Config.Digest; got != want {
+		t.Errorf("manifest config digest = %v, want %v", got, want)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	base, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cf := getConfigFile(t, base).DeepCopy()
+	cf.Config.Cmd = []string{"--help"}
+	if base, err = ConfigFile(base, cf); err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+
+	cf = getConfigFile(t, base).DeepCopy()
+	cf.Config.Cmd = nil
+	cf.Created = v1.Time{Time: time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)}
+	cf.Architecture = "arm64"
+	result, err := ConfigFile(base, cf)
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	if diff := cmp.Diff(getConfigFile(t, result), cf); diff != "" {
+		t.Errorf("ConfigFile (-got, +want) %s", diff)
+	}
+	if got := getConfigFile(t, base).Config.Cmd; len(got) != 1 {
+		t.Errorf("base Cmd = %v, want it unchanged", got)
+	}
+	cf.Architecture = "changed"
+	if got := getConfigFile(t, result).Architecture; got != "arm64" {
+		t.Errorf("ConfigFile kept a reference to its argument: Architecture = %q", got)
+	}
+
+	if result, err := ConfigFile(base, getConfigFile(t, base).DeepCopy()); err != nil || result != base {
+		t.Errorf("ConfigFile (unchanged) = %v, %v; want base", result, err)
+	}
+
+	cf = getConfigFile(t, base).DeepCopy()
+	cf.RootFS.DiffIDs = cf.RootFS.DiffIDs[:1]
+	if _, err := ConfigFile(base, cf); err == nil {
+		t.Error("ConfigFile with a missing diff id: expected an error")
+	}
+	cf = getConfigFile(t, base).DeepCopy()
+	cf.RootFS.DiffIDs[0], cf.RootFS.DiffIDs[1] = cf.RootFS.DiffIDs[1], cf.RootFS.DiffIDs[0]
+	if _, err := ConfigFile(base, cf); err == nil {
+		t.Error("ConfigFile with reordered diff ids: expected an error")
+	}
+}
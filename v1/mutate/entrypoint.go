@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// defaultPath is the PATH that container runtimes use when the image's
+// environment doesn't set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// maxSymlinks bounds the number of symlinks followed while resolving a path.
+const maxSymlinks = 255
+
+// ValidateEntrypoint returns an error if the first element of img's
+// Entrypoint doesn't resolve to a file in its flattened filesystem, which
+// would otherwise only fail when a container is started. Names without a
+// slash are looked up in the PATH of the config's Env, and symlinks are
+// followed. For shell-form entrypoints (e.g. ["/bin/sh", "-c", "..."]) the
+// shell is checked, as well as the command it runs if that is an absolute
+// path.
+//
+// This flattens the whole image, so it is expensive.
+func ValidateEntrypoint(img v1.Image) error {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	ep := cf.Config.Entrypoint
+	if len(ep) == 0 {
+		return nil
+	}
+
+	entries := map[string]*tar.Header{}
+	if err := walkFlattened(img, func(header *tar.Header, _ io.Reader) error {
+		entries[cleanPath(header.Name)] = header
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	searchPath := defaultPath
+	for _, kv := range cf.Config.Env {
+		if envKey(kv) == "PATH" {
+			searchPath = kv[len("PATH="):]
+		}
+	}
+
+	bins := []string{ep[0]}
+	if len(ep) >= 3 && ep[1] == "-c" {
+		if fields := strings.Fields(ep[2]); len(fields) > 0 && path.IsAbs(fields[0]) {
+			bins = append(bins, fields[0])
+		}
+	}
+	for _, bin := range bins {
+		if !findExecutable(entries, bin, cf.Config.WorkingDir, searchPath) {
+			return fmt.Errorf("entrypoint %q not found in image", bin)
+		}
+	}
+	return nil
+}
+
+// findExecutable returns whether bin names a file in entries, looking it up
+// in searchPath if it doesn't contain a slash, and relative to dir otherwise.
+func findExecutable(entries map[string]*tar.Header, bin, dir, searchPath string) bool {
+	if strings.Contains(bin, "/") {
+		return isFile(entries, path.Join("/", dir, bin))
+	}
+	for _, d := range strings.Split(searchPath, ":") {
+		if d == "" {
+			d = "."
+		}
+		if isFile(entries, path.Join("/", dir, d, bin)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFile returns whether name resolves to a non-directory in entries,
+// following symlinks, including symlinked parent directories.
+func isFile(entries map[string]*tar.Header, name string) bool {
+	resolved, ok := resolveSymlinks(entries, name)
+	if !ok {
+		return false
+	}
+	header, ok := entries[resolved]
+	return ok && header.Typeflag != tar.TypeDir
+}
+
+// resolveSymlinks returns the cleaned path that name refers to in entries
+// after following all symlinks, or false if there are too many of them.
+func resolveSymlinks(entries map[string]*tar.Header, name string) (string, bool) {
+	followed := 0
+	resolved := ""
+	rest := strings.Split(cleanPath(name), "/")
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		next := cleanPath(path.Join(resolved, part))
+		header, ok := entries[next]
+		if !ok || header.Typeflag != tar.TypeSymlink {
+			resolved = next
+			continue
+		}
+		if followed++; followed > maxSymlinks {
+			return "", false
+		}
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		resolved = ""
+		rest = append(strings.Split(cleanPath(target), "/"), rest...)
+	}
+	return resolved, true
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+func TestValidateEntrypoint(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t,
+		directory("bin/"),
+		regularFile("bin/sh", "shell"),
+		directory("usr/"),
+		directory("usr/local/"),
+		directory("usr/local/bin/"),
+		regularFile("usr/local/bin/app", "app"),
+		symlink("usr/local/bin/app-link", "app"),
+		symlink("opt", "usr/local"),
+		symlink("loop", "loop"),
+		directory("work/"),
+		regularFile("work/run.sh", "run"),
+	))
+
+	for _, test := range []struct {
+		name       string
+		entrypoint []string
+		env        []string
+		workingDir string
+		wantErr    bool
+	}{{
+		name: "no entrypoint",
+	}, {
+		name:       "absolute",
+		entrypoint: []string{"/usr/local/bin/app"},
+	}, {
+		name:       "default PATH",
+		entrypoint: []string{"app", "--flag"},
+	}, {
+		name:       "custom PATH",
+		entrypoint: []string{"app"},
+		env:        []string{"PATH=/bin"},
+		wantErr:    true,
+	}, {
+		name:       "symlinked binary",
+		entrypoint: []string{"/usr/local/bin/app-link"},
+	}, {
+		name:       "symlinked directory",
+		entrypoint: []string{"/opt/bin/app"},
+	}, {
+		name:       "relative to working dir",
+		entrypoint: []string{"./run.sh"},
+		workingDir: "/work",
+	}, {
+		name:       "missing",
+		entrypoint: []string{"/usr/bin/missing"},
+		wantErr:    true,
+	}, {
+		name:       "directory",
+		entrypoint: []string{"/usr/local/bin"},
+		wantErr:    true,
+	}, {
+		name:       "symlink cycle",
+		entrypoint: []string{"/loop"},
+		wantErr:    true,
+	}, {
+		name:       "shell form",
+		entrypoint: []string{"/bin/sh", "-c", "/usr/local/bin/app --flag"},
+	}, {
+		name:       "shell form with missing command",
+		entrypoint: []string{"/bin/sh", "-c", "/usr/bin/missing"},
+		wantErr:    true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := Config(img, v1.Config{
+				Entrypoint: test.entrypoint,
+				Env:        test.env,
+				WorkingDir: test.workingDir,
+			})
+			if err != nil {
+				t.Fatalf("Config: %v", err)
+			}
+			err = ValidateEntrypoint(img)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("ValidateEntrypoint() = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// ExtractSkipPseudoFS is like Extract, but omits the contents of the /dev,
+// /proc and /sys pseudo-filesystems, such as device nodes, that badly-built
+// images sometimes include.
+func ExtractSkipPseudoFS(img v1.Image) io.ReadCloser {
+	return ExtractWithOptions(img, &ExtractOptions{SkipPseudoFS: true})
+}
+
+// ExtractFiltered is like Extract, but omits the entries of the flattened
+// filesystem that keep returns false for, e.g. to skip huge caches when
+// scanning an image. See ExtractOptions.Filter.
+func ExtractFiltered(img v1.Image, keep func(*tar.Header) bool) io.ReadCloser {
+	return ExtractWithOptions(img, &ExtractOptions{Filter: keep})
+}
+
+// SizedReader is the flattened filesystem of an image, as returned by
+// ExtractSized, along with its total size.
+type SizedReader struct {
+	io.ReadCloser
+	size int64
+}
+
+// Size returns the total number of bytes in the tar stream, or -1 if it is not
+// yet known. The size becomes available once a Read has returned io.EOF; if
+// extraction fails, or the reader is closed early, it stays -1.
+func (s *SizedReader) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+// ExtractSized is like ExtractWithOptions, but also reports the size of the
+// tar stream once it has been fully read, e.g. so that streaming consumers can
+// validate the length of what they received.
+func ExtractSized(img v1.Image, opts *ExtractOptions) *SizedReader {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	pr, pw := io.Pipe()
+	sr := &SizedReader{ReadCloser: pr, size: -1}
+
+	go func() {
+		cw := &countingWriter{w: pw}
+		err := extract(context.Background(), img, cw, opts)
+		if err == nil {
+			// Publish the size before closing the writer, so it is
+			// visible to a reader that has observed io.EOF.
+			atomic.StoreInt64(&sr.size, cw.n)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return sr
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ExtractTee writes img's flattened filesystem, as a tar stream, to each of
+// writers at once, e.g. to a file and a hasher. A writer that fails is
+// dropped while the others carry on, and extraction stops early once all of
+// them have failed. If any writer failed, the error is a *TeeError.
+func ExtractTee(img v1.Image, writers ...io.Writer) error {
+	if len(writers) == 0 {
+		return errors.New("no writers to extract to")
+	}
+	tw := &teeWriter{writers: writers, errs: make([]error, len(writers))}
+	err := extract(context.Background(), img, tw, &ExtractOptions{})
+	for _, werr := range tw.errs {
+		if werr != nil {
+			return &TeeError{Writers: tw.errs, Err: err}
+		}
+	}
+	return err
+}
+
+// TeeError is the error returned by ExtractTee when some of its writers
+// failed.
+type TeeError struct {
+	// Writers holds the error of each writer, in order, or nil for the
+	// writers that didn't fail.
+	Writers []error
+
+	// Err is the error that extraction itself returned, if any, e.g. once
+	// every writer failed.
+	Err error
+}
+
+func (e *TeeError) Error() string {
+	var msgs []string
+	for i, err := range e.Writers {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("writer %d: %v", i, err))
+		}
+	}
+	if e.Err != nil {
+		msgs = append(msgs, e.Err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors of the writers that failed, followed by Err.
+func (e *TeeError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Writers {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// teeWriter writes to each of writers that hasn't failed yet, and only fails
+// once all of them have.
+type teeWriter struct {
+	writers []io.Writer
+	errs    []error
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, w := range t.writers {
+		if t.errs[i] != nil {
+			continue
+		}
+		n, err := w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			t.errs[i] = err
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errors.New("every writer failed")
+	}
+	return len(p), nil
+}
+
+// LayerUncompressedSizes returns the uncompressed size of each of img's
+// layers, base layer first.
+//
+// Unlike the compressed sizes recorded in the manifest, these require
+// streaming the contents of every layer, which helps diagnose images that
+// compress poorly.
+func LayerUncompressedSizes(img v1.Image) ([]int64, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving image layers: %w", err)
+	}
+	sizes := make([]int64, 0, len(layers))
+	for i, layer := range layers {
+		size, err := uncompressedSize(layer)
+		if err != nil {
+			return nil, fmt.Errorf("computing uncompressed size of layer %d: %w", i, err)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func uncompressedSize(layer v1.Layer) (int64, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(ioutil.Discard, rc)
+}
+
+// FileDigests returns the sha256 of the contents of each regular file in
+// img's flattened filesystem, keyed by its cleaned path. Hardlinks map to the
+// digest of their target, while directories, symlinks and other special
+// files are omitted.
+func FileDigests(img v1.Image) (map[string]v1.Hash, error) {
+	digests := map[string]v1.Hash{}
+	links := map[string]string{}
+	if err := walkFlattened(img, func(header *tar.Header, r io.Reader) error {
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			h, _, err := v1.SHA256(r)
+			if err != nil {
+				return err
+			}
+			digests[cleanPath(header.Name)] = h
+		case tar.TypeLink:
+			links[cleanPath(header.Name)] = cleanPath(header.Linkname)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for name, target := range links {
+		if h, ok := digests[target]; ok {
+			digests[name] = h
+		}
+	}
+	return digests, nil
+}
+
+// MaxExtractMapSize is the total size of file contents above which ExtractMap
+// gives up, to avoid loading a huge image into memory.
+const MaxExtractMapSize = 64 << 20
+
+// ExtractMap returns the contents of each regular file in img's flattened
+// filesystem, keyed by its cleaned path. Hardlinks map to the contents of
+// their target.
+//
+// It is intended for tests and small images only, and fails if the files
+// add up to more than MaxExtractMapSize bytes.
+func ExtractMap(img v1.Image) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	links := map[string]string{}
+	var total int64
+	if err := walkFlattened(img, func(header *tar.Header, r io.Reader) error {
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if total += header.Size; total > MaxExtractMapSize {
+				return fmt.Errorf("image contents exceed %d bytes", MaxExtractMapSize)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			files[cleanPath(header.Name)] = b
+		case tar.TypeLink:
+			links[cleanPath(header.Name)] = cleanPath(header.Linkname)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for name, target := range links {
+		if b, ok := files[target]; ok {
+			files[name] = b
+		}
+	}
+	return files, nil
+}
+
+// ExtractDelta returns the files of derived's flattened filesystem that are
+// new or changed relative to base's, as a tar stream with whiteouts for the
+// files that base had but derived removed.
+//
+// Unlike extracting derived's top layers, this diffs the two flattened
+// filesystems, so it works even if derived wasn't built on top of base's
+// layers. Applying the result on top of base yields derived's filesystem.
+// derived is flattened twice, once to find out what changed and once to copy
+// the changed files, so that their contents aren't held in memory.
+func ExtractDelta(derived, base v1.Image) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(extractDelta(derived, base, pw))
+	}()
+	return pr
+}
+
+// deltaEntry summarizes an entry of a flattened filesystem, for comparison.
+type deltaEntry struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+	linkname string
+	digest   v1.Hash
+}
+
+func newDeltaEntry(header *tar.Header, digest v1.Hash) deltaEntry {
+	return deltaEntry{
+		typeflag: header.Typeflag,
+		mode:     header.Mode,
+		uid:      header.Uid,
+		gid:      header.Gid,
+		linkname: header.Linkname,
+		digest:   digest,
+	}
+}
+
+func extractDelta(derived, base v1.Image, w io.Writer) error {
+	baseEntries, err := deltaEntries(base)
+	if err != nil {
+		return fmt.Errorf("flattening base: %w", err)
+	}
+	// Find out what changed first, so that changed files can then be
+	// streamed without holding on to the contents of the others.
+	derivedEntries, err := deltaEntries(derived)
+	if err != nil {
+		return fmt.Errorf("flattening derived: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	if err := walkFlattened(derived, func(header *tar.Header, r io.Reader) error {
+		name := cleanPath(header.Name)
+		if old, ok := baseEntries[name]; ok && old == derivedEntries[name] {
+			return nil
+		}
+		return writeTarEntry(tw, header, r)
+	}); err != nil {
+		return fmt.Errorf("flattening derived: %w", err)
+	}
+
+	removed := map[string]bool{}
+	for _, name := range sortedDeltaNames(baseEntries) {
+		if _, ok := derivedEntries[name]; ok || name == "" {
+			continue
+		}
+		removed[name] = true
+		// Whiting out a directory removes its contents too, and so does
+		// replacing it with a non-directory. Names sort after their
+		// parent directory.
+		parent := path.Dir(name)
+		if removed[parent] {
+			continue
+		}
+		if e, ok := derivedEntries[parent]; ok && e.typeflag != tar.TypeDir {
+			continue
+		}
+		dir, file := path.Split(name)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     dir + whiteoutPrefix + file,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deltaEntries summarizes the entries of img's flattened filesystem, keyed
+// by their cleaned path.
+func deltaEntries(img v1.Image) (map[string]deltaEntry, error) {
+	entries := map[string]deltaEntry{}
+	err := walkFlattened(img, func(header *tar.Header, r io.Reader) error {
+		var h v1.Hash
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			var err error
+			if h, _, err = v1.SHA256(r); err != nil {
+				return err
+			}
+		}
+		entries[cleanPath(header.Name)] = newDeltaEntry(header, h)
+		return nil
+	})
+	return entries, err
+}
+
+// sortedDeltaNames returns the names of entries in sorted order, so that
+// directories come before their contents.
+func sortedDeltaNames(entries map[string]deltaEntry) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walkFlattened calls fn for each entry of img's flattened filesystem, with
+// a reader for the entry's contents.
+func walkFlattened(img v1.Image, fn func(*tar.Header, io.Reader) error) error {
+	rc := Extract(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,564 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// Checkpoint records the progress of ExtractToResumable, so that an
+// interrupted extraction can pick up where it left off. It is safe to
+// persist as JSON between attempts.
+type Checkpoint struct {
+	// Image is the digest of the image being extracted.
+	Image v1.Hash `json:"image"`
+
+	// Layers is the number of layers, counted from the top of the image,
+	// that have been fully written.
+	Layers int `json:"layers"`
+
+	// Seen records the paths handled by the written layers, which is
+	// needed to keep resolving whiteouts correctly on resume.
+	Seen map[string]bool `json:"seen,omitempty"`
+
+	// Opaque records the directories made opaque by the written layers,
+	// whose contents in the layers below must stay hidden on resume.
+	Opaque map[string]bool `json:"opaque,omitempty"`
+
+	// Links and Symlinks record the hardlinks and symlinks to create once
+	// every layer is written, keyed by the link's name.
+	Links    map[string]string `json:"links,omitempty"`
+	Symlinks map[string]string `json:"symlinks,omitempty"`
+
+	// LinkTargets records the targets of the recorded hardlinks that the
+	// written layers don't have, so that a lower layer holding one that is
+	// hidden, e.g. by a whiteout, can still give its contents to the links.
+	LinkTargets map[string]bool `json:"linkTargets,omitempty"`
+
+	// DirModes records the permissions of the written directories, which
+	// are applied once everything else is written, so that a read-only
+	// directory doesn't keep its contents from being written.
+	DirModes map[string]os.FileMode `json:"dirModes,omitempty"`
+
+	// Skipped records the device nodes, fifos and other special files
+	// that were not written, since they cannot be created without
+	// privileges.
+	Skipped []string `json:"skipped,omitempty"`
+
+	// Save, if non-nil, is called each time a layer has been fully written,
+	// e.g. to persist the checkpoint to disk.
+	Save func(*Checkpoint) error `json:"-"`
+}
+
+// ExtractTo writes the flattened filesystem of img into dir, as described
+// by opts. A nil opts behaves like the zero ExtractOptions.
+//
+// Entries whose names would escape dir are refused. Symlinks and hardlinks
+// are created once every layer has been written, and device nodes, fifos and
+// the like are skipped since they cannot be created without privileges.
+//
+// Every option applies, MaxBytes bounding the contents written by this call
+// and Heartbeat reporting them, except for Order: the files written don't
+// depend on it, so a non-default Order is refused.
+func ExtractTo(img v1.Image, dir string, opts *ExtractOptions) error {
+	return extractTo(img, dir, opts, &Checkpoint{})
+}
+
+// ExtractToDir writes the flattened filesystem of img into dir, like
+// ExtractTo with default options, and returns the names of the special files
+// it skipped rather than failing on them.
+func ExtractToDir(img v1.Image, dir string) ([]string, error) {
+	checkpoint := &Checkpoint{}
+	if err := extractTo(img, dir, nil, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint.Skipped, nil
+}
+
+// ExtractToResumable writes the flattened filesystem of img into dir,
+// recording its progress into checkpoint after each layer.
+//
+// If a previous call failed, passing the same checkpoint (or one restored
+// from what Save persisted) skips the layers that were already written. A
+// layer that was partially written is rewritten from its start. A nil
+// checkpoint extracts the whole image.
+func ExtractToResumable(img v1.Image, dir string, checkpoint *Checkpoint) error {
+	if checkpoint == nil {
+		checkpoint = &Checkpoint{}
+	}
+	return extractTo(img, dir, nil, checkpoint)
+}
+
+func extractTo(img v1.Image, dir string, opts *ExtractOptions, checkpoint *Checkpoint) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	if opts.Order != LayerOrder {
+		return errors.New("extracting to a directory doesn't support Order")
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if checkpoint.Image != (v1.Hash{}) && checkpoint.Image != digest {
+		return fmt.Errorf("checkpoint is for image %v, not %v", checkpoint.Image, digest)
+	}
+	checkpoint.Image = digest
+
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("retrieving image layers: %w", err)
+	}
+	if checkpoint.Layers < 0 || checkpoint.Layers > len(layers) {
+		return fmt.Errorf("checkpoint has %d layers written, image has %d", checkpoint.Layers, len(layers))
+	}
+
+	f := newFlattener(context.Background(), opts)
+	if checkpoint.Seen == nil {
+		checkpoint.Seen = f.fileMap
+	}
+	f.fileMap = checkpoint.Seen
+	if checkpoint.Opaque == nil {
+		checkpoint.Opaque = f.opaqueDirs
+	}
+	f.opaqueDirs = checkpoint.Opaque
+	if checkpoint.Links == nil {
+		checkpoint.Links = map[string]string{}
+	}
+	if checkpoint.Symlinks == nil {
+		checkpoint.Symlinks = map[string]string{}
+	}
+	if checkpoint.LinkTargets == nil {
+		checkpoint.LinkTargets = f.linkTargets
+	}
+	f.linkTargets = checkpoint.LinkTargets
+	if checkpoint.DirModes == nil {
+		checkpoint.DirModes = map[string]os.FileMode{}
+	}
+
+	var dedup map[dedupKey]string
+	if opts.DedupFiles {
+		dedup = map[dedupKey]string{}
+	}
+
+	var hw *heartbeatWriter
+	if opts.Heartbeat != nil {
+		hw = &heartbeatWriter{w: ioutil.Discard}
+		stop := hw.start(opts.Heartbeat, opts.HeartbeatInterval)
+		defer stop()
+	}
+	var written int64
+	write := func(header *tar.Header, r io.Reader) error {
+		if opts.MaxBytes > 0 && header.Size > opts.MaxBytes-written {
+			return fmt.Errorf("would exceed the limit of %d bytes", opts.MaxBytes)
+		}
+		written += header.Size
+		if hw != nil {
+			r = io.TeeReader(r, hw)
+		}
+		return writeEntry(dir, header, r, checkpoint, dedup)
+	}
+	f.onHidden = func(header *tar.Header, r io.Reader) error {
+		if err := materializeLinks(header, r, checkpoint.Links, write); err != nil {
+			// Keep the target, so that resuming copies it again.
+			checkpoint.LinkTargets[cleanPath(header.Name)] = true
+			return err
+		}
+		return nil
+	}
+
+	var p *progress
+	if opts.Progress != nil {
+		if p, err = newProgress(layers, opts.Progress); err != nil {
+			return err
+		}
+		f.onRead = p.advance
+		// The layers written by a previous attempt count as done.
+		for i := len(layers) - 1; i > len(layers)-1-checkpoint.Layers; i-- {
+			p.startLayer(i)
+		}
+	}
+
+	for i := len(layers) - 1 - checkpoint.Layers; i >= 0; i-- {
+		if p != nil {
+			p.startLayer(i)
+		}
+		skipped := len(checkpoint.Skipped)
+		if err := f.flattenLayer(i, layers[i], write); err != nil {
+			f.rollback()
+			checkpoint.Skipped = checkpoint.Skipped[:skipped]
+			return err
+		}
+		checkpoint.Layers++
+		if checkpoint.Save != nil {
+			if err := checkpoint.Save(checkpoint); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.DetectSymlinkCycles {
+		if err := checkSymlinkCycles(checkpoint.Symlinks); err != nil {
+			return err
+		}
+	}
+	if err := writeSymlinks(dir, checkpoint.Symlinks); err != nil {
+		return err
+	}
+	if err := writeLinks(dir, checkpoint.Links); err != nil {
+		return err
+	}
+	if err := writeDirModes(dir, checkpoint.DirModes); err != nil {
+		return err
+	}
+	if p != nil {
+		p.report(1)
+	}
+	return nil
+}
+
+// writeDirModes applies the recorded directory permissions, deepest first, so
+// that no directory is made read-only before its subdirectories are done.
+func writeDirModes(dir string, modes map[string]os.FileMode) error {
+	targets := make(map[string]os.FileMode, len(modes))
+	for name, mode := range modes {
+		target, err := resolvePath(dir, name)
+		if err != nil {
+			return err
+		}
+		targets[target] = mode
+	}
+	paths := make([]string, 0, len(targets))
+	for target := range targets {
+		paths = append(paths, target)
+	}
+	// A directory sorts before everything under it.
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, target := range paths {
+		if err := os.Chmod(target, targets[target]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvePath returns where the entry called name belongs under dir,
+// refusing names that would escape it.
+func resolvePath(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %q escapes the extraction directory", name)
+	}
+	return target, nil
+}
+
+// makeParent creates the parent directory of target, refusing to follow
+// symlinks that lead outside of dir.
+func makeParent(dir, target string) error {
+	parent := filepath.Dir(target)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	return checkInside(dir, parent)
+}
+
+// checkInside returns an error unless p, once its symlinks are resolved, is
+// dir or under it.
+func checkInside(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves outside of the extraction directory", p)
+	}
+	return nil
+}
+
+// dedupKey identifies regular files that can share an inode.
+type dedupKey struct {
+	digest  [sha256.Size]byte
+	mode    os.FileMode
+	modTime int64
+}
+
+// writeEntry materializes a single tar entry under dir. Links are recorded in
+// checkpoint rather than created, since their targets may not have been
+// written yet, and so are the modes of directories, which may not be
+// writable. If dedup is non-nil, regular files are hardlinked to earlier
+// files with the same dedupKey, which are recorded in it.
+func writeEntry(dir string, header *tar.Header, r io.Reader, checkpoint *Checkpoint, dedup map[dedupKey]string) error {
+	target, err := resolvePath(dir, header.Name)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(header.Mode).Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := makeParent(dir, target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		checkpoint.DirModes[header.Name] = mode
+		return nil
+
+	case tar.TypeReg, tar.TypeRegA:
+		if err := makeParent(dir, target); err != nil {
+			return err
+		}
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+		if dedup == nil {
+			return nil
+		}
+		key := dedupKey{mode: mode, modTime: header.ModTime.UnixNano()}
+		copy(key.digest[:], h.Sum(nil))
+		return dedupFile(dedup, key, target)
+
+	case tar.TypeSymlink:
+		checkpoint.Symlinks[header.Name] = header.Linkname
+		return nil
+
+	case tar.TypeLink:
+		if _, err := resolvePath(dir, header.Linkname); err != nil {
+			return err
+		}
+		checkpoint.Links[header.Name] = header.Linkname
+		return nil
+
+	default:
+		// Device nodes, fifos and the like cannot be recreated without
+		// privileges, so they are skipped.
+		checkpoint.Skipped = append(checkpoint.Skipped, header.Name)
+		return nil
+	}
+}
+
+// dedupFile replaces target with a hardlink to the first file written with
+// the same key, if any. If the file system can't hardlink them, e.g. across
+// devices, target is kept.
+func dedupFile(dedup map[dedupKey]string, key dedupKey, target string) error {
+	existing, ok := dedup[key]
+	if !ok {
+		dedup[key] = target
+		return nil
+	}
+	// Link under a temporary name first, so that target is left alone if
+	// linking fails. The name must not be taken, e.g. by a file of the
+	// image.
+	for i := 0; ; i++ {
+		tmp := fmt.Sprintf("%s.dedup%d", target, i)
+		err := os.Link(existing, tmp)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			if cannotLink(err) {
+				return nil
+			}
+			return err
+		}
+		return os.Rename(tmp, target)
+	}
+}
+
+// cannotLink reports whether err, from os.Link, means that the file system
+// can't hardlink the files, rather than that linking went wrong.
+func cannotLink(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EXDEV || errno == syscall.ENOTSUP ||
+		errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS
+}
+
+// materializeLinks writes the recorded hardlinks to header, a regular file
+// that is hidden from the flattened filesystem, as copies of it: the first one
+// becomes a regular file with its contents r, and the others link to that one.
+func materializeLinks(header *tar.Header, r io.Reader, links map[string]string, write func(*tar.Header, io.Reader) error) error {
+	target := cleanPath(header.Name)
+	var names []string
+	for _, name := range sortedKeys(links) {
+		if cleanPath(links[name]) == target {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	first := *header
+	first.Name = names[0]
+	if err := write(&first, r); err != nil {
+		return err
+	}
+	delete(links, names[0])
+	for _, name := range names[1:] {
+		links[name] = names[0]
+	}
+	return nil
+}
+
+// writeSymlinks creates the recorded symlinks, in a stable order.
+func writeSymlinks(dir string, symlinks map[string]string) error {
+	for _, name := range sortedKeys(symlinks) {
+		target, err := resolvePath(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := makeParent(dir, target); err != nil {
+			return err
+		}
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(symlinks[name], target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLinks creates the recorded hardlinks, in a stable order.
+func writeLinks(dir string, links map[string]string) error {
+	for _, name := range sortedKeys(links) {
+		target, err := resolvePath(dir, name)
+		if err != nil {
+			return err
+		}
+		source, err := resolvePath(dir, links[name])
+		if err != nil {
+			return err
+		}
+		// The symlinks have been written by now, so the source's parent
+		// may be one that leads outside of dir. os.Link doesn't follow a
+		// symlink at the source itself.
+		if err := checkInside(dir, filepath.Dir(source)); err != nil {
+			return err
+		}
+		if err := makeParent(dir, target); err != nil {
+			return err
+		}
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSymlinkCycles returns an error describing the first chain of symlinks
+// that leads back to where it started, e.g. a -> b -> a.
+func checkSymlinkCycles(symlinks map[string]string) error {
+	// Key the symlinks by their cleaned path, so that e.g. "./a" and "/a"
+	// refer to the same node.
+	graph := make(map[string]string, len(symlinks))
+	for name, target := range symlinks {
+		name = cleanPath(name)
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		graph[name] = cleanPath(target)
+	}
+
+	for _, start := range sortedKeys(graph) {
+		chain := []string{start}
+		seen := map[string]bool{start: true}
+		for next, ok := graph[start]; ok; next, ok = graph[next] {
+			chain = append(chain, next)
+			if next == start {
+				return fmt.Errorf("symlink cycle: %s", strings.Join(chain, " -> "))
+			}
+			if seen[next] {
+				// A cycle that doesn't include start; it is reported
+				// when starting from one of its members.
+				break
+			}
+			seen[next] = true
+		}
+	}
+	return nil
+}
+
+// cleanPath returns the canonical, relative form of an entry's name.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// removeExisting removes a non-directory at path, if there is one.
+func removeExisting(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New(path + " is a directory")
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,558 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+)
+
+// flakyLayer fails the first time its contents are read, and counts reads.
+type flakyLayer struct {
+	v1.Layer
+	fail  bool
+	reads int
+}
+
+var errFlaky = errors.New("flaky storage")
+
+func (l *flakyLayer) Uncompressed() (io.ReadCloser, error) {
+	l.reads++
+	if l.fail {
+		l.fail = false
+		return nil, errFlaky
+	}
+	return l.Layer.Uncompressed()
+}
+
+// readDir returns the contents of the regular files under dir, keyed by
+// their slash-separated path relative to dir.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := map[string]string{}
+	if err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk(%s): %v", dir, err)
+	}
+	return files
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "mutate")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestExtractToResumable(t *testing.T) {
+	bottom := &flakyLayer{Layer: tarLayer(t,
+		directory("etc/"),
+		regularFile("etc/removed", "removed"),
+		regularFile("etc/kept", "old"),
+	)}
+	middle := &flakyLayer{Layer: tarLayer(t,
+		regularFile("etc/kept", "new"),
+		regularFile("bin/app", "app"),
+	), fail: true}
+	top := &flakyLayer{Layer: tarLayer(t,
+		regularFile("etc/.wh.removed", ""),
+		hardlink("bin/app-link", "bin/app"),
+	)}
+	img := imageFromLayers(t, bottom, middle, top)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Persist the checkpoint the way a caller would, so that resuming
+	// doesn't rely on in-memory state.
+	var saved []byte
+	save := func(c *Checkpoint) error {
+		var err error
+		saved, err = json.Marshal(c)
+		return err
+	}
+
+	if err := ExtractToResumable(img, dir, &Checkpoint{Save: save}); err == nil {
+		t.Fatal("ExtractToResumable: expected an error from the flaky layer")
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(saved, &checkpoint); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if got, want := checkpoint.Layers, 1; got != want {
+		t.Fatalf("checkpoint.Layers = %d, want %d", got, want)
+	}
+	checkpoint.Save = save
+	if err := ExtractToResumable(img, dir, &checkpoint); err != nil {
+		t.Fatalf("ExtractToResumable (resumed): %v", err)
+	}
+
+	if got, want := top.reads, 1; got != want {
+		t.Errorf("top layer read %d times, want %d", got, want)
+	}
+	want := map[string]string{
+		"etc/kept":     "new",
+		"bin/app":      "app",
+		"bin/app-link": "app",
+	}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("extracted files (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractToResumableOpaque(t *testing.T) {
+	bottom := &flakyLayer{Layer: tarLayer(t,
+		directory("etc/"),
+		regularFile("etc/stale", "stale"),
+	), fail: true}
+	top := &flakyLayer{Layer: tarLayer(t,
+		regularFile("etc/.wh..wh..opq", ""),
+		regularFile("etc/fresh", "fresh"),
+	)}
+	img := imageFromLayers(t, bottom, top)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var saved []byte
+	save := func(c *Checkpoint) error {
+		var err error
+		saved, err = json.Marshal(c)
+		return err
+	}
+	if err := ExtractToResumable(img, dir, &Checkpoint{Save: save}); err == nil {
+		t.Fatal("ExtractToResumable: expected an error from the flaky layer")
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(saved, &checkpoint); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if err := ExtractToResumable(img, dir, &checkpoint); err != nil {
+		t.Fatalf("ExtractToResumable (resumed): %v", err)
+	}
+
+	// The opaque directory keeps hiding the bottom layer after resuming.
+	want := map[string]string{"etc/fresh": "fresh"}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("extracted files (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractToResumableWrongImage(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t, regularFile("a", "a")))
+	checkpoint := &Checkpoint{Image: v1.Hash{Algorithm: "sha256", Hex: "deadbeef"}}
+	if err := ExtractToResumable(img, os.TempDir(), checkpoint); err == nil {
+		t.Error("expected an error resuming with a checkpoint for another image")
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"etc/passwd", true},
+		{"/etc/passwd", true},
+		{"./a/../b", true},
+		{"../escape", false},
+		{"a/../../escape", false},
+	} {
+		if _, err := resolvePath("/root", tc.name); (err == nil) != tc.ok {
+			t.Errorf("resolvePath(%q) = %v, want ok: %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestExtractToSymlinkCycle(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, symlink("etc/a", "b"), regularFile("etc/file", "file")),
+		tarLayer(t, symlink("etc/b", "/etc/a"), symlink("etc/c", "file")),
+	)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	err := ExtractTo(img, dir, &ExtractOptions{DetectSymlinkCycles: true})
+	if err == nil {
+		t.Fatal("ExtractTo: expected a symlink cycle error")
+	}
+	if got, want := err.Error(), "symlink cycle: etc/a -> etc/b -> etc/a"; got != want {
+		t.Errorf("ExtractTo: got %q, want %q", got, want)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "etc", "c")); !os.IsNotExist(err) {
+		t.Errorf("symlinks were created before detecting the cycle: %v", err)
+	}
+
+	dir, cleanup = tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dir, nil); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if got, err := os.Readlink(filepath.Join(dir, "etc", "c")); err != nil || got != "file" {
+		t.Errorf("Readlink(etc/c) = %q, %v; want %q", got, err, "file")
+	}
+}
+
+func TestExtractToDedupFiles(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("a", "same"),
+			regularFile("b", "different"),
+		),
+		tarLayer(t,
+			regularFile("c", "same"),
+			regularFile("d", "same"),
+		),
+	)
+
+	stat := func(dir, name string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", name, err)
+		}
+		return fi
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dir, &ExtractOptions{DedupFiles: true}); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	want := map[string]string{"a": "same", "b": "different", "c": "same", "d": "same"}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("ExtractTo (-got, +want) %s", diff)
+	}
+	if !os.SameFile(stat(dir, "a"), stat(dir, "c")) || !os.SameFile(stat(dir, "a"), stat(dir, "d")) {
+		t.Error("files with identical contents were not hardlinked")
+	}
+	if os.SameFile(stat(dir, "a"), stat(dir, "b")) {
+		t.Error("files with different contents were hardlinked")
+	}
+
+	dir, cleanup = tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dir, nil); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if os.SameFile(stat(dir, "a"), stat(dir, "c")) {
+		t.Error("files were hardlinked without DedupFiles")
+	}
+}
+
+func TestExtractToOptions(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("a", "aaaa")),
+		tarLayer(t, regularFile("b", "bbbb")),
+	)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dir, &ExtractOptions{Order: PathOrder}); err == nil {
+		t.Error("ExtractTo with an Order: expected an error")
+	}
+	if err := ExtractTo(img, dir, &ExtractOptions{MaxBytes: 7}); err == nil {
+		t.Error("ExtractTo over MaxBytes: expected an error")
+	}
+
+	dir, cleanup = tempDir(t)
+	defer cleanup()
+	var fractions []float64
+	if err := ExtractTo(img, dir, &ExtractOptions{
+		MaxBytes: 8,
+		Progress: func(fraction float64) { fractions = append(fractions, fraction) },
+	}); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if len(fractions) == 0 || fractions[len(fractions)-1] != 1 {
+		t.Errorf("Progress = %v, want it to end at 1", fractions)
+	}
+
+	// The layer's contents are only readable once the heartbeat fires.
+	slow := slowLayer{
+		Layer:   tarLayer(t, regularFile("slow", "slow")),
+		unblock: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(slow.unblock) }) }
+	defer time.AfterFunc(5*time.Second, unblock).Stop()
+	var beats int32
+	dir, cleanup = tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(imageFromLayers(t, slow), dir, &ExtractOptions{
+		HeartbeatInterval: time.Millisecond,
+		Heartbeat: func(int64) {
+			atomic.AddInt32(&beats, 1)
+			unblock()
+		},
+	}); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if atomic.LoadInt32(&beats) == 0 {
+		t.Error("Heartbeat was never called")
+	}
+}
+
+func TestDedupFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	write := func(name, contents string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return p
+	}
+
+	// The image's own files keep their names.
+	a, b := write("a", "same"), write("b", "same")
+	write("b.dedup0", "image file")
+	dedup := map[dedupKey]string{}
+	if err := dedupFile(dedup, dedupKey{}, a); err != nil {
+		t.Fatalf("dedupFile(a): %v", err)
+	}
+	if err := dedupFile(dedup, dedupKey{}, b); err != nil {
+		t.Fatalf("dedupFile(b): %v", err)
+	}
+	want := map[string]string{"a": "same", "b": "same", "b.dedup0": "image file"}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("dedupFile (-got, +want) %s", diff)
+	}
+	fa, err := os.Stat(a)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !os.SameFile(fa, fb) {
+		t.Error("a and b are not hardlinked")
+	}
+
+	// Failures other than the file system not supporting the link are
+	// reported.
+	os.Remove(a)
+	if err := dedupFile(dedup, dedupKey{}, write("c", "same")); err == nil {
+		t.Error("dedupFile with a missing original: expected an error")
+	}
+}
+
+func TestExtractToDir(t *testing.T) {
+	private := directory("private/")
+	private.hdr.Mode = 0700
+	img := imageFromLayers(t, tarLayer(t,
+		directory("dev/"),
+		testFile{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testFile{hdr: tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}},
+		private,
+		regularFile("private/secret", "secret"),
+		symlink("link", "private/secret"),
+	))
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	skipped, err := ExtractToDir(img, dir)
+	if err != nil {
+		t.Fatalf("ExtractToDir: %v", err)
+	}
+	if diff := cmp.Diff(skipped, []string{"dev/null", "fifo"}); diff != "" {
+		t.Errorf("skipped files (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(readDir(t, dir), map[string]string{"private/secret": "secret"}); diff != "" {
+		t.Errorf("extracted files (-got, +want) %s", diff)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "private")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("Stat(private) = %v, %v; want mode 0700", fi, err)
+	}
+	if got, err := os.Readlink(filepath.Join(dir, "link")); err != nil || got != "private/secret" {
+		t.Errorf("Readlink(link) = %q, %v; want %q", got, err, "private/secret")
+	}
+}
+
+func TestExtractToDirEscape(t *testing.T) {
+	for _, name := range []string{"../escaped", "a/../../escaped"} {
+		img := imageFromLayers(t, tarLayer(t, regularFile(name, "oops")))
+
+		parent, cleanup := tempDir(t)
+		defer cleanup()
+		dir := filepath.Join(parent, "root")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		if _, err := ExtractToDir(img, dir); err == nil {
+			t.Errorf("ExtractToDir(%q): expected an error", name)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+			t.Errorf("ExtractToDir(%q) wrote outside of dir: %v", name, err)
+		}
+	}
+}
+
+func TestExtractToDirLinkEscape(t *testing.T) {
+	outside, cleanup := tempDir(t)
+	defer cleanup()
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, []byte("host secret"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	img := imageFromLayers(t, tarLayer(t,
+		symlink("evil", outside),
+		hardlink("stolen", "evil/secret"),
+	))
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	if _, err := ExtractToDir(img, dir); err == nil {
+		t.Error("ExtractToDir with a hardlink through an escaping symlink: expected an error")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "stolen")); !os.IsNotExist(err) {
+		t.Errorf("ExtractToDir linked to a file outside of dir: %v", err)
+	}
+}
+
+func TestExtractToHiddenLinkTarget(t *testing.T) {
+	bottom := &flakyLayer{Layer: tarLayer(t, regularFile("a", "contents")), fail: true}
+	img := imageFromLayers(t,
+		bottom,
+		tarLayer(t,
+			regularFile(".wh.a", ""),
+			hardlink("b", "a"),
+			hardlink("c", "a"),
+		),
+	)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	checkpoint := &Checkpoint{}
+	if err := ExtractToResumable(img, dir, checkpoint); err == nil {
+		t.Fatal("ExtractToResumable: expected an error from the flaky layer")
+	}
+	// Resume from a checkpoint restored from JSON, which must remember
+	// the link target that the bottom layer hides.
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	restored := &Checkpoint{}
+	if err := json.Unmarshal(b, restored); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := ExtractToResumable(img, dir, restored); err != nil {
+		t.Fatalf("ExtractToResumable: %v", err)
+	}
+
+	want := map[string]string{"b": "contents", "c": "contents"}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("ExtractToResumable (-got, +want) %s", diff)
+	}
+	fb, err := os.Stat(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	fc, err := os.Stat(filepath.Join(dir, "c"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !os.SameFile(fb, fc) {
+		t.Error("b and c are not hardlinked")
+	}
+
+	dir, cleanup = tempDir(t)
+	defer cleanup()
+	if err := ExtractTo(img, dir, nil); err != nil {
+		t.Fatalf("ExtractTo: %v", err)
+	}
+	if diff := cmp.Diff(readDir(t, dir), want); diff != "" {
+		t.Errorf("ExtractTo (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractToReadOnlyDir(t *testing.T) {
+	ro := directory("ro/")
+	ro.hdr.Mode = 0555
+	bottom := &flakyLayer{Layer: tarLayer(t,
+		directory("ro/"),
+		regularFile("ro/file", "file"),
+	), fail: true}
+	top := tarLayer(t,
+		ro,
+		directory("ro/sub/"),
+		hardlink("ro/link", "ro/file"),
+	)
+	img := imageFromLayers(t, bottom, top)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+
+	checkpoint := &Checkpoint{}
+	if err := ExtractToResumable(img, dir, checkpoint); err == nil {
+		t.Fatal("ExtractToResumable: expected an error from the flaky layer")
+	}
+	// The directory must stay writable until the lower layers are done.
+	if fi, err := os.Stat(filepath.Join(dir, "ro")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("Stat(ro) after the top layer = %v, %v; want mode 0755", fi, err)
+	}
+	if got, want := checkpoint.DirModes["ro/"], os.FileMode(0555); got != want {
+		t.Errorf("checkpoint.DirModes[ro/] = %v, want %v", got, want)
+	}
+
+	if err := ExtractToResumable(img, dir, checkpoint); err != nil {
+		t.Fatalf("ExtractToResumable (resumed): %v", err)
+	}
+	if diff := cmp.Diff(readDir(t, dir), map[string]string{"ro/file": "file", "ro/link": "file"}); diff != "" {
+		t.Errorf("extracted files (-got, +want) %s", diff)
+	}
+	for name, want := range map[string]os.FileMode{"ro": 0555, "ro/sub": 0755} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || fi.Mode().Perm() != want {
+			t.Errorf("Stat(%s) = %v, %v; want mode %v", name, fi, err, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// ExtractFile returns the contents and header of the entry at name in img's
+// flattened filesystem, walking the layers from the top the way Extract does
+// and stopping at the first one that has it.
+//
+// The returned reader streams from that layer and must be closed. If the
+// entry never existed or was whited out, the error satisfies os.IsNotExist.
+func ExtractFile(img v1.Image, name string) (io.ReadCloser, *tar.Header, error) {
+	target := cleanPath(name)
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieving image layers: %w", err)
+	}
+	notExist := &os.PathError{Op: "extract", Path: name, Err: os.ErrNotExist}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		rc, err := layers[i].Uncompressed()
+		if err != nil {
+			return nil, nil, err
+		}
+		tr := tar.NewReader(rc)
+		hidden := false
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rc.Close()
+				return nil, nil, fmt.Errorf("reading tar: %w", err)
+			}
+			if isAUFSMetadata(header.Name) {
+				continue
+			}
+
+			dirname, basename := path.Split(cleanPath(header.Name))
+			if basename == whiteoutOpaqueDir {
+				// An opaque directory hides the layers below, but not
+				// the rest of this one.
+				if strings.HasPrefix(target, dirname) {
+					hidden = true
+				}
+				continue
+			}
+			entry := dirname + basename
+			if strings.HasPrefix(basename, whiteoutPrefix) {
+				entry = dirname + basename[len(whiteoutPrefix):]
+				if entry == target || strings.HasPrefix(target, entry+"/") {
+					rc.Close()
+					return nil, nil, notExist
+				}
+				continue
+			}
+			if entry == target {
+				return &fileReader{Reader: tr, Closer: rc}, header, nil
+			}
+			if header.Typeflag != tar.TypeDir && strings.HasPrefix(target, entry+"/") {
+				// A non-directory replaces everything under its name.
+				rc.Close()
+				return nil, nil, notExist
+			}
+		}
+		if err := rc.Close(); err != nil {
+			return nil, nil, err
+		}
+		if hidden {
+			return nil, nil, notExist
+		}
+	}
+	return nil, nil, notExist
+}
+
+// fileReader streams an entry of a layer, closing the layer when done.
+type fileReader struct {
+	io.Reader
+	io.Closer
+}
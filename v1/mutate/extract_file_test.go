@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExtractFile(t *testing.T) {
+	bottom := &flakyLayer{Layer: tarLayer(t,
+		regularFile("etc/os-release", "old"),
+		regularFile("etc/passwd", "root"),
+	), fail: true}
+	img := imageFromLayers(t, bottom, tarLayer(t,
+		regularFile("./etc/os-release", "new"),
+	))
+
+	rc, header, err := ExtractFile(img, "/etc/os-release")
+	if err != nil {
+		t.Fatalf("ExtractFile: %v", err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(b), "new"; got != want {
+		t.Errorf("ExtractFile contents = %q, want %q", got, want)
+	}
+	if got, want := header.Name, "./etc/os-release"; got != want {
+		t.Errorf("ExtractFile header.Name = %q, want %q", got, want)
+	}
+	if bottom.reads != 0 {
+		t.Errorf("bottom layer read %d times, want 0", bottom.reads)
+	}
+}
+
+func TestExtractFileNotExist(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("etc/removed", "removed"),
+			regularFile("var/lib/data", "data"),
+			regularFile("opt/app/config", "config"),
+			regularFile("usr/file", "file"),
+			regularFile("kept", "kept"),
+		),
+		tarLayer(t,
+			regularFile("etc/.wh.removed", ""),
+			regularFile("var/.wh.lib", ""),
+			regularFile("opt/app/.wh..wh..opq", ""),
+			regularFile("opt/app/new", "new"),
+			regularFile("usr", "not a directory"),
+		),
+	)
+
+	for _, name := range []string{"/etc/removed", "/var/lib/data", "/opt/app/config", "/usr/file", "/missing"} {
+		if _, _, err := ExtractFile(img, name); !os.IsNotExist(err) {
+			t.Errorf("ExtractFile(%s): got %v, want a not-exist error", name, err)
+		}
+	}
+	for _, name := range []string{"/opt/app/new", "/kept"} {
+		rc, _, err := ExtractFile(img, name)
+		if err != nil {
+			t.Errorf("ExtractFile(%s): %v", name, err)
+			continue
+		}
+		rc.Close()
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// ExtractPaths returns the contents of the regular files at paths in img's
+// flattened filesystem, keyed by the paths as given. Symlinks and hardlinks
+// are followed, including those of parent directories.
+//
+// It stops reading img as soon as every path has been found, which makes it
+// much cheaper than a full extraction for a handful of files. It fails,
+// listing them, if some of the paths don't exist.
+func ExtractPaths(img v1.Image, paths ...string) (map[string][]byte, error) {
+	l := &pathLookup{
+		paths: paths,
+		links: map[string]string{},
+		files: map[string][]byte{},
+	}
+	retry, err := l.walk(img)
+	if err != nil {
+		return nil, err
+	}
+	if retry {
+		// A link found during the first walk pointed at a file that had
+		// already gone by.
+		if _, err := l.walk(img); err != nil {
+			return nil, err
+		}
+	}
+
+	files := make(map[string][]byte, len(paths))
+	var missing []string
+	for _, p := range paths {
+		resolved, err := l.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := l.files[resolved]
+		if !ok {
+			missing = append(missing, p)
+			continue
+		}
+		files[p] = b
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("paths not found in image: %s", strings.Join(missing, ", "))
+	}
+	return files, nil
+}
+
+// pathLookup holds the state of ExtractPaths across walks.
+type pathLookup struct {
+	paths []string
+
+	// links maps the cleaned names of symlinks and hardlinks to the
+	// cleaned names they point at.
+	links map[string]string
+
+	// files holds the contents of the wanted regular files found so far.
+	files map[string][]byte
+}
+
+// walk reads img's flattened filesystem until every path is found. It
+// reports whether a wanted file may have been skipped because the link
+// leading to it came later.
+func (l *pathLookup) walk(img v1.Image) (bool, error) {
+	want, err := l.wanted()
+	if err != nil {
+		return false, err
+	}
+	if len(want) == 0 {
+		return false, nil
+	}
+	retry := false
+	err = walkFlattened(img, func(header *tar.Header, r io.Reader) error {
+		name := cleanPath(header.Name)
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			if _, ok := l.links[name]; ok {
+				return nil
+			}
+			target := cleanPath(header.Linkname)
+			if header.Typeflag == tar.TypeSymlink && !path.IsAbs(header.Linkname) {
+				target = cleanPath(path.Join(path.Dir(name), header.Linkname))
+			}
+			l.links[name] = target
+			next, err := l.wanted()
+			if err != nil {
+				return err
+			}
+			for p := range next {
+				if !want[p] {
+					retry = true
+				}
+			}
+			want = next
+		case tar.TypeReg, tar.TypeRegA:
+			if !want[name] {
+				return nil
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			l.files[name] = b
+			delete(want, name)
+		default:
+			return nil
+		}
+		if len(want) == 0 {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err == errStopWalk {
+		return false, nil
+	}
+	return retry, err
+}
+
+// wanted returns the resolved names of the paths that haven't been found.
+func (l *pathLookup) wanted() (map[string]bool, error) {
+	want := map[string]bool{}
+	for _, p := range l.paths {
+		resolved, err := l.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.files[resolved]; !ok {
+			want[resolved] = true
+		}
+	}
+	return want, nil
+}
+
+// resolve returns the cleaned name that p refers to, following the links
+// known so far through each of its components.
+func (l *pathLookup) resolve(p string) (string, error) {
+	name := cleanPath(p)
+	for hops := 0; ; {
+		parts := strings.Split(name, "/")
+		followed := false
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/")
+			target, ok := l.links[prefix]
+			if !ok {
+				continue
+			}
+			if hops++; hops > maxSymlinks {
+				return "", fmt.Errorf("too many levels of symlinks resolving %s", p)
+			}
+			name = cleanPath(path.Join(target, strings.Join(parts[i+1:], "/")))
+			followed = true
+			break
+		}
+		if !followed {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExtractPaths(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("etc/os-release", "old"),
+			regularFile("usr/bin/sh", "sh"),
+			symlink("sbin", "/usr/bin"),
+		),
+		tarLayer(t,
+			regularFile("etc/os-release", "new"),
+			symlink("bin", "usr/bin"),
+			symlink("etc/release", "os-release"),
+			hardlink("usr/bin/bash", "usr/bin/sh"),
+			regularFile("usr/bin/env", "env"),
+		),
+	)
+
+	got, err := ExtractPaths(img, "/etc/os-release", "/bin/sh", "etc/release", "/bin/bash", "/sbin/env")
+	if err != nil {
+		t.Fatalf("ExtractPaths: %v", err)
+	}
+	want := map[string][]byte{
+		"/etc/os-release": []byte("new"),
+		"/bin/sh":         []byte("sh"),
+		"etc/release":     []byte("new"),
+		"/bin/bash":       []byte("sh"),
+		"/sbin/env":       []byte("env"),
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ExtractPaths (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractPathsStopsEarly(t *testing.T) {
+	bottom := &flakyLayer{Layer: tarLayer(t, regularFile("etc/passwd", "root")), fail: true}
+	img := imageFromLayers(t, bottom, tarLayer(t,
+		regularFile("etc/os-release", "release"),
+		regularFile("etc/hostname", "host"),
+	))
+
+	if _, err := ExtractPaths(img, "/etc/os-release"); err != nil {
+		t.Fatalf("ExtractPaths: %v", err)
+	}
+	if bottom.reads != 0 {
+		t.Errorf("bottom layer read %d times, want 0", bottom.reads)
+	}
+}
+
+func TestExtractPathsErrors(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t,
+		regularFile("etc/os-release", "release"),
+		symlink("loop/a", "b"),
+		symlink("loop/b", "a"),
+	))
+
+	_, err := ExtractPaths(img, "/etc/os-release", "/nope", "/etc/nope")
+	if err == nil {
+		t.Fatal("ExtractPaths: expected an error for missing paths")
+	}
+	if got, want := err.Error(), "paths not found in image: /nope, /etc/nope"; got != want {
+		t.Errorf("ExtractPaths: got %q, want %q", got, want)
+	}
+
+	if _, err := ExtractPaths(img, "/loop/a"); err == nil || !strings.Contains(err.Error(), "too many levels of symlinks") {
+		t.Errorf("ExtractPaths(/loop/a): got %v, want a symlink loop error", err)
+	}
+}
@@ -0,0 +1,503 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/tarball"
+)
+
+// closeTrackingLayer records whether the readers it hands out were closed.
+type closeTrackingLayer struct {
+	v1.Layer
+	opened, closed int
+}
+
+func (l *closeTrackingLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	l.opened++
+	return &closeTrackingReader{ReadCloser: rc, layer: l}, nil
+}
+
+type closeTrackingReader struct {
+	io.ReadCloser
+	layer *closeTrackingLayer
+}
+
+func (r *closeTrackingReader) Close() error {
+	r.layer.closed++
+	return r.ReadCloser.Close()
+}
+
+func TestLayerUncompressedSizes(t *testing.T) {
+	small := &closeTrackingLayer{Layer: tarLayer(t, regularFile("small", "a"))}
+	big := &closeTrackingLayer{Layer: tarLayer(t, regularFile("big", string(make([]byte, 4096))))}
+	img := imageFromLayers(t, small, big)
+
+	sizes, err := LayerUncompressedSizes(img)
+	if err != nil {
+		t.Fatalf("LayerUncompressedSizes: %v", err)
+	}
+
+	// Each tar has a 512 byte header, contents padded to 512 bytes and a
+	// 1024 byte end-of-archive marker.
+	if diff := cmp.Diff(sizes, []int64{2048, 5632}); diff != "" {
+		t.Errorf("LayerUncompressedSizes (-got, +want) %s", diff)
+	}
+	for _, l := range []*closeTrackingLayer{small, big} {
+		if l.opened != l.closed {
+			t.Errorf("opened %d readers, closed %d", l.opened, l.closed)
+		}
+	}
+}
+
+func TestFileDigests(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/hosts", "old"),
+			regularFile("etc/removed", "removed"),
+		),
+		tarLayer(t,
+			regularFile("./etc/hosts", "new"),
+			regularFile("etc/.wh.removed", ""),
+			symlink("etc/link", "hosts"),
+			hardlink("etc/hardlink", "etc/hosts"),
+		),
+	)
+
+	got, err := FileDigests(img)
+	if err != nil {
+		t.Fatalf("FileDigests: %v", err)
+	}
+	want, _, err := v1.SHA256(strings.NewReader("new"))
+	if err != nil {
+		t.Fatalf("SHA256: %v", err)
+	}
+	if diff := cmp.Diff(got, map[string]v1.Hash{
+		"etc/hosts":    want,
+		"etc/hardlink": want,
+	}); diff != "" {
+		t.Errorf("FileDigests (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractSkipPseudoFS(t *testing.T) {
+	devNull := testFile{hdr: tar.Header{
+		Name:     "dev/null",
+		Typeflag: tar.TypeChar,
+		Mode:     0666,
+		Devmajor: 1,
+		Devminor: 3,
+	}}
+	img := imageFromLayers(t, tarLayer(t,
+		directory("dev/"),
+		devNull,
+		directory("proc/"),
+		regularFile("proc/cpuinfo", "cpus"),
+		directory("./sys/"),
+		regularFile("./sys/kernel", "kernel"),
+		regularFile("devices.txt", "not a device"),
+	))
+
+	headers, _ := readEntries(t, Extract(img))
+	if got, want := len(headers), 7; got != want {
+		t.Errorf("Extract: got %d entries, want %d", got, want)
+	}
+
+	headers, _ = readEntries(t, ExtractSkipPseudoFS(img))
+	want := []string{"dev/", "proc/", "./sys/", "devices.txt"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("ExtractSkipPseudoFS (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractFiltered(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("cache/"),
+			regularFile("cache/big", "lots of bytes"),
+			regularFile("cache/gone", "whited out above"),
+			regularFile("app/main", "old main"),
+		),
+		tarLayer(t,
+			regularFile("cache/.wh.gone", ""),
+			regularFile("cache/new", "more bytes"),
+			regularFile("app/main", "new main"),
+			regularFile("app/config", "config"),
+		),
+	)
+
+	var seen []string
+	headers, files := readEntries(t, ExtractFiltered(img, func(hdr *tar.Header) bool {
+		seen = append(seen, hdr.Name)
+		return !strings.HasPrefix(hdr.Name, "cache/")
+	}))
+	want := []string{"app/main", "app/config"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("ExtractFiltered (-got, +want) %s", diff)
+	}
+	if got, want := files["app/main"], "new main"; got != want {
+		t.Errorf("app/main = %q, want %q", got, want)
+	}
+	// Whiteouts and hidden entries never reach the filter.
+	wantSeen := []string{"cache/new", "app/main", "app/config", "cache/", "cache/big"}
+	if diff := cmp.Diff(seen, wantSeen); diff != "" {
+		t.Errorf("filter calls (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractSized(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t,
+		regularFile("foo", "foo"),
+		regularFile("bar", "bar contents"),
+	))
+
+	rc := ExtractSized(img, nil)
+	defer rc.Close()
+	if got, want := rc.Size(), int64(-1); got != want {
+		t.Errorf("Size() before reading = %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := rc.Size(), int64(len(b)); got != want {
+		t.Errorf("Size() after reading = %d, want %d", got, want)
+	}
+}
+
+func TestExtractDelta(t *testing.T) {
+	base := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/unchanged", "same"),
+			regularFile("etc/modified", "before"),
+			regularFile("etc/removed", "gone"),
+			directory("var/"),
+			regularFile("var/log", "log"),
+		),
+	)
+	// derived doesn't share any layers with base.
+	derived := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/unchanged", "same"),
+			regularFile("etc/modified", "after"),
+			regularFile("etc/added", "new"),
+		),
+	)
+
+	_, contents := readEntries(t, ExtractDelta(derived, base))
+	want := map[string]string{
+		"etc/modified":    "after",
+		"etc/added":       "new",
+		"etc/.wh.removed": "",
+		".wh.var":         "",
+	}
+	if diff := cmp.Diff(contents, want); diff != "" {
+		t.Errorf("ExtractDelta (-got, +want) %s", diff)
+	}
+
+	// Applying the delta on top of base gives derived's filesystem.
+	rc := ExtractDelta(derived, base)
+	defer rc.Close()
+	delta, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(delta)), nil
+	})
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+	applied, err := AppendLayers(base, layer)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	got, err := FileDigests(applied)
+	if err != nil {
+		t.Fatalf("FileDigests(applied): %v", err)
+	}
+	wantDigests, err := FileDigests(derived)
+	if err != nil {
+		t.Fatalf("FileDigests(derived): %v", err)
+	}
+	if diff := cmp.Diff(got, wantDigests); diff != "" {
+		t.Errorf("base + delta (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractDeltaDirReplaced(t *testing.T) {
+	base := imageFromLayers(t, tarLayer(t,
+		directory("a/"),
+		regularFile("a/b", "b"),
+		directory("a/c/"),
+		regularFile("a/c/d", "d"),
+		regularFile("kept", "kept"),
+	))
+	derived := imageFromLayers(t, tarLayer(t,
+		regularFile("a", "now a file"),
+		regularFile("kept", "kept"),
+	))
+
+	headers, contents := readEntries(t, ExtractDelta(derived, base))
+	if diff := cmp.Diff(entryNames(headers), []string{"a"}); diff != "" {
+		t.Errorf("ExtractDelta entries (-got, +want) %s", diff)
+	}
+	if got, want := contents["a"], "now a file"; got != want {
+		t.Errorf("a = %q, want %q", got, want)
+	}
+}
+
+func TestExtractMap(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/passwd", "root"),
+			regularFile("etc/removed", "gone"),
+		),
+		tarLayer(t,
+			regularFile("etc/.wh.removed", ""),
+			hardlink("etc/passwd-", "etc/passwd"),
+			symlink("etc/link", "passwd"),
+		),
+	)
+
+	got, err := ExtractMap(img)
+	if err != nil {
+		t.Fatalf("ExtractMap: %v", err)
+	}
+	want := map[string][]byte{
+		"etc/passwd":  []byte("root"),
+		"etc/passwd-": []byte("root"),
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ExtractMap (-got, +want) %s", diff)
+	}
+
+	big := testFile{hdr: tar.Header{
+		Name:     "big",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     MaxExtractMapSize + 1,
+	}, contents: strings.Repeat("x", MaxExtractMapSize+1)}
+	if _, err := ExtractMap(imageFromLayers(t, tarLayer(t, big))); err == nil {
+		t.Error("ExtractMap of a huge image = nil error, want error")
+	}
+}
+
+func TestExtractInto(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("a", "a"), regularFile("b", "old b")),
+		tarLayer(t, regularFile("b", "new b")),
+	)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	writeFile := func(name, contents string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", name, err)
+		}
+		if _, err := io.WriteString(tw, contents); err != nil {
+			t.Fatalf("Write(%q): %v", name, err)
+		}
+	}
+	writeFile("before", "before")
+	if err := ExtractInto(img, tw); err != nil {
+		t.Fatalf("ExtractInto: %v", err)
+	}
+	// tw must still be usable.
+	writeFile("after", "after")
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	headers, contents := readEntries(t, ioutil.NopCloser(&buf))
+	if diff := cmp.Diff(entryNames(headers), []string{"before", "b", "a", "after"}); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	want := map[string]string{"before": "before", "a": "a", "b": "new b", "after": "after"}
+	if diff := cmp.Diff(contents, want); diff != "" {
+		t.Errorf("contents (-got, +want) %s", diff)
+	}
+}
+
+// onceLayer fails if its contents are streamed more than once.
+type onceLayer struct {
+	v1.Layer
+	opened *int
+}
+
+func (l onceLayer) Uncompressed() (io.ReadCloser, error) {
+	if *l.opened++; *l.opened > 1 {
+		return nil, errors.New("layer contents were read twice")
+	}
+	return l.Layer.Uncompressed()
+}
+
+// wrongDiffIDLayer reports a diff id that doesn't match its contents.
+type wrongDiffIDLayer struct {
+	v1.Layer
+	diffID v1.Hash
+}
+
+func (l wrongDiffIDLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func TestExtractSinglePass(t *testing.T) {
+	onceImage := func() v1.Image {
+		layer := tarLayer(t, regularFile("a", "a"), hardlink("b", "a"))
+		return imageFromLayers(t, onceLayer{Layer: layer, opened: new(int)})
+	}
+	for name, extract := range map[string]func(v1.Image) error{
+		"ExtractWithOptions": func(img v1.Image) error {
+			rc := ExtractWithOptions(img, &ExtractOptions{VerifyDiffIDs: true})
+			defer rc.Close()
+			_, err := io.Copy(ioutil.Discard, rc)
+			return err
+		},
+		"ExtractTo": func(img v1.Image) error {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			return ExtractTo(img, dir, &ExtractOptions{VerifyDiffIDs: true})
+		},
+		"FileDigests": func(img v1.Image) error {
+			_, err := FileDigests(img)
+			return err
+		},
+		"ExtractMap": func(img v1.Image) error {
+			_, err := ExtractMap(img)
+			return err
+		},
+	} {
+		if err := extract(onceImage()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestExtractVerifyDiffIDs(t *testing.T) {
+	layer := tarLayer(t, regularFile("a", "a"))
+	wrong, err := v1.NewHash("sha256:" + strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatalf("NewHash: %v", err)
+	}
+	img := imageFromLayers(t, wrongDiffIDLayer{Layer: layer, diffID: wrong})
+
+	rc := ExtractWithOptions(img, &ExtractOptions{VerifyDiffIDs: true})
+	defer rc.Close()
+	if _, err := io.Copy(ioutil.Discard, rc); err == nil || !strings.Contains(err.Error(), wrong.String()) {
+		t.Errorf("ExtractWithOptions(VerifyDiffIDs) = %v, want a diff id mismatch", err)
+	}
+
+	rc = Extract(img)
+	defer rc.Close()
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Errorf("Extract() = %v, want no verification by default", err)
+	}
+}
+
+// failingWriter fails after accepting n bytes.
+type failingWriter struct {
+	n int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.n = 0
+		return 0, errDiskFull
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestExtractTee(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("a", "a"), regularFile("big", strings.Repeat("x", 1<<20))),
+		tarLayer(t, regularFile("b", "b")),
+	)
+	want, err := ioutil.ReadAll(Extract(img))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	var buf bytes.Buffer
+	hasher := sha256.New()
+	if err := ExtractTee(img, &buf, hasher); err != nil {
+		t.Fatalf("ExtractTee: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("ExtractTee wrote different bytes than Extract")
+	}
+	if got, wantSum := hasher.Sum(nil), sha256.Sum256(buf.Bytes()); !bytes.Equal(got, wantSum[:]) {
+		t.Errorf("hasher sum = %x, want %x", got, wantSum)
+	}
+
+	// A failing writer doesn't stop the others, but is reported.
+	buf.Reset()
+	err = ExtractTee(img, &failingWriter{n: 512}, &buf)
+	var teeErr *TeeError
+	if !errors.As(err, &teeErr) || !errors.Is(err, errDiskFull) {
+		t.Errorf("ExtractTee with a failing writer: got %v, want a *TeeError wrapping %v", err, errDiskFull)
+	} else if teeErr.Writers[0] != errDiskFull || teeErr.Writers[1] != nil || teeErr.Err != nil {
+		t.Errorf("TeeError = %+v, want only writer 0 to fail", teeErr)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("ExtractTee stopped writing to the healthy writer")
+	}
+
+	// The extraction error is kept along with those of the writers.
+	broken := imageFromLayers(t,
+		unreadableLayer{tarLayer(t, regularFile("a", "a"))},
+		tarLayer(t, regularFile("big", strings.Repeat("x", 1<<20))),
+	)
+	err = ExtractTee(broken, &failingWriter{n: 512}, ioutil.Discard)
+	var extractErr *ExtractError
+	if !errors.Is(err, errDiskFull) || !errors.As(err, &extractErr) {
+		t.Errorf("ExtractTee of a broken image with a failing writer: got %v, want both errors", err)
+	}
+
+	// Extraction stops once every writer has failed.
+	counting := &countingWriter{w: ioutil.Discard}
+	first := &failingWriter{n: 512}
+	if err := ExtractTee(img, first, io.MultiWriter(&failingWriter{n: 1024}, counting)); err == nil {
+		t.Error("ExtractTee with only failing writers: got nil error")
+	}
+	if counting.n >= int64(len(want)) {
+		t.Errorf("ExtractTee wrote %d bytes after every writer failed, want it to stop early", counting.n)
+	}
+
+	if err := ExtractTee(img); err == nil {
+		t.Error("ExtractTee without writers: got nil error")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/tarball"
+)
+
+// FlattenOptions are used to expose optional information to guide or
+// control how FlattenToLayer squashes an image's filesystem.
+type FlattenOptions struct {
+	// PreserveModTimes keeps the modification time of each entry as it
+	// appeared in the layer that provided it, rather than normalizing
+	// every entry to the Unix epoch.
+	PreserveModTimes bool
+}
+
+// FlattenToLayer returns a single v1.Layer containing the flattened
+// filesystem of img, as produced by Extract.
+//
+// By default, the modification time of every entry is normalized to the Unix
+// epoch so that the resulting layer is reproducible. Set PreserveModTimes
+// when downstream tooling relies on the original mtimes.
+func FlattenToLayer(img v1.Image, opts *FlattenOptions) (v1.Layer, error) {
+	if opts == nil {
+		opts = &FlattenOptions{}
+	}
+	eo := &ExtractOptions{}
+	if !opts.PreserveModTimes {
+		epoch := time.Unix(0, 0).UTC()
+		eo.ModTime = &epoch
+	}
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ExtractWithOptions(img, eo), nil
+	})
+}
+
+// Squash returns an image with the same config as base, but whose layers are
+// replaced by a single one holding its flattened filesystem, as produced by
+// FlattenToLayer with PreserveModTimes. Whiteouts are resolved, so deleted
+// files don't reappear. The history is replaced by a single entry for the
+// squashed layer.
+func Squash(base v1.Image) (v1.Image, error) {
+	layer, err := FlattenToLayer(base, &FlattenOptions{PreserveModTimes: true})
+	if err != nil {
+		return nil, err
+	}
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.Layers = nil
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = nil
+	cf.History = nil
+	// Start from the empty image, so that none of base's layers linger.
+	img, err := configFile(empty.Image, m, cf)
+	if err != nil {
+		return nil, err
+	}
+	return Append(img, Addendum{
+		Layer: layer,
+		History: v1.History{
+			CreatedBy: "mutate.Squash",
+			Created:   v1.Time{Time: time.Now()},
+		},
+	})
+}
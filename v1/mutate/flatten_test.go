@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+)
+
+func TestFlattenToLayerModTimes(t *testing.T) {
+	older := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	lower := regularFile("app/config", "old")
+	lower.hdr.ModTime = older
+	upper := regularFile("app/config", "new")
+	upper.hdr.ModTime = newer
+	untouched := regularFile("app/data", "data")
+	untouched.hdr.ModTime = older
+
+	img := imageFromLayers(t, tarLayer(t, lower, untouched), tarLayer(t, upper))
+
+	for _, tc := range []struct {
+		name string
+		opts *FlattenOptions
+		want map[string]time.Time
+	}{{
+		name: "preserved",
+		opts: &FlattenOptions{PreserveModTimes: true},
+		want: map[string]time.Time{
+			"app/config": newer,
+			"app/data":   older,
+		},
+	}, {
+		name: "normalized",
+		opts: nil,
+		want: map[string]time.Time{
+			"app/config": time.Unix(0, 0),
+			"app/data":   time.Unix(0, 0),
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := FlattenToLayer(img, tc.opts)
+			if err != nil {
+				t.Fatalf("FlattenToLayer: %v", err)
+			}
+			rc, err := layer.Uncompressed()
+			if err != nil {
+				t.Fatalf("Uncompressed: %v", err)
+			}
+			headers, contents := readEntries(t, rc)
+			if got, want := contents["app/config"], "new"; got != want {
+				t.Errorf("app/config = %q, want %q", got, want)
+			}
+			for _, hdr := range headers {
+				if want := tc.want[hdr.Name]; !hdr.ModTime.Equal(want) {
+					t.Errorf("%s ModTime = %v, want %v", hdr.Name, hdr.ModTime, want)
+				}
+			}
+			if got, want := len(headers), len(tc.want); got != want {
+				t.Errorf("got %d entries, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSquash(t *testing.T) {
+	base := imageFromLayers(t,
+		tarLayer(t, regularFile("kept", "kept"), regularFile("deleted", "deleted"), regularFile("changed", "old")),
+		tarLayer(t, regularFile(".wh.deleted", ""), regularFile("changed", "new")),
+	)
+	base, err := Config(base, v1.Config{Env: []string{"PATH=/bin"}, Entrypoint: []string{"/app"}})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	img, err := Squash(base)
+	if err != nil {
+		t.Fatalf("Squash: %v", err)
+	}
+	m := getManifest(t, img)
+	cf := getConfigFile(t, img)
+	if len(m.Layers) != 1 || len(cf.RootFS.DiffIDs) != 1 {
+		t.Fatalf("got %d layers and %d diff ids, want 1", len(m.Layers), len(cf.RootFS.DiffIDs))
+	}
+	if len(cf.History) != 1 || cf.History[0].EmptyLayer {
+		t.Errorf("History = %v, want a single non-empty entry", cf.History)
+	}
+	if diff := cmp.Diff(cf.Config, getConfigFile(t, base).Config); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+
+	_, contents := readEntries(t, Extract(img))
+	want := map[string]string{"kept": "kept", "changed": "new"}
+	if diff := cmp.Diff(contents, want); diff != "" {
+		t.Errorf("Extract (-got, +want) %s", diff)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// Freeze computes img's manifest, config file and their digests once,
+// returning a v1.Image whose corresponding accessors are O(1) thereafter.
+//
+// This is useful before handing an image produced by a chain of mutations
+// to multiple consumers, each of which would otherwise recompute them.
+// Layer access is delegated to img.
+func Freeze(img v1.Image) (v1.Image, error) {
+	rm, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(rm))
+	if err != nil {
+		return nil, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(rm))
+	if err != nil {
+		return nil, err
+	}
+
+	rcf, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := v1.ParseConfigFile(bytes.NewReader(rcf))
+	if err != nil {
+		return nil, err
+	}
+	configName, _, err := v1.SHA256(bytes.NewReader(rcf))
+	if err != nil {
+		return nil, err
+	}
+
+	return &frozenImage{
+		Image:         img,
+		manifest:      m,
+		rawManifest:   rm,
+		digest:        digest,
+		configFile:    cf,
+		rawConfigFile: rcf,
+		configName:    configName,
+	}, nil
+}
+
+type frozenImage struct {
+	v1.Image
+	manifest      *v1.Manifest
+	rawManifest   []byte
+	digest        v1.Hash
+	configFile    *v1.ConfigFile
+	rawConfigFile []byte
+	configName    v1.Hash
+}
+
+var _ v1.Image = (*frozenImage)(nil)
+
+// BlobSet returns an unordered collection of all the blobs in the image.
+func (i *frozenImage) BlobSet() (map[v1.Hash]struct{}, error) {
+	bs := make(map[v1.Hash]struct{}, len(i.manifest.Layers)+1)
+	for _, l := range i.manifest.Layers {
+		bs[l.Digest] = struct{}{}
+	}
+	bs[i.configName] = struct{}{}
+	return bs, nil
+}
+
+// ConfigName returns the hash of the image's config file.
+func (i *frozenImage) ConfigName() (v1.Hash, error) {
+	return i.configName, nil
+}
+
+// ConfigFile returns this image's config file.
+func (i *frozenImage) ConfigFile() (*v1.ConfigFile, error) {
+	return i.configFile, nil
+}
+
+// RawConfigFile returns the serialized bytes of ConfigFile()
+func (i *frozenImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfigFile, nil
+}
+
+// Digest returns the sha256 of this image's manifest.
+func (i *frozenImage) Digest() (v1.Hash, error) {
+	return i.digest, nil
+}
+
+// Manifest returns this image's Manifest object.
+func (i *frozenImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest returns the serialized bytes of Manifest()
+func (i *frozenImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
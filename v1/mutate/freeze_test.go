@@ -0,0 +1,91 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+)
+
+// countingImage counts the calls made to the methods Freeze memoizes.
+type countingImage struct {
+	v1.Image
+	calls int
+}
+
+func (c *countingImage) RawManifest() ([]byte, error) {
+	c.calls++
+	return c.Image.RawManifest()
+}
+
+func (c *countingImage) RawConfigFile() ([]byte, error) {
+	c.calls++
+	return c.Image.RawConfigFile()
+}
+
+func TestFreeze(t *testing.T) {
+	base, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	img, err := AppendLayers(base, getLayers(t, base)[0])
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	counting := &countingImage{Image: img}
+
+	frozen, err := Freeze(counting)
+	if err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+	calls := counting.calls
+
+	for i := 0; i < 3; i++ {
+		got, err := frozen.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		want, err := img.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		if got != want {
+			t.Errorf("Digest = %v, want %v", got, want)
+		}
+		if _, err := frozen.ConfigName(); err != nil {
+			t.Fatalf("ConfigName: %v", err)
+		}
+		if _, err := frozen.Manifest(); err != nil {
+			t.Fatalf("Manifest: %v", err)
+		}
+	}
+	if counting.calls != calls {
+		t.Errorf("frozen image recomputed its manifest or config %d times", counting.calls-calls)
+	}
+
+	if !manifestsAreEqual(t, frozen, img) {
+		t.Error("manifests are not the same")
+	}
+	if !configFilesAreEqual(t, frozen, img) {
+		t.Error("config files are not the same")
+	}
+	if diff := cmp.Diff(layerDigests(t, frozen), layerDigests(t, img)); diff != "" {
+		t.Errorf("Layers (-got, +want) %s", diff)
+	}
+	assertLayerOrderMatchesManifest(t, frozen)
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/partial"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// MapIndexImages returns a copy of idx in which each image is replaced with
+// the result of fn, e.g. to apply the same change to every platform of a
+// multi-arch image. fn is given the platform of the image's descriptor, if
+// any. Nested indexes are mapped too; other manifests are left alone.
+func MapIndexImages(idx v1.ImageIndex, fn func(v1.Platform, v1.Image) (v1.Image, error)) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	result := &index{
+		base:     idx,
+		manifest: im.DeepCopy(),
+		images:   make(map[v1.Hash]v1.Image),
+		indexes:  make(map[v1.Hash]v1.ImageIndex),
+	}
+	for i := range result.manifest.Manifests {
+		desc := &result.manifest.Manifests[i]
+		switch desc.MediaType {
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			var platform v1.Platform
+			if desc.Platform != nil {
+				platform = *desc.Platform.DeepCopy()
+			}
+			if img, err = fn(platform, img); err != nil {
+				return nil, fmt.Errorf("manifest %d (%v): %v", i, desc.Digest, err)
+			}
+			if err := describe(desc, img); err != nil {
+				return nil, err
+			}
+			result.images[desc.Digest] = img
+		case types.OCIImageIndex, types.DockerManifestList:
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if child, err = MapIndexImages(child, fn); err != nil {
+				return nil, err
+			}
+			if err := describe(desc, child); err != nil {
+				return nil, err
+			}
+			result.indexes[desc.Digest] = child
+		}
+	}
+	return result, nil
+}
+
+// IndexAddendum is an image, or a nested index, to append to an index, along
+// with the platform it is for. Exactly one of Image and Index must be set.
+type IndexAddendum struct {
+	Image v1.Image
+	Index v1.ImageIndex
+
+	// Platform, unless zero, is recorded in the new descriptor.
+	Platform v1.Platform
+
+	// Annotations are added to the new descriptor.
+	Annotations map[string]string
+}
+
+// AppendIndex returns a copy of base that also references each of adds, in
+// order, e.g. to stitch per-architecture images into a multi-arch image,
+// starting from empty.Index.
+func AppendIndex(base v1.ImageIndex, adds ...IndexAddendum) (v1.ImageIndex, error) {
+	im, err := base.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	result := &index{
+		base:     base,
+		manifest: im.DeepCopy(),
+		images:   make(map[v1.Hash]v1.Image),
+		indexes:  make(map[v1.Hash]v1.ImageIndex),
+	}
+	for i, add := range adds {
+		var m manifester
+		switch {
+		case add.Image != nil && add.Index == nil:
+			m = add.Image
+		case add.Index != nil && add.Image == nil:
+			m = add.Index
+		default:
+			return nil, fmt.Errorf("addendum %d must have exactly one of an image and an index", i)
+		}
+		desc := v1.Descriptor{}
+		if err := describe(&desc, m); err != nil {
+			return nil, fmt.Errorf("addendum %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(add.Platform, v1.Platform{}) {
+			desc.Platform = add.Platform.DeepCopy()
+		}
+		if len(add.Annotations) > 0 {
+			desc.Annotations = make(map[string]string, len(add.Annotations))
+			for k, v := range add.Annotations {
+				desc.Annotations[k] = v
+			}
+		}
+		result.manifest.Manifests = append(result.manifest.Manifests, desc)
+		if add.Image != nil {
+			result.images[desc.Digest] = add.Image
+		} else {
+			result.indexes[desc.Digest] = add.Index
+		}
+	}
+	return result, nil
+}
+
+// RemoveManifest returns a copy of base without the descriptors for which
+// matcher returns true, e.g. to drop the Windows images of a multi-arch image.
+// The remaining descriptors keep their order.
+func RemoveManifest(base v1.ImageIndex, matcher func(v1.Descriptor) bool) (v1.ImageIndex, error) {
+	im, err := base.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	result := &index{
+		base:     base,
+		manifest: im.DeepCopy(),
+		images:   make(map[v1.Hash]v1.Image),
+		indexes:  make(map[v1.Hash]v1.ImageIndex),
+	}
+	kept := result.manifest.Manifests[:0]
+	for _, desc := range result.manifest.Manifests {
+		if !matcher(*desc.DeepCopy()) {
+			kept = append(kept, desc)
+		}
+	}
+	result.manifest.Manifests = kept
+	return result, nil
+}
+
+// manifester is implemented by both v1.Image and v1.ImageIndex.
+type manifester interface {
+	MediaType() (types.MediaType, error)
+	Digest() (v1.Hash, error)
+	RawManifest() ([]byte, error)
+}
+
+// describe updates desc to point at m, keeping its platform, urls and
+// annotations.
+func describe(desc *v1.Descriptor, m manifester) error {
+	mt, err := m.MediaType()
+	if err != nil {
+		return err
+	}
+	raw, err := m.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := m.Digest()
+	if err != nil {
+		return err
+	}
+	desc.MediaType = mt
+	desc.Size = int64(len(raw))
+	desc.Digest = digest
+	return nil
+}
+
+// index is an image index whose manifest may differ from that of base, and
+// which may reference images and indexes that base doesn't.
+type index struct {
+	base     v1.ImageIndex
+	manifest *v1.IndexManifest
+	images   map[v1.Hash]v1.Image
+	indexes  map[v1.Hash]v1.ImageIndex
+}
+
+var _ v1.ImageIndex = (*index)(nil)
+
+// MediaType of this image index's manifest.
+func (i *index) MediaType() (types.MediaType, error) {
+	if i.manifest.MediaType != "" {
+		return i.manifest.MediaType, nil
+	}
+	return i.base.MediaType()
+}
+
+// Digest returns the sha256 of this index's manifest.
+func (i *index) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// IndexManifest returns this image index's manifest object.
+func (i *index) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest returns the serialized bytes of IndexManifest().
+func (i *index) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// Image returns a v1.Image that this ImageIndex references.
+func (i *index) Image(h v1.Hash) (v1.Image, error) {
+	if img, ok := i.images[h]; ok {
+		return img, nil
+	}
+	return i.base.Image(h)
+}
+
+// ImageIndex returns a v1.ImageIndex that this ImageIndex references.
+func (i *index) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	if idx, ok := i.indexes[h]; ok {
+		return idx, nil
+	}
+	return i.base.ImageIndex(h)
+}
@@ -0,0 +1,311 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/random"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// indexFromImages returns an OCI image index of the given images, one per
+// platform.
+func indexFromImages(t *testing.T, platforms []v1.Platform, imgs []v1.Image) *index {
+	t.Helper()
+
+	idx := &index{
+		manifest: &v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIImageIndex,
+		},
+		images:  make(map[v1.Hash]v1.Image),
+		indexes: make(map[v1.Hash]v1.ImageIndex),
+	}
+	for i, img := range imgs {
+		desc := v1.Descriptor{Platform: &platforms[i]}
+		if err := describe(&desc, img); err != nil {
+			t.Fatalf("describe: %v", err)
+		}
+		idx.manifest.Manifests = append(idx.manifest.Manifests, desc)
+		idx.images[desc.Digest] = img
+	}
+	return idx
+}
+
+func TestMapIndexImages(t *testing.T) {
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+	var imgs []v1.Image
+	for range platforms {
+		img, err := random.Image(100, 1)
+		if err != nil {
+			t.Fatalf("random.Image: %v", err)
+		}
+		imgs = append(imgs, img)
+	}
+	base := indexFromImages(t, platforms, imgs)
+	baseDigest, err := base.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+
+	var seen []v1.Platform
+	result, err := MapIndexImages(base, func(p v1.Platform, img v1.Image) (v1.Image, error) {
+		seen = append(seen, p)
+		return Append(img, Addendum{Layer: tarLayer(t, regularFile("arch", p.Architecture))})
+	})
+	if err != nil {
+		t.Fatalf("MapIndexImages: %v", err)
+	}
+	if diff := cmp.Diff(seen, platforms); diff != "" {
+		t.Errorf("platforms (-got, +want) %s", diff)
+	}
+
+	im, err := result.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if got, want := len(im.Manifests), len(platforms); got != want {
+		t.Fatalf("index has %d manifests, want %d", got, want)
+	}
+	for i, desc := range im.Manifests {
+		if diff := cmp.Diff(desc.Platform, &platforms[i]); diff != "" {
+			t.Errorf("manifest %d platform (-got, +want) %s", i, diff)
+		}
+		img, err := result.Image(desc.Digest)
+		if err != nil {
+			t.Fatalf("Image: %v", err)
+		}
+		var want v1.Descriptor
+		if err := describe(&want, img); err != nil {
+			t.Fatalf("describe: %v", err)
+		}
+		want.Platform = desc.Platform
+		if diff := cmp.Diff(desc, want); diff != "" {
+			t.Errorf("manifest %d descriptor (-got, +want) %s", i, diff)
+		}
+		_, contents := readEntries(t, Extract(img))
+		if got := string(contents["arch"]); got != platforms[i].Architecture {
+			t.Errorf("manifest %d arch file = %q, want %q", i, got, platforms[i].Architecture)
+		}
+	}
+
+	digest, err := result.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if digest == baseDigest {
+		t.Error("MapIndexImages didn't change the index digest")
+	}
+	if d, err := base.Digest(); err != nil || d != baseDigest {
+		t.Errorf("base index digest = %v, %v; want it unchanged", d, err)
+	}
+
+	// Errors from fn are reported.
+	boom := errors.New("boom")
+	if _, err := MapIndexImages(base, func(v1.Platform, v1.Image) (v1.Image, error) {
+		return nil, boom
+	}); err == nil {
+		t.Error("MapIndexImages: got nil error, want fn's error")
+	}
+}
+
+func TestMapIndexImagesNested(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	child := indexFromImages(t, []v1.Platform{{OS: "linux", Architecture: "amd64"}}, []v1.Image{img})
+	parent := &index{
+		manifest: &v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex},
+		images:   make(map[v1.Hash]v1.Image),
+		indexes:  make(map[v1.Hash]v1.ImageIndex),
+	}
+	desc := v1.Descriptor{}
+	if err := describe(&desc, child); err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	parent.manifest.Manifests = append(parent.manifest.Manifests, desc)
+	parent.indexes[desc.Digest] = child
+
+	calls := 0
+	result, err := MapIndexImages(parent, func(p v1.Platform, img v1.Image) (v1.Image, error) {
+		calls++
+		return ArtifactType(img, "application/vnd.example")
+	})
+	if err != nil {
+		t.Fatalf("MapIndexImages: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	im, err := result.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if im.Manifests[0].Digest == desc.Digest {
+		t.Error("nested index digest didn't change")
+	}
+	nested, err := result.ImageIndex(im.Manifests[0].Digest)
+	if err != nil {
+		t.Fatalf("ImageIndex: %v", err)
+	}
+	nim, err := nested.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	mapped, err := nested.Image(nim.Manifests[0].Digest)
+	if err != nil {
+		t.Fatalf("Image: %v", err)
+	}
+	if got := getManifest(t, mapped).ArtifactType; got != "application/vnd.example" {
+		t.Errorf("nested image artifact type = %q, want it mapped", got)
+	}
+}
+
+func TestAppendIndex(t *testing.T) {
+	amd64, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	arm64, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	arm64Platform := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	idx, err := AppendIndex(empty.Index,
+		IndexAddendum{Image: amd64, Platform: v1.Platform{OS: "linux", Architecture: "amd64"}},
+		IndexAddendum{Image: arm64, Platform: arm64Platform, Annotations: map[string]string{"a": "b"}},
+	)
+	if err != nil {
+		t.Fatalf("AppendIndex: %v", err)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if got, want := len(im.Manifests), 2; got != want {
+		t.Fatalf("len(Manifests) = %d, want %d", got, want)
+	}
+	raw, err := arm64.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	mt, err := arm64.MediaType()
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	want := v1.Descriptor{
+		MediaType:   mt,
+		Size:        int64(len(raw)),
+		Digest:      digestOf(t, arm64),
+		Annotations: map[string]string{"a": "b"},
+		Platform:    &arm64Platform,
+	}
+	if diff := cmp.Diff(im.Manifests[1], want); diff != "" {
+		t.Errorf("arm64 descriptor (-got, +want) %s", diff)
+	}
+	for _, img := range []v1.Image{amd64, arm64} {
+		got, err := idx.Image(digestOf(t, img))
+		if err != nil || got != img {
+			t.Errorf("Image(%v) = %v, %v; want the appended image", digestOf(t, img), got, err)
+		}
+	}
+	if im, err := empty.Index.IndexManifest(); err != nil || len(im.Manifests) != 0 {
+		t.Errorf("empty.Index was modified: %v, %v", im, err)
+	}
+
+	// Indexes nest.
+	parent, err := AppendIndex(empty.Index, IndexAddendum{Index: idx})
+	if err != nil {
+		t.Fatalf("AppendIndex: %v", err)
+	}
+	pim, err := parent.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	if got := pim.Manifests[0]; got.MediaType != types.OCIImageIndex || got.Platform != nil {
+		t.Errorf("nested descriptor = %v, want an index without a platform", got)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if child, err := parent.ImageIndex(idxDigest); err != nil || child != idx {
+		t.Errorf("ImageIndex(%v) = %v, %v; want the appended index", idxDigest, child, err)
+	}
+
+	for _, add := range []IndexAddendum{{}, {Image: amd64, Index: idx}} {
+		if _, err := AppendIndex(empty.Index, add); err == nil {
+			t.Errorf("AppendIndex(%v): expected an error", add)
+		}
+	}
+}
+
+func TestRemoveManifest(t *testing.T) {
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "windows", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+	var imgs []v1.Image
+	for range platforms {
+		img, err := random.Image(100, 1)
+		if err != nil {
+			t.Fatalf("random.Image: %v", err)
+		}
+		imgs = append(imgs, img)
+	}
+	base := indexFromImages(t, platforms, imgs)
+	baseDigest, err := base.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+
+	result, err := RemoveManifest(base, func(desc v1.Descriptor) bool {
+		return desc.Platform != nil && desc.Platform.OS == "windows"
+	})
+	if err != nil {
+		t.Fatalf("RemoveManifest: %v", err)
+	}
+	im, err := result.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest: %v", err)
+	}
+	var got []v1.Hash
+	for _, desc := range im.Manifests {
+		got = append(got, desc.Digest)
+	}
+	if diff := cmp.Diff(got, []v1.Hash{digestOf(t, imgs[0]), digestOf(t, imgs[2])}); diff != "" {
+		t.Errorf("remaining manifests (-got, +want) %s", diff)
+	}
+	if d, err := result.Digest(); err != nil || d == baseDigest {
+		t.Errorf("Digest() = %v, %v; want it to change", d, err)
+	}
+	if d, err := base.Digest(); err != nil || d != baseDigest {
+		t.Errorf("base was modified: Digest() = %v, %v", d, err)
+	}
+	if img, err := result.Image(digestOf(t, imgs[2])); err != nil || img != imgs[2] {
+		t.Errorf("Image() = %v, %v; want the arm64 image", img, err)
+	}
+}
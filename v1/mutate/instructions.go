@@ -0,0 +1,248 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// Instruction is a Dockerfile instruction that only changes the config of an
+// image, such as ENV or CMD, for ApplyInstructions. It is implemented by
+// EnvInstruction, LabelInstruction, UserInstruction, WorkdirInstruction,
+// EntrypointInstruction, CmdInstruction, ExposeInstruction,
+// VolumeInstruction and StopSignalInstruction.
+type Instruction interface {
+	// String returns the instruction as it would be written in a
+	// Dockerfile.
+	String() string
+
+	apply(*v1.Config) error
+}
+
+// EnvInstruction sets the environment variable Name to Value.
+type EnvInstruction struct {
+	Name, Value string
+}
+
+func (i EnvInstruction) String() string { return "ENV " + i.Name + "=" + i.Value }
+
+func (i EnvInstruction) apply(cfg *v1.Config) error {
+	if i.Name == "" || strings.Contains(i.Name, "=") {
+		return fmt.Errorf("invalid environment variable name %q", i.Name)
+	}
+	cfg.Env = mergeEnv(cfg.Env, []string{i.Name + "=" + i.Value})
+	return nil
+}
+
+// LabelInstruction sets the label Key to Value.
+type LabelInstruction struct {
+	Key, Value string
+}
+
+func (i LabelInstruction) String() string { return "LABEL " + i.Key + "=" + i.Value }
+
+func (i LabelInstruction) apply(cfg *v1.Config) error {
+	if i.Key == "" {
+		return errors.New("label key must not be empty")
+	}
+	if cfg.Labels == nil {
+		cfg.Labels = map[string]string{}
+	}
+	cfg.Labels[i.Key] = i.Value
+	return nil
+}
+
+// UserInstruction sets the user, and optionally group, to run as.
+type UserInstruction struct {
+	User string
+}
+
+func (i UserInstruction) String() string { return "USER " + i.User }
+
+func (i UserInstruction) apply(cfg *v1.Config) error {
+	cfg.User = i.User
+	return nil
+}
+
+// WorkdirInstruction sets the working directory. A relative Dir is relative
+// to the previous working directory.
+type WorkdirInstruction struct {
+	Dir string
+}
+
+func (i WorkdirInstruction) String() string { return "WORKDIR " + i.Dir }
+
+func (i WorkdirInstruction) apply(cfg *v1.Config) error {
+	if i.Dir == "" {
+		return errors.New("working directory must not be empty")
+	}
+	dir := i.Dir
+	if !path.IsAbs(dir) {
+		dir = path.Join("/", cfg.WorkingDir, dir)
+	}
+	cfg.WorkingDir = dir
+	return nil
+}
+
+// EntrypointInstruction sets the entrypoint, in exec form.
+type EntrypointInstruction struct {
+	Entrypoint []string
+}
+
+func (i EntrypointInstruction) String() string { return "ENTRYPOINT " + execForm(i.Entrypoint) }
+
+func (i EntrypointInstruction) apply(cfg *v1.Config) error {
+	cfg.Entrypoint = append([]string(nil), i.Entrypoint...)
+	return nil
+}
+
+// CmdInstruction sets the command, in exec form.
+type CmdInstruction struct {
+	Cmd []string
+}
+
+func (i CmdInstruction) String() string { return "CMD " + execForm(i.Cmd) }
+
+func (i CmdInstruction) apply(cfg *v1.Config) error {
+	cfg.Cmd = append([]string(nil), i.Cmd...)
+	return nil
+}
+
+// ExposeInstruction exposes Port, e.g. "80" or "53/udp". The protocol
+// defaults to tcp.
+type ExposeInstruction struct {
+	Port string
+}
+
+func (i ExposeInstruction) String() string { return "EXPOSE " + i.Port }
+
+func (i ExposeInstruction) apply(cfg *v1.Config) error {
+	port, proto := i.Port, "tcp"
+	if j := strings.Index(port, "/"); j >= 0 {
+		port, proto = port[:j], strings.ToLower(port[j+1:])
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", i.Port)
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("invalid protocol in port %q", i.Port)
+	}
+	if cfg.ExposedPorts == nil {
+		cfg.ExposedPorts = map[string]struct{}{}
+	}
+	cfg.ExposedPorts[port+"/"+proto] = struct{}{}
+	return nil
+}
+
+// VolumeInstruction declares Path as a volume.
+type VolumeInstruction struct {
+	Path string
+}
+
+func (i VolumeInstruction) String() string { return "VOLUME [" + strconv.Quote(i.Path) + "]" }
+
+func (i VolumeInstruction) apply(cfg *v1.Config) error {
+	if i.Path == "" {
+		return errors.New("volume path must not be empty")
+	}
+	if cfg.Volumes == nil {
+		cfg.Volumes = map[string]struct{}{}
+	}
+	cfg.Volumes[i.Path] = struct{}{}
+	return nil
+}
+
+// StopSignalInstruction sets the signal that stops the container, e.g.
+// "SIGTERM".
+type StopSignalInstruction struct {
+	Signal string
+}
+
+func (i StopSignalInstruction) String() string { return "STOPSIGNAL " + i.Signal }
+
+func (i StopSignalInstruction) apply(cfg *v1.Config) error {
+	if i.Signal == "" {
+		return errors.New("stop signal must not be empty")
+	}
+	cfg.StopSignal = i.Signal
+	return nil
+}
+
+// execForm returns args in the JSON form of Dockerfile instructions.
+func execForm(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, strconv.Quote(arg))
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
+
+// ApplyInstructions applies instructions to the config of base, in order, and
+// records each of them in the history as an empty layer, the way docker build
+// does.
+//
+// As with docker build, an ENTRYPOINT clears the command inherited from base,
+// unless a CMD was applied before it.
+func ApplyInstructions(base v1.Image, instructions []Instruction) (v1.Image, error) {
+	if len(instructions) == 0 {
+		return base, nil
+	}
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	if cf.History, err = emptyLayerHistory(cf); err != nil {
+		return nil, err
+	}
+
+	created := v1.Time{Time: time.Now()}
+	cmdSet := false
+	for n, i := range instructions {
+		if i == nil {
+			return nil, fmt.Errorf("instruction %d is nil", n)
+		}
+		if err := i.apply(&cf.Config); err != nil {
+			return nil, fmt.Errorf("instruction %d (%v): %v", n, i, err)
+		}
+		switch i.(type) {
+		case CmdInstruction:
+			cmdSet = true
+		case EntrypointInstruction:
+			if !cmdSet {
+				cf.Config.Cmd = nil
+			}
+		}
+		cf.History = append(cf.History, v1.History{
+			Created:    created,
+			CreatedBy:  "/bin/sh -c #(nop)  " + i.String(),
+			EmptyLayer: true,
+		})
+	}
+	return configFile(base, m, cf)
+}
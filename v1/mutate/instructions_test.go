@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+)
+
+func TestApplyInstructions(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{
+		Env:        []string{"PATH=/bin", "HOME=/root"},
+		Cmd:        []string{"/bin/sh"},
+		WorkingDir: "/srv",
+		Labels:     map[string]string{"base": "yes"},
+	})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	instructions := []Instruction{
+		EnvInstruction{Name: "HOME", Value: "/home/app"},
+		EnvInstruction{Name: "MODE", Value: "prod"},
+		LabelInstruction{Key: "org.opencontainers.image.title", Value: "app"},
+		UserInstruction{User: "app:app"},
+		WorkdirInstruction{Dir: "app"},
+		WorkdirInstruction{Dir: "data"},
+		EntrypointInstruction{Entrypoint: []string{"/app", "--serve"}},
+		ExposeInstruction{Port: "8080"},
+		ExposeInstruction{Port: "53/UDP"},
+		VolumeInstruction{Path: "/data"},
+		StopSignalInstruction{Signal: "SIGINT"},
+	}
+	result, err := ApplyInstructions(base, instructions)
+	if err != nil {
+		t.Fatalf("ApplyInstructions: %v", err)
+	}
+
+	want := v1.Config{
+		Env:        []string{"PATH=/bin", "HOME=/home/app", "MODE=prod"},
+		WorkingDir: "/srv/app/data",
+		Labels:     map[string]string{"base": "yes", "org.opencontainers.image.title": "app"},
+		User:       "app:app",
+		Entrypoint: []string{"/app", "--serve"},
+		ExposedPorts: map[string]struct{}{
+			"8080/tcp": {},
+			"53/udp":   {},
+		},
+		Volumes:    map[string]struct{}{"/data": {}},
+		StopSignal: "SIGINT",
+	}
+	cf := getConfigFile(t, result)
+	if diff := cmp.Diff(cf.Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+
+	history := cf.History[len(getConfigFile(t, base).History):]
+	var createdBy []string
+	for _, h := range history {
+		if !h.EmptyLayer {
+			t.Errorf("history entry %q is not an empty layer", h.CreatedBy)
+		}
+		if h.Created != history[0].Created {
+			t.Errorf("history entry %q created at %v, want %v", h.CreatedBy, h.Created, history[0].Created)
+		}
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	wantCreatedBy := []string{
+		"/bin/sh -c #(nop)  ENV HOME=/home/app",
+		"/bin/sh -c #(nop)  ENV MODE=prod",
+		"/bin/sh -c #(nop)  LABEL org.opencontainers.image.title=app",
+		"/bin/sh -c #(nop)  USER app:app",
+		"/bin/sh -c #(nop)  WORKDIR app",
+		"/bin/sh -c #(nop)  WORKDIR data",
+		`/bin/sh -c #(nop)  ENTRYPOINT ["/app","--serve"]`,
+		"/bin/sh -c #(nop)  EXPOSE 8080",
+		"/bin/sh -c #(nop)  EXPOSE 53/UDP",
+		`/bin/sh -c #(nop)  VOLUME ["/data"]`,
+		"/bin/sh -c #(nop)  STOPSIGNAL SIGINT",
+	}
+	if diff := cmp.Diff(createdBy, wantCreatedBy); diff != "" {
+		t.Errorf("history (-got, +want) %s", diff)
+	}
+	if got, want := len(cf.RootFS.DiffIDs), 1; got != want {
+		t.Errorf("image has %d layers, want %d", got, want)
+	}
+	if got := getConfigFile(t, base).Config.Labels; len(got) != 1 {
+		t.Errorf("base labels = %v, want them unchanged", got)
+	}
+}
+
+func TestApplyInstructionsCmd(t *testing.T) {
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err := Config(img, v1.Config{Cmd: []string{"/bin/sh"}})
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	// A CMD before the ENTRYPOINT survives it.
+	result, err := ApplyInstructions(base, []Instruction{
+		CmdInstruction{Cmd: []string{"--port", "80"}},
+		EntrypointInstruction{Entrypoint: []string{"/app"}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyInstructions: %v", err)
+	}
+	want := v1.Config{Entrypoint: []string{"/app"}, Cmd: []string{"--port", "80"}}
+	if diff := cmp.Diff(getConfigFile(t, result).Config, want); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	if got, want := getConfigFile(t, result).History[1].CreatedBy, `/bin/sh -c #(nop)  CMD ["--port","80"]`; got != want {
+		t.Errorf("CreatedBy = %q, want %q", got, want)
+	}
+
+	if result, err := ApplyInstructions(base, nil); err != nil || result != base {
+		t.Errorf("ApplyInstructions(nil) = %v, %v; want base", result, err)
+	}
+}
+
+func TestApplyInstructionsHistory(t *testing.T) {
+	img, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cf := getConfigFile(t, img).DeepCopy()
+	cf.History = nil
+	base, err := ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+
+	result, err := ApplyInstructions(base, []Instruction{EnvInstruction{Name: "A", Value: "b"}})
+	if err != nil {
+		t.Fatalf("ApplyInstructions: %v", err)
+	}
+	// Each layer of a base without history gets a blank entry first.
+	history := getConfigFile(t, result).History
+	if got, want := len(history), 3; got != want {
+		t.Fatalf("len(History) = %d, want %d", got, want)
+	}
+	if got, want := nonEmptyLayers(history), 2; got != want {
+		t.Errorf("History has %d entries with a layer, want %d", got, want)
+	}
+	if h := history[2]; !h.EmptyLayer || h.CreatedBy != "/bin/sh -c #(nop)  ENV A=b" {
+		t.Errorf("History[2] = %+v, want an empty layer for ENV A=b", h)
+	}
+
+	cf.History = []v1.History{{Comment: "only one"}}
+	misaligned, err := ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	if _, err := ApplyInstructions(misaligned, []Instruction{EnvInstruction{Name: "A", Value: "b"}}); err == nil {
+		t.Error("ApplyInstructions with fewer history entries than layers = nil error, want error")
+	}
+}
+
+func TestApplyInstructionsErrors(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	for _, i := range []Instruction{
+		nil,
+		EnvInstruction{Name: ""},
+		EnvInstruction{Name: "A=B"},
+		LabelInstruction{},
+		WorkdirInstruction{},
+		ExposeInstruction{Port: "http"},
+		ExposeInstruction{Port: "70000"},
+		ExposeInstruction{Port: "80/icmp"},
+		VolumeInstruction{},
+		StopSignalInstruction{},
+	} {
+		if _, err := ApplyInstructions(base, []Instruction{i}); err == nil {
+			t.Errorf("ApplyInstructions(%v) = nil error, want error", i)
+		}
+	}
+}
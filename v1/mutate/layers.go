@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/partial"
+)
+
+// AssertLayerOrder returns an error unless the diff ids of img's layers are
+// exactly expected, in order, e.g. to check that a build is reproducible.
+//
+// The error lists the layers the two have in common, followed by the
+// expected (-) and actual (+) layers from where they diverge.
+func AssertLayerOrder(img v1.Image, expected []v1.Hash) error {
+	diffIDs, err := partial.DiffIDs(img)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for i < len(diffIDs) && i < len(expected) && diffIDs[i] == expected[i] {
+		i++
+	}
+	if i == len(diffIDs) && i == len(expected) {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "layer order diverges at index %d (-want, +got):", i)
+	for j := 0; j < i; j++ {
+		fmt.Fprintf(&b, "\n  %d: %v", j, diffIDs[j])
+	}
+	for j := i; j < len(expected); j++ {
+		fmt.Fprintf(&b, "\n- %d: %v", j, expected[j])
+	}
+	for j := i; j < len(diffIDs); j++ {
+		fmt.Fprintf(&b, "\n+ %d: %v", j, diffIDs[j])
+	}
+	return errors.New(b.String())
+}
+
+// RemoveLayer returns a copy of img without the layer whose diff id is
+// diffID, e.g. to drop a debugging layer. The layer's descriptor is removed
+// from the manifest, and its diff id and history entry from the config. If
+// several layers have that diff id, the topmost one is removed.
+func RemoveLayer(img v1.Image, diffID v1.Hash) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, h := range cf.RootFS.DiffIDs {
+		if h == diffID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("image has no layer with diff id %v", diffID)
+	}
+
+	// The manifest refers to the layer by its digest, not its diff id.
+	layer, err := img.LayerByDiffID(diffID)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if index >= len(m.Layers) || m.Layers[index].Digest != digest {
+		return nil, fmt.Errorf("layer %d of the manifest is not the layer with diff id %v (digest %v)", index, diffID, digest)
+	}
+
+	m = m.DeepCopy()
+	m.Layers = append(m.Layers[:index], m.Layers[index+1:]...)
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = append(cf.RootFS.DiffIDs[:index], cf.RootFS.DiffIDs[index+1:]...)
+	// History has entries for empty layers too, so find the layer's own.
+	for i, n := 0, 0; i < len(cf.History); i++ {
+		if cf.History[i].EmptyLayer {
+			continue
+		}
+		if n == index {
+			cf.History = append(cf.History[:i], cf.History[i+1:]...)
+			break
+		}
+		n++
+	}
+	return configFile(img, m, cf)
+}
+
+// ReplaceLayers returns a copy of base whose layers are exactly layers, e.g.
+// to assemble a filesystem from scratch while keeping base's config. The
+// history is rebuilt to match, as AppendLayers records it.
+func ReplaceLayers(base v1.Image, layers ...v1.Layer) (v1.Image, error) {
+	adds := make([]Addendum, 0, len(layers))
+	for _, layer := range layers {
+		adds = append(adds, Addendum{Layer: layer})
+	}
+	if err := validate(adds); err != nil {
+		return nil, err
+	}
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.Layers = []v1.Descriptor{}
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = []v1.Hash{}
+	cf.History = nil
+	stripped, err := configFile(base, m, cf)
+	if err != nil {
+		return nil, err
+	}
+	return AppendLayers(stripped, layers...)
+}
+
+// LayerDigests returns the digests of img's blobs in a deterministic order:
+// those of its layers from the base up, then that of its config. Unlike
+// BlobSet, this lets a pusher upload blobs base-first for better cache
+// locality.
+func LayerDigests(img v1.Image) ([]v1.Hash, error) {
+	digests, err := partial.FSLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	config, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	return append(digests, config), nil
+}
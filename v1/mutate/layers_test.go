@@ -0,0 +1,238 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+)
+
+func TestAssertLayerOrder(t *testing.T) {
+	a := tarLayer(t, regularFile("a", "a"))
+	b := tarLayer(t, regularFile("b", "b"))
+	c := tarLayer(t, regularFile("c", "c"))
+	img := imageFromLayers(t, a, b, c)
+
+	diffID := func(l v1.Layer) v1.Hash {
+		h, err := l.DiffID()
+		if err != nil {
+			t.Fatalf("DiffID: %v", err)
+		}
+		return h
+	}
+
+	if err := AssertLayerOrder(img, []v1.Hash{diffID(a), diffID(b), diffID(c)}); err != nil {
+		t.Errorf("AssertLayerOrder(a, b, c) = %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		expected []v1.Hash
+		want     []string
+	}{{
+		name:     "swapped",
+		expected: []v1.Hash{diffID(a), diffID(c), diffID(b)},
+		want:     []string{"diverges at index 1", "  0: " + diffID(a).String(), "- 1: " + diffID(c).String(), "+ 1: " + diffID(b).String()},
+	}, {
+		name:     "missing",
+		expected: []v1.Hash{diffID(a), diffID(b)},
+		want:     []string{"diverges at index 2", "+ 2: " + diffID(c).String()},
+	}, {
+		name:     "extra",
+		expected: []v1.Hash{diffID(a), diffID(b), diffID(c), diffID(a)},
+		want:     []string{"diverges at index 3", "- 3: " + diffID(a).String()},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			err := AssertLayerOrder(img, test.expected)
+			if err == nil {
+				t.Fatal("AssertLayerOrder() = nil, want error")
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("AssertLayerOrder() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveLayer(t *testing.T) {
+	base, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	debug := gzipLayer(t, regularFile("debug", "debug"))
+	top := gzipLayer(t, regularFile("top", "top"))
+	img, err := Append(base,
+		Addendum{Layer: debug, History: v1.History{CreatedBy: "debug"}},
+		Addendum{Layer: top, History: v1.History{CreatedBy: "top"}},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// Put an empty layer entry before the debug layer's.
+	cf := getConfigFile(t, img).DeepCopy()
+	cf.History = append(cf.History[:2], append([]v1.History{{CreatedBy: "ENV", EmptyLayer: true}}, cf.History[2:]...)...)
+	if img, err = configFile(img, getManifest(t, img), cf); err != nil {
+		t.Fatalf("configFile: %v", err)
+	}
+
+	diffID, err := debug.DiffID()
+	if err != nil {
+		t.Fatalf("DiffID: %v", err)
+	}
+	digest, err := debug.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if diffID == digest {
+		t.Fatal("test layer must be compressed")
+	}
+
+	result, err := RemoveLayer(img, diffID)
+	if err != nil {
+		t.Fatalf("RemoveLayer: %v", err)
+	}
+	rcf, m := getConfigFile(t, result), getManifest(t, result)
+	if got, want := len(rcf.RootFS.DiffIDs), 3; got != want {
+		t.Fatalf("result has %d diff ids, want %d", got, want)
+	}
+	if got, want := len(m.Layers), 3; got != want {
+		t.Fatalf("result has %d manifest layers, want %d", got, want)
+	}
+	for i, l := range m.Layers {
+		if l.Digest == digest || rcf.RootFS.DiffIDs[i] == diffID {
+			t.Errorf("layer %d is still the removed layer", i)
+		}
+	}
+	var createdBy []string
+	for _, h := range rcf.History {
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	want := []string{cf.History[0].CreatedBy, cf.History[1].CreatedBy, "ENV", "top"}
+	if diff := cmp.Diff(createdBy, want); diff != "" {
+		t.Errorf("history (-got, +want) %s", diff)
+	}
+	layers, err := result.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	if got, err := layers[2].Digest(); err != nil || got != m.Layers[2].Digest {
+		t.Errorf("top layer digest = %v, %v; want %v", got, err, m.Layers[2].Digest)
+	}
+	configName, err := result.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	if m.Config.Digest != configName {
+		t.Errorf("manifest config digest = %v, want %v", m.Config.Digest, configName)
+	}
+
+	if _, err := RemoveLayer(result, diffID); err == nil {
+		t.Error("RemoveLayer of a missing layer: got nil error")
+	}
+}
+
+func TestReplaceLayers(t *testing.T) {
+	base, err := random.Image(100, 3)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	cfg := getConfigFile(t, base).Config.DeepCopy()
+	cfg.Env = []string{"A=b"}
+	if base, err = Config(base, *cfg); err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	a := tarLayer(t, regularFile("a", "a"))
+	b := tarLayer(t, regularFile("b", "b"))
+	result, err := ReplaceLayers(base, a, b)
+	if err != nil {
+		t.Fatalf("ReplaceLayers: %v", err)
+	}
+	var want []v1.Hash
+	for _, l := range []v1.Layer{a, b} {
+		diffID, err := l.DiffID()
+		if err != nil {
+			t.Fatalf("DiffID: %v", err)
+		}
+		want = append(want, diffID)
+	}
+	if err := AssertLayerOrder(result, want); err != nil {
+		t.Error(err)
+	}
+	cf := getConfigFile(t, result)
+	if got, want := len(cf.History), 2; got != want {
+		t.Errorf("len(History) = %d, want %d", got, want)
+	}
+	if diff := cmp.Diff(cf.Config.Env, []string{"A=b"}); diff != "" {
+		t.Errorf("Env (-got, +want) %s", diff)
+	}
+	if got, want := len(getManifest(t, result).Layers), 2; got != want {
+		t.Errorf("len(manifest layers) = %d, want %d", got, want)
+	}
+	if got, want := len(getManifest(t, base).Layers), 3; got != want {
+		t.Errorf("base was modified: %d layers, want %d", got, want)
+	}
+
+	if _, err := ReplaceLayers(base, a, nil); err == nil {
+		t.Error("ReplaceLayers with a nil layer: expected an error")
+	}
+	none, err := ReplaceLayers(base)
+	if err != nil {
+		t.Fatalf("ReplaceLayers(): %v", err)
+	}
+	if got := getManifest(t, none).Layers; len(got) != 0 {
+		t.Errorf("ReplaceLayers() layers = %v, want none", got)
+	}
+}
+
+func TestLayerDigests(t *testing.T) {
+	img, err := random.Image(100, 5)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	got, err := LayerDigests(img)
+	if err != nil {
+		t.Fatalf("LayerDigests: %v", err)
+	}
+
+	m := getManifest(t, img)
+	var want []v1.Hash
+	for _, l := range m.Layers {
+		want = append(want, l.Digest)
+	}
+	want = append(want, m.Config.Digest)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("LayerDigests (-got, +want) %s", diff)
+	}
+
+	blobs, err := img.BlobSet()
+	if err != nil {
+		t.Fatalf("BlobSet: %v", err)
+	}
+	if got, want := len(got), len(blobs); got != want {
+		t.Errorf("LayerDigests returned %d digests, BlobSet has %d", got, want)
+	}
+	for _, h := range got {
+		if _, ok := blobs[h]; !ok {
+			t.Errorf("LayerDigests returned %v, which isn't in BlobSet", h)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"reflect"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// ArtifactType sets the artifactType of base's manifest, which OCI 1.1 uses
+// to let tools filter artifacts by type, e.g. through the referrers API. An
+// empty at removes it.
+func ArtifactType(base v1.Image, at string) (v1.Image, error) {
+	return mutateManifest(base, func(m *v1.Manifest) {
+		m.ArtifactType = at
+	})
+}
+
+// Subject sets the subject of base's manifest, which makes base a referrer of
+// the subject through the OCI referrers API, e.g. to attach an SBOM or a
+// signature to an image. Only OCI manifests have a subject, so a Docker
+// manifest is converted to OCI first, as by MediaType. A subject without a
+// digest, such as the zero Descriptor, removes it instead.
+func Subject(base v1.Image, subject v1.Descriptor) (v1.Image, error) {
+	if subject.Digest == (v1.Hash{}) {
+		return mutateManifest(base, func(m *v1.Manifest) {
+			m.Subject = nil
+		})
+	}
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := manifestMediaType(base, m)
+	if err != nil {
+		return nil, err
+	}
+	if mt == types.DockerManifestSchema2 {
+		if base, err = MediaType(base, types.OCIManifestSchema1); err != nil {
+			return nil, err
+		}
+	}
+	return mutateManifest(base, func(m *v1.Manifest) {
+		m.Subject = subject.DeepCopy()
+	})
+}
+
+// mutateManifest returns an image like base, but whose manifest has been
+// changed by fn. fn is given a copy of base's manifest, so it may change it
+// freely, but it must not change the config or layer descriptors. If fn
+// doesn't change anything, base itself is returned.
+func mutateManifest(base v1.Image, fn func(*v1.Manifest)) (v1.Image, error) {
+	orig, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m := orig.DeepCopy()
+	fn(m)
+	if reflect.DeepEqual(m, orig) {
+		return base, nil
+	}
+	return &image{
+		Image:      base,
+		manifest:   m,
+		configFile: cf.DeepCopy(),
+		diffIDMap:  make(map[v1.Hash]v1.Layer),
+		digestMap:  make(map[v1.Hash]v1.Layer),
+	}, nil
+}
+
+// Annotations merges anns into the annotations of base's manifest, e.g. to
+// record where an image comes from with org.opencontainers.image.source.
+// Annotations whose value is empty are removed instead.
+func Annotations(base v1.Image, anns map[string]string) (v1.Image, error) {
+	return mutateManifest(base, func(m *v1.Manifest) {
+		if m.Annotations == nil {
+			m.Annotations = make(map[string]string, len(anns))
+		}
+		for k, v := range anns {
+			if v == "" {
+				delete(m.Annotations, k)
+			} else {
+				m.Annotations[k] = v
+			}
+		}
+		if len(m.Annotations) == 0 {
+			m.Annotations = nil
+		}
+	})
+}
+
+// ReadOnlyRootFSAnnotation is the manifest annotation set by ReadOnlyRootFS.
+const ReadOnlyRootFSAnnotation = "io.containerregistry.readonly-rootfs"
+
+// ReadOnlyRootFS sets, or removes if !enabled, the ReadOnlyRootFSAnnotation
+// on base's manifest, a hint for platforms that honor it to run the container
+// with a read-only root filesystem.
+func ReadOnlyRootFS(base v1.Image, enabled bool) (v1.Image, error) {
+	return ReadOnlyRootFSWithKey(base, ReadOnlyRootFSAnnotation, enabled)
+}
+
+// ReadOnlyRootFSWithKey is like ReadOnlyRootFS, but uses the annotation key,
+// for platforms that expect the hint under a key of their own.
+func ReadOnlyRootFSWithKey(base v1.Image, key string, enabled bool) (v1.Image, error) {
+	value := ""
+	if enabled {
+		value = "true"
+	}
+	return Annotations(base, map[string]string{key: value})
+}
@@ -0,0 +1,235 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+func TestArtifactType(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	const at = "application/vnd.example.sbom+json"
+
+	img, err := ArtifactType(base, at)
+	if err != nil {
+		t.Fatalf("ArtifactType: %v", err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	if want := []byte(`"artifactType":"` + at + `"`); !bytes.Contains(raw, want) {
+		t.Errorf("RawManifest() = %s, want it to contain %s", raw, want)
+	}
+	parsed, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+	if parsed.ArtifactType != at {
+		t.Errorf("ArtifactType = %q, want %q", parsed.ArtifactType, at)
+	}
+
+	baseDigest, err := base.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if digest == baseDigest {
+		t.Error("ArtifactType didn't change the digest")
+	}
+	if m := getManifest(t, base); m.ArtifactType != "" {
+		t.Errorf("base ArtifactType = %q, want it unchanged", m.ArtifactType)
+	}
+
+	img, err = ArtifactType(img, "")
+	if err != nil {
+		t.Fatalf("ArtifactType: %v", err)
+	}
+	if raw, err := img.RawManifest(); err != nil || bytes.Contains(raw, []byte("artifactType")) {
+		t.Errorf("RawManifest() = %s, %v; want no artifactType", raw, err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	img, err := Annotations(base, map[string]string{
+		"org.opencontainers.image.source": "https://example.com/repo",
+		"a":                               "1",
+	})
+	if err != nil {
+		t.Fatalf("Annotations: %v", err)
+	}
+	img, err = Annotations(img, map[string]string{"a": "", "b": "2", "missing": ""})
+	if err != nil {
+		t.Fatalf("Annotations: %v", err)
+	}
+	want := map[string]string{
+		"org.opencontainers.image.source": "https://example.com/repo",
+		"b":                               "2",
+	}
+	if diff := cmp.Diff(getManifest(t, img).Annotations, want); diff != "" {
+		t.Errorf("Annotations (-got, +want) %s", diff)
+	}
+	if got := getManifest(t, base).Annotations; got != nil {
+		t.Errorf("base annotations = %v, want them unchanged", got)
+	}
+
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	parsed, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+	if diff := cmp.Diff(parsed.Annotations, want); diff != "" {
+		t.Errorf("RawManifest annotations (-got, +want) %s", diff)
+	}
+
+	img, err = Annotations(img, map[string]string{"org.opencontainers.image.source": "", "b": ""})
+	if err != nil {
+		t.Fatalf("Annotations: %v", err)
+	}
+	if raw, err := img.RawManifest(); err != nil || bytes.Contains(raw, []byte("annotations")) {
+		t.Errorf("RawManifest() = %s, %v; want no annotations", raw, err)
+	}
+}
+
+func TestReadOnlyRootFS(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	base, err = Annotations(base, map[string]string{"other": "kept"})
+	if err != nil {
+		t.Fatalf("Annotations: %v", err)
+	}
+
+	img, err := ReadOnlyRootFS(base, true)
+	if err != nil {
+		t.Fatalf("ReadOnlyRootFS: %v", err)
+	}
+	want := map[string]string{"other": "kept", ReadOnlyRootFSAnnotation: "true"}
+	if diff := cmp.Diff(getManifest(t, img).Annotations, want); diff != "" {
+		t.Errorf("enabled annotations (-got, +want) %s", diff)
+	}
+	if _, ok := getManifest(t, base).Annotations[ReadOnlyRootFSAnnotation]; ok {
+		t.Error("ReadOnlyRootFS changed the base manifest")
+	}
+
+	img, err = ReadOnlyRootFS(img, false)
+	if err != nil {
+		t.Fatalf("ReadOnlyRootFS: %v", err)
+	}
+	want = map[string]string{"other": "kept"}
+	if diff := cmp.Diff(getManifest(t, img).Annotations, want); diff != "" {
+		t.Errorf("disabled annotations (-got, +want) %s", diff)
+	}
+
+	img, err = ReadOnlyRootFSWithKey(img, "com.example.readonly", true)
+	if err != nil {
+		t.Fatalf("ReadOnlyRootFSWithKey: %v", err)
+	}
+	if got := getManifest(t, img).Annotations["com.example.readonly"]; got != "true" {
+		t.Errorf("custom key annotation = %q, want %q", got, "true")
+	}
+}
+
+func TestSubject(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	target, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	targetDigest, err := target.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	targetManifest, err := target.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	subject := v1.Descriptor{
+		MediaType: types.DockerManifestSchema2,
+		Size:      int64(len(targetManifest)),
+		Digest:    targetDigest,
+	}
+
+	img, err := Subject(base, subject)
+	if err != nil {
+		t.Fatalf("Subject: %v", err)
+	}
+	m := getManifest(t, img)
+	if diff := cmp.Diff(m.Subject, &subject); diff != "" {
+		t.Errorf("Subject (-got, +want) %s", diff)
+	}
+	if got, want := m.MediaType, types.OCIManifestSchema1; got != want {
+		t.Errorf("MediaType = %q, want %q", got, want)
+	}
+	if got, want := m.Config.MediaType, types.OCIConfigJSON; got != want {
+		t.Errorf("Config.MediaType = %q, want %q", got, want)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	if want := []byte(`"subject":{`); !bytes.Contains(raw, want) {
+		t.Errorf("RawManifest() = %s, want it to contain %s", raw, want)
+	}
+	baseDigest, err := base.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if digest == baseDigest {
+		t.Error("Subject didn't change the digest")
+	}
+	if m := getManifest(t, base); m.Subject != nil || m.MediaType != types.DockerManifestSchema2 {
+		t.Errorf("base manifest changed: subject %v, media type %q", m.Subject, m.MediaType)
+	}
+
+	cleared, err := Subject(img, v1.Descriptor{})
+	if err != nil {
+		t.Fatalf("Subject: %v", err)
+	}
+	if m := getManifest(t, cleared); m.Subject != nil {
+		t.Errorf("Subject = %v, want it cleared", m.Subject)
+	}
+	if raw, err := cleared.RawManifest(); err != nil || bytes.Contains(raw, []byte("subject")) {
+		t.Errorf("RawManifest() = %s, %v; want no subject", raw, err)
+	}
+}
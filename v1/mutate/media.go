@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// ociLayerTypes maps Docker layer media types to their OCI equivalents.
+var ociLayerTypes = map[types.MediaType]types.MediaType{
+	types.DockerLayer:             types.OCILayer,
+	types.DockerUncompressedLayer: types.OCIUncompressedLayer,
+	types.DockerForeignLayer:      types.OCIRestrictedLayer,
+}
+
+// dockerLayerTypes maps OCI layer media types to their Docker equivalents.
+var dockerLayerTypes = map[types.MediaType]types.MediaType{
+	types.OCILayer:                       types.DockerLayer,
+	types.OCIUncompressedLayer:           types.DockerUncompressedLayer,
+	types.OCIRestrictedLayer:             types.DockerForeignLayer,
+	types.OCIUncompressedRestrictedLayer: types.DockerForeignLayer,
+}
+
+// MediaType converts img's manifest to the manifest media type mt, which
+// must be types.OCIManifestSchema1 or types.DockerManifestSchema2, e.g. to
+// publish the same image both ways. The media types of the config and layers
+// are converted to their equivalents too. The layers themselves are left
+// alone, so they keep their digests; the digest of the image changes.
+func MediaType(img v1.Image, mt types.MediaType) (v1.Image, error) {
+	var (
+		configType types.MediaType
+		layerTypes map[types.MediaType]types.MediaType
+	)
+	switch mt {
+	case types.OCIManifestSchema1:
+		configType, layerTypes = types.OCIConfigJSON, ociLayerTypes
+	case types.DockerManifestSchema2:
+		configType, layerTypes = types.DockerConfigJSON, dockerLayerTypes
+	default:
+		return nil, fmt.Errorf("unsupported manifest media type %q", mt)
+	}
+	return mutateManifest(img, func(m *v1.Manifest) {
+		m.MediaType = mt
+		m.Config.MediaType = configType
+		for i, l := range m.Layers {
+			if converted, ok := layerTypes[l.MediaType]; ok {
+				m.Layers[i].MediaType = converted
+			}
+		}
+	})
+}
+
+// manifestMediaType returns the media type of img's manifest m, falling back
+// to img's MediaType when the manifest doesn't declare one.
+func manifestMediaType(img v1.Image, m *v1.Manifest) (types.MediaType, error) {
+	if m.MediaType != "" {
+		return m.MediaType, nil
+	}
+	return img.MediaType()
+}
+
+// validateLayerMediaType checks that the i-th appended layer, of media type
+// mt, may be referenced by base's manifest m.
+func validateLayerMediaType(base v1.Image, m *v1.Manifest, i int, mt types.MediaType) error {
+	manifestType, err := manifestMediaType(base, m)
+	if err != nil {
+		return err
+	}
+	var suggestion types.MediaType
+	switch manifestType {
+	case types.OCIManifestSchema1:
+		suggestion = ociLayerTypes[mt]
+	case types.DockerManifestSchema2:
+		suggestion = dockerLayerTypes[mt]
+	}
+	if suggestion != "" {
+		return fmt.Errorf("layer %d has media type %q, which is incompatible with a %q manifest; use %q instead", i, mt, manifestType, suggestion)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// mediaTypeImage overrides the media type of the wrapped image's manifest.
+type mediaTypeImage struct {
+	v1.Image
+	mt types.MediaType
+}
+
+func (i *mediaTypeImage) MediaType() (types.MediaType, error) {
+	return i.mt, nil
+}
+
+func (i *mediaTypeImage) Manifest() (*v1.Manifest, error) {
+	m, err := i.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.MediaType = i.mt
+	return m, nil
+}
+
+func ociImage(t *testing.T) v1.Image {
+	t.Helper()
+
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	return &mediaTypeImage{Image: img, mt: types.OCIManifestSchema1}
+}
+
+func TestAppendValidateMediaTypes(t *testing.T) {
+	base := ociImage(t)
+	layer := tarLayer(t, regularFile("a", "a"))
+	opts := &AppendOptions{ValidateMediaTypes: true}
+
+	// Appended layers are Docker layers, which an OCI manifest shouldn't
+	// reference.
+	_, err := AppendWithOptions(base, opts, Addendum{Layer: layer})
+	if err == nil {
+		t.Fatal("AppendWithOptions: expected an error appending a Docker layer to an OCI image")
+	}
+	for _, want := range []string{"layer 0", string(types.DockerLayer), string(types.OCILayer)} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("AppendWithOptions: error %q should mention %q", err, want)
+		}
+	}
+
+	// Validation is opt-in.
+	if _, err := Append(base, Addendum{Layer: layer}); err != nil {
+		t.Errorf("Append: %v", err)
+	}
+
+	// OCI layers are fine.
+	ociLayer := ReferenceLayer(v1.Descriptor{MediaType: types.OCILayer, Size: 1}, v1.Hash{})
+	if _, err := AppendWithOptions(base, opts, Addendum{Layer: ociLayer}); err != nil {
+		t.Errorf("AppendWithOptions: %v", err)
+	}
+}
+
+func TestMediaType(t *testing.T) {
+	img, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	foreign := ReferenceLayer(v1.Descriptor{MediaType: types.DockerForeignLayer, Size: 1, URLs: []string{"https://example.com/layer"}}, v1.Hash{})
+	base, err := Append(img, Addendum{Layer: foreign})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if base, err = MediaType(base, types.DockerManifestSchema2); err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+
+	oci, err := MediaType(base, types.OCIManifestSchema1)
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	if mt, err := oci.MediaType(); err != nil || mt != types.OCIManifestSchema1 {
+		t.Errorf("MediaType() = %v, %v; want %v", mt, err, types.OCIManifestSchema1)
+	}
+	m := getManifest(t, oci)
+	if m.MediaType != types.OCIManifestSchema1 || m.Config.MediaType != types.OCIConfigJSON {
+		t.Errorf("manifest media types = %v, %v; want OCI", m.MediaType, m.Config.MediaType)
+	}
+	want := []types.MediaType{types.OCILayer, types.OCILayer, types.OCIRestrictedLayer}
+	for i, l := range m.Layers {
+		if l.MediaType != want[i] {
+			t.Errorf("layer %d media type = %v, want %v", i, l.MediaType, want[i])
+		}
+		if l.Digest != getManifest(t, base).Layers[i].Digest {
+			t.Errorf("layer %d digest changed", i)
+		}
+	}
+	if got := m.Layers[2].URLs; len(got) != 1 {
+		t.Errorf("foreign layer urls = %v, want them kept", got)
+	}
+	if d1, d2 := digestOf(t, oci), digestOf(t, base); d1 == d2 {
+		t.Error("MediaType didn't change the image digest")
+	}
+
+	// Converting back is lossless.
+	docker, err := MediaType(oci, types.DockerManifestSchema2)
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	if d1, d2 := digestOf(t, docker), digestOf(t, base); d1 != d2 {
+		t.Errorf("round trip digest = %v, want %v", d1, d2)
+	}
+
+	for _, mt := range []types.MediaType{types.OCIImageIndex, types.DockerManifestSchema1, "text/plain"} {
+		if _, err := MediaType(base, mt); err == nil {
+			t.Errorf("MediaType(%q) = nil error, want error", mt)
+		}
+	}
+}
+
+func digestOf(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	return d
+}
+
+// mediaTypeLayer is a layer that knows its media type.
+type mediaTypeLayer struct {
+	v1.Layer
+	mt types.MediaType
+}
+
+func (l mediaTypeLayer) MediaType() (types.MediaType, error) {
+	return l.mt, nil
+}
+
+func TestAppendLayerMediaType(t *testing.T) {
+	docker, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	oci := ociImage(t)
+	layer := tarLayer(t, regularFile("a", "a"))
+	const zstd = types.MediaType("application/vnd.oci.image.layer.v1.tar+zstd")
+
+	for _, tc := range []struct {
+		name string
+		base v1.Image
+		add  Addendum
+		want types.MediaType
+	}{{
+		name: "default",
+		base: docker,
+		add:  Addendum{Layer: layer},
+		want: types.DockerLayer,
+	}, {
+		name: "explicit",
+		base: docker,
+		add:  Addendum{Layer: layer, MediaType: types.OCIUncompressedLayer},
+		want: types.OCIUncompressedLayer,
+	}, {
+		name: "layer's own",
+		base: oci,
+		add:  Addendum{Layer: mediaTypeLayer{layer, zstd}},
+		want: zstd,
+	}, {
+		name: "explicit over layer's own",
+		base: oci,
+		add:  Addendum{Layer: mediaTypeLayer{layer, zstd}, MediaType: types.OCILayer},
+		want: types.OCILayer,
+	}} {
+		img, err := Append(tc.base, tc.add)
+		if err != nil {
+			t.Errorf("%s: Append: %v", tc.name, err)
+			continue
+		}
+		m := getManifest(t, img)
+		if got := m.Layers[len(m.Layers)-1].MediaType; got != tc.want {
+			t.Errorf("%s: media type = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// A layer's own media type must suit the manifest, unless it is
+	// overridden explicitly.
+	for _, tc := range []struct {
+		name string
+		base v1.Image
+		mt   types.MediaType
+		want types.MediaType
+	}{
+		{"OCI layer in a Docker manifest", docker, types.OCILayer, types.DockerLayer},
+		{"Docker layer in an OCI manifest", oci, types.DockerLayer, types.OCILayer},
+		{"foreign layer in an OCI manifest", oci, types.DockerForeignLayer, types.OCIRestrictedLayer},
+	} {
+		_, err = Append(tc.base, Addendum{Layer: mediaTypeLayer{layer, tc.mt}}, Addendum{Layer: mediaTypeLayer{layer, tc.mt}})
+		if err == nil {
+			t.Errorf("%s: Append: expected an error", tc.name)
+			continue
+		}
+		for _, want := range []string{"layer 0", string(tc.mt), string(tc.want), "MediaType"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: Append: error %q should mention %q", tc.name, err, want)
+			}
+		}
+	}
+}
@@ -16,39 +16,240 @@ package mutate
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/go-containerregistry/v1"
 	"github.com/google/go-containerregistry/v1/partial"
 	"github.com/google/go-containerregistry/v1/types"
 )
 
-const whiteoutPrefix = ".wh."
+const (
+	whiteoutPrefix = ".wh."
+
+	// whiteoutMetaPrefix prefixes AUFS metadata entries such as .wh..wh.aufs
+	// and the .wh..wh.plnk/ and .wh..wh.orph/ directories, which are not
+	// part of the image's filesystem.
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+
+	// whiteoutOpaqueDir is the one whiteoutMetaPrefix entry that is not
+	// AUFS metadata: it marks its directory as opaque.
+	whiteoutOpaqueDir = whiteoutMetaPrefix + ".opq"
+)
 
 // Addendum contains layers and history to be appended
 // to a base image
 type Addendum struct {
-	Layer   v1.Layer
+	Layer v1.Layer
+
+	// History is the layer's history entry, e.g. with the Author and
+	// Comment of the build step that created it. An empty History records
+	// when the layer was created. Its EmptyLayer flag is ignored, since the
+	// entry has a layer; use AddHistory for steps that add no layer.
 	History v1.History
+
+	// Annotations are added to the layer's descriptor in the manifest.
+	Annotations map[string]string
+
+	// ExpectedDiffID, if non-nil, makes Append fail unless the layer's
+	// diff id matches it, e.g. to pin layers in reproducible tests.
+	ExpectedDiffID *v1.Hash
+
+	// MediaType, if set, is the media type of the layer's descriptor, e.g.
+	// types.OCIUncompressedLayer. It defaults to the layer's own media
+	// type, if it has one, and to types.DockerLayer otherwise. Append fails
+	// if the layer's own media type doesn't suit the base's manifest, e.g.
+	// an OCI layer in a Docker manifest, unless MediaType is set.
+	MediaType types.MediaType
 }
 
-// AppendLayers applies layers to a base image
+// withMediaType is implemented by layers that know their media type.
+type withMediaType interface {
+	MediaType() (types.MediaType, error)
+}
+
+// AppendLayersCreatedBy is the CreatedBy of the history entries that
+// AppendLayers records, so that tools like "docker history" don't show blank
+// rows for its layers.
+const AppendLayersCreatedBy = "mutate.AppendLayers"
+
+// AppendLayers applies layers to a base image. Each layer gets a history
+// entry created by AppendLayersCreatedBy, at the time the layer was created,
+// if it knows, or the current time otherwise.
 func AppendLayers(base v1.Image, layers ...v1.Layer) (v1.Image, error) {
 	additions := make([]Addendum, 0, len(layers))
 	for _, layer := range layers {
-		additions = append(additions, Addendum{Layer: layer})
+		created, err := layerCreated(layer)
+		if err != nil {
+			return nil, err
+		}
+		additions = append(additions, Addendum{
+			Layer: layer,
+			History: v1.History{
+				CreatedBy: AppendLayersCreatedBy,
+				Created:   created,
+			},
+		})
 	}
 
 	return Append(base, additions...)
 }
 
-// Append will apply the list of addendums to the base image
+// withCreated is implemented by layers that know when they were created.
+type withCreated interface {
+	Created() (v1.Time, error)
+}
+
+// layerCreated returns when layer was created, if it knows, or now.
+func layerCreated(layer v1.Layer) (v1.Time, error) {
+	if wc, ok := layer.(withCreated); ok {
+		created, err := wc.Created()
+		if err != nil {
+			return v1.Time{}, err
+		}
+		if !created.IsZero() {
+			return created, nil
+		}
+	}
+	return v1.Time{Time: time.Now()}, nil
+}
+
+// Append will apply the list of addendums to the base image. Addenda with an
+// empty History get one recording when their layer was created, if the layer
+// knows, or the current time otherwise.
 func Append(base v1.Image, adds ...Addendum) (v1.Image, error) {
+	return AppendWithOptions(base, nil, adds...)
+}
+
+// AppendAtTime is like Append, but records t as the creation time of every
+// added layer whose History doesn't have one, so that layers added in the
+// same build step share a timestamp.
+func AppendAtTime(base v1.Image, t time.Time, adds ...Addendum) (v1.Image, error) {
+	stamped := make([]Addendum, 0, len(adds))
+	for _, add := range adds {
+		if add.History.Created.IsZero() {
+			add.History.Created = v1.Time{Time: t}
+		}
+		stamped = append(stamped, add)
+	}
+	return Append(base, stamped...)
+}
+
+// AddHistory appends h to the history of base as an empty layer entry,
+// without adding a layer, e.g. to record an ENV or LABEL build step. Its
+// Created time defaults to the current time.
+//
+// If base has layers but no history, each layer first gets a blank entry, so
+// that the entries with a layer still line up with the layers.
+func AddHistory(base v1.Image, h v1.History) (v1.Image, error) {
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	history, err := emptyLayerHistory(cf)
+	if err != nil {
+		return nil, err
+	}
+
+	h.EmptyLayer = true
+	if h.Created.IsZero() {
+		h.Created = v1.Time{Time: time.Now()}
+	}
+	return mutateConfigFile(base, func(cf *v1.ConfigFile) {
+		cf.History = append(history, h)
+	})
+}
+
+// emptyLayerHistory returns a copy of the history of cf to which entries for
+// empty layers can be appended. If cf has layers but no history, each layer
+// gets a blank entry, so that the entries with a layer still line up with the
+// layers.
+func emptyLayerHistory(cf *v1.ConfigFile) ([]v1.History, error) {
+	diffIDs := len(cf.RootFS.DiffIDs)
+	if len(cf.History) == 0 {
+		return make([]v1.History, diffIDs), nil
+	}
+	if layers := nonEmptyLayers(cf.History); layers != diffIDs {
+		return nil, fmt.Errorf("history has %d entries with a layer, but the image has %d layers", layers, diffIDs)
+	}
+	return append([]v1.History(nil), cf.History...), nil
+}
+
+// AppendOptions are used to expose optional information to guide or
+// control how Append builds the resulting image.
+type AppendOptions struct {
+	// ValidateMediaTypes makes Append fail if an appended layer's media type
+	// doesn't match the kind of manifest (OCI or Docker) of the base image,
+	// which strict registries reject. Layers that declare their own media
+	// type are always checked; this checks the rest, which default to
+	// types.DockerLayer, and those given an Addendum MediaType too.
+	ValidateMediaTypes bool
+
+	// CreatedAnnotation, if set, is the key of an annotation that Append
+	// adds to the descriptor of each new layer, recording when it was
+	// appended, e.g. AnnotationCreated. Layers of the base image are left
+	// alone.
+	CreatedAnnotation string
+
+	// CreatedValue is the value of the CreatedAnnotation. It defaults to
+	// the time of the call to Append, in RFC 3339 format.
+	CreatedValue string
+
+	// OnLayer, if set, is called with the descriptor of each new layer, in
+	// order, once Append has computed it, e.g. to log or collect metrics on
+	// what is being added. It receives a copy, so changing it has no effect
+	// on the image.
+	OnLayer func(v1.Descriptor)
+
+	// OnWhiteoutOnly, if set, is called with the index and descriptor of
+	// each new layer that only deletes files, i.e. that has whiteouts but
+	// no files, directories aside. This is legitimate but often a sign of
+	// an unintended deletion. It requires reading each new layer.
+	OnWhiteoutOnly func(int, v1.Descriptor)
+
+	// SkipDuplicateLayers makes Append skip the layers whose diff id the
+	// image already has, from the base or from earlier adds, rather than
+	// referencing the same layer twice. The history of a skipped layer, if
+	// any, is still appended, as an empty layer.
+	SkipDuplicateLayers bool
+}
+
+// AppendDedup is like Append, but skips the layers that base, or an earlier
+// add, already has. See AppendOptions.SkipDuplicateLayers.
+func AppendDedup(base v1.Image, adds ...Addendum) (v1.Image, error) {
+	return AppendWithOptions(base, &AppendOptions{SkipDuplicateLayers: true}, adds...)
+}
+
+// AnnotationCreated is the OCI annotation for the date and time on which
+// something was created.
+const AnnotationCreated = "org.opencontainers.image.created"
+
+// AppendWithOptions is like Append, but allows the caller to control how
+// the resulting image is built. A nil opts behaves like Append.
+//
+// If some of the layers don't know their digests until they have been read,
+// such as a StreamLayer, the resulting image lists its layers right away, but
+// the rest of its methods return ErrNotComputed until those layers have been
+// read, e.g. while writing them out. Media types and options are still
+// checked right away.
+func AppendWithOptions(base v1.Image, opts *AppendOptions, adds ...Addendum) (v1.Image, error) {
+	if opts == nil {
+		opts = &AppendOptions{}
+	}
 	if len(adds) == 0 {
 		return base, nil
 	}
@@ -62,6 +263,16 @@ func Append(base v1.Image, adds ...Addendum) (v1.Image, error) {
 		return nil, err
 	}
 
+	if hasUncomputedLayer(adds) {
+		// The manifest and config can only be computed once the
+		// layers have been read, so check what can be checked now
+		// rather than when the image is written out.
+		if err := validateUncomputed(base, m, opts, adds); err != nil {
+			return nil, err
+		}
+		return &streamingImage{base: base, opts: opts, adds: adds}, nil
+	}
+
 	cf, err := base.ConfigFile()
 	if err != nil {
 		return nil, err
@@ -77,22 +288,63 @@ func Append(base v1.Image, adds ...Addendum) (v1.Image, error) {
 
 	diffIDs := image.configFile.RootFS.DiffIDs
 	history := image.configFile.History
+	manifestLayers := image.manifest.Layers
 
-	for _, add := range adds {
+	created := opts.CreatedValue
+	if created == "" {
+		created = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	var present map[v1.Hash]bool
+	if opts.SkipDuplicateLayers {
+		present = make(map[v1.Hash]bool, len(diffIDs))
+		for _, h := range diffIDs {
+			present[h] = true
+		}
+	}
+
+	// The diff ids and history in the config must stay in sync with the
+	// layers in the manifest, so they are all appended in a single pass.
+	for i, add := range adds {
 		diffID, err := add.Layer.DiffID()
 		if err != nil {
 			return nil, err
 		}
-		diffIDs = append(diffIDs, diffID)
-		history = append(history, add.History)
-		image.diffIDMap[diffID] = add.Layer
-	}
+		if add.ExpectedDiffID != nil && *add.ExpectedDiffID != diffID {
+			return nil, fmt.Errorf("layer %d has diff id %v, expected %v", i, diffID, *add.ExpectedDiffID)
+		}
+		if present[diffID] {
+			if add.History != (v1.History{}) {
+				h := add.History
+				h.EmptyLayer = true
+				history = append(history, h)
+			}
+			continue
+		}
+		if present != nil {
+			present[diffID] = true
+		}
+		h := add.History
+		h.EmptyLayer = false
+		if h == (v1.History{}) {
+			if h.Created, err = layerCreated(add.Layer); err != nil {
+				return nil, err
+			}
+		}
 
-	manifestLayers := image.manifest.Layers
+		d := v1.Descriptor{}
 
-	for _, add := range adds {
-		d := v1.Descriptor{
-			MediaType: types.DockerLayer,
+		// Layers that know their own descriptor (e.g. reference-only
+		// layers) keep their media type, urls and annotations.
+		if dl, ok := add.Layer.(describable); ok {
+			desc, err := dl.Descriptor()
+			if err != nil {
+				return nil, err
+			}
+			d = *desc
+		}
+		if d.MediaType, err = layerMediaType(base, m, opts, i, add, d.MediaType); err != nil {
+			return nil, err
 		}
 
 		if d.Size, err = add.Layer.Size(); err != nil {
@@ -103,10 +355,46 @@ func Append(base v1.Image, adds ...Addendum) (v1.Image, error) {
 			return nil, err
 		}
 
+		if len(add.Annotations) > 0 || opts.CreatedAnnotation != "" {
+			annotations := make(map[string]string, len(d.Annotations)+len(add.Annotations)+1)
+			for k, v := range d.Annotations {
+				annotations[k] = v
+			}
+			for k, v := range add.Annotations {
+				annotations[k] = v
+			}
+			if opts.CreatedAnnotation != "" {
+				annotations[opts.CreatedAnnotation] = created
+			}
+			d.Annotations = annotations
+		}
+
+		if opts.OnWhiteoutOnly != nil {
+			only, err := whiteoutOnly(add.Layer)
+			if err != nil {
+				return nil, fmt.Errorf("reading layer %d: %v", i, err)
+			}
+			if only {
+				opts.OnWhiteoutOnly(i, *d.DeepCopy())
+			}
+		}
+
+		if opts.OnLayer != nil {
+			opts.OnLayer(*d.DeepCopy())
+		}
+
+		diffIDs = append(diffIDs, diffID)
+		history = append(history, h)
 		manifestLayers = append(manifestLayers, d)
+		image.diffIDMap[diffID] = add.Layer
 		image.digestMap[d.Digest] = add.Layer
 	}
 
+	if len(manifestLayers) == len(m.Layers) && len(history) == len(cf.History) {
+		// Every layer was a duplicate, with no history to record.
+		return base, nil
+	}
+
 	image.configFile.RootFS.DiffIDs = diffIDs
 	image.configFile.History = history
 	image.manifest.Layers = manifestLayers
@@ -118,7 +406,108 @@ func Append(base v1.Image, adds ...Addendum) (v1.Image, error) {
 	return image, nil
 }
 
-// Config mutates the provided v1.Image to have the provided v1.Config
+// Prepend is like Append, but inserts the adds at the bottom of base's layers,
+// in order, e.g. to add a layer of instrumentation that the application's
+// layers build upon.
+//
+// Since upper layers win over lower ones, files of the adds are masked by
+// base's layers wherever both have the same path, and whiteouts in base's
+// layers now delete files of the adds. Likewise, whiteouts in the adds no
+// longer delete anything from base. The history entries of the adds come
+// first too, so tools that map history to layers stay in sync.
+func Prepend(base v1.Image, adds ...Addendum) (v1.Image, error) {
+	if len(adds) == 0 {
+		return base, nil
+	}
+	img, err := AppendWithOptions(base, nil, adds...)
+	if err != nil {
+		return nil, err
+	}
+	// Append put the adds last, with their history entries.
+	i, ok := img.(*image)
+	if !ok {
+		return nil, errors.New("cannot prepend layers that haven't been read, such as a StreamLayer")
+	}
+	n := len(adds)
+	i.manifest.Layers = rotate(i.manifest.Layers, n)
+	i.configFile.RootFS.DiffIDs = rotateHashes(i.configFile.RootFS.DiffIDs, n)
+	i.configFile.History = rotateHistory(i.configFile.History, n)
+	rcfg, err := i.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	i.manifest.Config.Size = int64(len(rcfg))
+	if i.manifest.Config.Digest, err = i.ConfigName(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// rotate moves the last n descriptors to the front.
+func rotate(ds []v1.Descriptor, n int) []v1.Descriptor {
+	return append(append([]v1.Descriptor(nil), ds[len(ds)-n:]...), ds[:len(ds)-n]...)
+}
+
+// rotateHashes moves the last n hashes to the front.
+func rotateHashes(hs []v1.Hash, n int) []v1.Hash {
+	return append(append([]v1.Hash(nil), hs[len(hs)-n:]...), hs[:len(hs)-n]...)
+}
+
+// rotateHistory moves the last n history entries to the front.
+func rotateHistory(hs []v1.History, n int) []v1.History {
+	return append(append([]v1.History(nil), hs[len(hs)-n:]...), hs[:len(hs)-n]...)
+}
+
+// whiteoutOnly reports whether layer has whiteouts and, apart from
+// directories, nothing else.
+func whiteoutOnly(layer v1.Layer) (bool, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	whiteouts := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return whiteouts, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if isAUFSMetadata(header.Name) || header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if !strings.HasPrefix(path.Base(header.Name), whiteoutPrefix) {
+			return false, nil
+		}
+		whiteouts = true
+	}
+}
+
+// AppendDryRun returns the manifest and config file of the image that Append
+// would produce, e.g. to preview its layer order, sizes and digests before
+// building and pushing it. Like Append, it doesn't read the contents of the
+// layers, but it does ask for their digests, diff ids and sizes.
+func AppendDryRun(base v1.Image, adds ...Addendum) (*v1.Manifest, *v1.ConfigFile, error) {
+	img, err := Append(base, adds...)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.DeepCopy(), cf.DeepCopy(), nil
+}
+
+// Config mutates the provided v1.Image to have the provided v1.Config. If
+// base already has that config, base itself is returned.
 func Config(base v1.Image, cfg v1.Config) (v1.Image, error) {
 	m, err := base.Manifest()
 	if err != nil {
@@ -129,16 +518,57 @@ func Config(base v1.Image, cfg v1.Config) (v1.Image, error) {
 	if err != nil {
 		return nil, err
 	}
+	if reflect.DeepEqual(cf.Config, cfg) {
+		return base, nil
+	}
 
+	cf = cf.DeepCopy()
 	cf.Config = cfg
 
+	return configFile(base, m, cf)
+}
+
+// ConfigFile returns base with the given config file, e.g. to set its
+// Created time or clear fields of its Config that Config would need the rest
+// of the config to be copied for. The RootFS must be that of base, since it
+// describes base's layers. If base already has that config file, base itself
+// is returned.
+func ConfigFile(base v1.Image, cf *v1.ConfigFile) (v1.Image, error) {
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	current, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(cf.RootFS.DiffIDs), len(m.Layers); got != want {
+		return nil, fmt.Errorf("config file has %d diff ids, but the image has %d layers", got, want)
+	}
+	if !reflect.DeepEqual(cf.RootFS, current.RootFS) {
+		return nil, errors.New("config file's rootfs doesn't match the image's")
+	}
+	if reflect.DeepEqual(cf, current) {
+		return base, nil
+	}
+	return configFile(base, m, cf.DeepCopy())
+}
+
+// configFile returns an image with the layers of base and the given config
+// file, updating the manifest's reference to the config to match.
+func configFile(base v1.Image, m *v1.Manifest, cf *v1.ConfigFile) (v1.Image, error) {
 	image := &image{
 		Image:      base,
 		manifest:   m.DeepCopy(),
-		configFile: cf.DeepCopy(),
+		configFile: cf,
 		diffIDMap:  make(map[v1.Hash]v1.Layer),
 		digestMap:  make(map[v1.Hash]v1.Layer),
 	}
+	rcfg, err := image.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	image.manifest.Config.Size = int64(len(rcfg))
 	image.manifest.Config.Digest, err = image.ConfigName()
 	if err != nil {
 		return nil, err
@@ -172,6 +602,11 @@ func (i *image) Layers() ([]v1.Layer, error) {
 	return ls, nil
 }
 
+// MediaType of this image's manifest.
+func (i *image) MediaType() (types.MediaType, error) {
+	return manifestMediaType(i.Image, i.manifest)
+}
+
 // BlobSet returns an unordered collection of all the blobs in the image.
 func (i *image) BlobSet() (map[v1.Hash]struct{}, error) {
 	return partial.BlobSet(i)
@@ -230,6 +665,76 @@ func (i *image) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
 	return i.Image.LayerByDiffID(h)
 }
 
+// layerMediaType returns the media type that add's layer gets in m, given
+// the media type of its own descriptor, if any, and checks that it suits m.
+func layerMediaType(base v1.Image, m *v1.Manifest, opts *AppendOptions, i int, add Addendum, mt types.MediaType) (types.MediaType, error) {
+	if add.MediaType != "" {
+		mt = add.MediaType
+	} else if wm, ok := add.Layer.(withMediaType); ok && mt == "" {
+		var err error
+		if mt, err = wm.MediaType(); err != nil {
+			return "", err
+		}
+	}
+	if _, ok := add.Layer.(*StreamLayer); ok && mt == "" {
+		// A StreamLayer is gzipped tar, of whichever kind suits m.
+		manifestType, err := manifestMediaType(base, m)
+		if err != nil {
+			return "", err
+		}
+		mt = gzipLayerType(manifestType, "")
+	} else if mt == "" {
+		mt = types.DockerLayer
+	} else if add.MediaType == "" {
+		// A layer's own media type must suit the manifest, e.g. a
+		// Docker manifest only gets an OCI layer when asked
+		// explicitly, since registries reject the mix on push.
+		if err := validateLayerMediaType(base, m, i, mt); err != nil {
+			return "", fmt.Errorf("%v, or set the Addendum's MediaType", err)
+		}
+	}
+
+	if opts.ValidateMediaTypes {
+		if err := validateLayerMediaType(base, m, i, mt); err != nil {
+			return "", err
+		}
+	}
+	return mt, nil
+}
+
+// validateUncomputed checks adds, some of which haven't been read yet, as
+// far as it can without reading them. The expected diff ids of the layers
+// that haven't been read are only checked once they have been.
+func validateUncomputed(base v1.Image, m *v1.Manifest, opts *AppendOptions, adds []Addendum) error {
+	if opts.OnWhiteoutOnly != nil {
+		return errors.New("OnWhiteoutOnly can't read layers that haven't been read yet, such as a StreamLayer")
+	}
+	for i, add := range adds {
+		if add.ExpectedDiffID != nil {
+			diffID, err := add.Layer.DiffID()
+			if err != nil && err != ErrNotComputed {
+				return err
+			}
+			if err == nil && *add.ExpectedDiffID != diffID {
+				return fmt.Errorf("layer %d has diff id %v, expected %v", i, diffID, *add.ExpectedDiffID)
+			}
+		}
+
+		var mt types.MediaType
+		if dl, ok := add.Layer.(describable); ok {
+			desc, err := dl.Descriptor()
+			if err != nil {
+				return err
+			}
+			mt = desc.MediaType
+		}
+		if _, err := layerMediaType(base, m, opts, i, add, mt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func validate(adds []Addendum) error {
 	for _, add := range adds {
 		if add.Layer == nil {
@@ -248,104 +753,864 @@ func validate(adds []Addendum) error {
 // If a caller doesn't read the full contents, they should Close it to free up
 // resources used during extraction.
 //
+// Extract, and every variant of it in this package, calls Uncompressed once
+// per layer and reads it in a single forward pass, so it works with layers
+// that can only be streamed once.
+//
 // Adapted from https://github.com/google/containerregistry/blob/master/client/v2_2/docker_image_.py#L731
 func Extract(img v1.Image) io.ReadCloser {
+	return ExtractWithOptions(img, nil)
+}
+
+// ExtractContext is like Extract, but stops extracting with ctx's error once
+// ctx is done, e.g. to stop streaming a filesystem to a client that went away.
+func ExtractContext(ctx context.Context, img v1.Image) io.ReadCloser {
+	return extractPipe(ctx, img, &ExtractOptions{})
+}
+
+// ExtractOptions are used to expose optional information to guide or
+// control the flattening of an image's filesystem.
+type ExtractOptions struct {
+	// ModTime, if non-nil, replaces the modification time of every entry
+	// in the flattened filesystem.
+	ModTime *time.Time
+
+	// DetectSymlinkCycles makes ExtractTo fail, before creating any
+	// symlinks, if a chain of symlinks leads back to where it started.
+	DetectSymlinkCycles bool
+
+	// SkipPseudoFS omits the contents of /dev, /proc and /sys, which are
+	// populated by the container runtime and shouldn't be in an image.
+	// The directories themselves are kept, as mount points.
+	SkipPseudoFS bool
+
+	// PreserveOpaqueMarkers keeps opaque directory markers (.wh..wh..opq)
+	// in the flattened filesystem, while other whiteouts are resolved as
+	// usual, so that an exported delta still instructs consumers to
+	// replace those directories.
+	PreserveOpaqueMarkers bool
+
+	// Heartbeat, if non-nil, is called every HeartbeatInterval during
+	// extraction with the number of bytes written so far, e.g. to keep a
+	// watchdog happy while a single huge file is copied to a slow sink.
+	Heartbeat func(written int64)
+
+	// HeartbeatInterval is how often Heartbeat is called. It defaults to
+	// DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+
+	// LayerTimeout, if positive, bounds how long reading each layer may
+	// take, so that an unresponsive layer (e.g. a stalled remote blob)
+	// aborts extraction instead of blocking it forever. The time spent
+	// waiting for the consumer of the flattened filesystem counts too.
+	LayerTimeout time.Duration
+
+	// DedupFiles makes ExtractTo hardlink regular files with identical
+	// contents, mode and modification time to a single copy, rather than
+	// writing the same bytes several times. If a hardlink can't be
+	// created, e.g. across devices, the file is kept as a copy.
+	DedupFiles bool
+
+	// VerifyDiffIDs makes extraction fail if the uncompressed contents of
+	// a layer don't match its diff id. The contents are hashed as they are
+	// flattened, without reading the layer a second time.
+	VerifyDiffIDs bool
+
+	// Order controls the order of the entries of the flattened filesystem.
+	// It defaults to LayerOrder, the only one ExtractTo supports.
+	Order ExtractOrder
+
+	// MaxPaths, if positive, bounds the number of distinct paths tracked
+	// to resolve whiteouts and overwritten files. Memory use grows with
+	// that number, so pathological images with millions of entries make
+	// extraction fail with an error instead of exhausting memory.
+	MaxPaths int
+
+	// Progress, if non-nil, is called as extraction proceeds with the
+	// estimated fraction of the work done, from 0 to 1. It is called with
+	// exactly 1 once extraction completes.
+	//
+	// Since the uncompressed sizes of layers aren't known without reading
+	// them, each layer is weighted by its compressed size, and progress
+	// within a layer is estimated by comparing the uncompressed bytes read
+	// to its compressed size. This underestimates the size of the layer,
+	// so progress may stall at the end of each layer, but it is exact
+	// between layers.
+	Progress func(fraction float64)
+
+	// StripLeadingDotSlash removes a single leading "./" from the names of
+	// entries, and from the targets of hardlinks, which refer to entries
+	// by name. The "./" entry for the root directory is dropped. Whiteouts
+	// are resolved the same either way.
+	StripLeadingDotSlash bool
+
+	// MaxBytes, if positive, bounds the total size of the file contents
+	// that extraction writes, so that a layer that decompresses to far
+	// more than expected fails instead of filling up memory or disk. An
+	// entry that would go over the limit fails before any of its contents
+	// are copied.
+	MaxBytes int64
+
+	// Filter, if non-nil, is called with each entry of the flattened
+	// filesystem, and the entries it returns false for are omitted. The
+	// omitted entries still hide those of lower layers, and whiteouts
+	// below omitted directories still apply, so the entries that are kept
+	// are the same as without Filter.
+	Filter func(*tar.Header) bool
+}
+
+// DefaultHeartbeatInterval is the default ExtractOptions.HeartbeatInterval.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// ExtractWithOptions is like Extract, but allows the caller to control how
+// the flattened filesystem is produced. A nil opts behaves like Extract.
+func ExtractWithOptions(img v1.Image, opts *ExtractOptions) io.ReadCloser {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	return extractPipe(context.Background(), img, opts)
+}
+
+// ExtractWithLimit is like Extract, but fails once the flattened filesystem
+// has more than maxBytes of file contents. See ExtractOptions.MaxBytes.
+func ExtractWithLimit(img v1.Image, maxBytes int64) io.ReadCloser {
+	return ExtractWithOptions(img, &ExtractOptions{MaxBytes: maxBytes})
+}
+
+func extractPipe(ctx context.Context, img v1.Image, opts *ExtractOptions) io.ReadCloser {
 	pr, pw := io.Pipe()
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
 		// Close the writer with any errors encountered during
 		// extraction. These errors will be returned by the reader end
 		// on subsequent reads. If err == nil, the reader will return
 		// EOF.
-		pw.CloseWithError(extract(img, pw))
+		pw.CloseWithError(extract(ctx, img, pw, opts))
 	}()
+	if ctx.Done() != nil {
+		// Unblock a write that the reader isn't consuming, too.
+		go func() {
+			select {
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+			case <-done:
+			}
+		}()
+	}
 
 	return pr
 }
 
-func extract(img v1.Image, w io.Writer) error {
+func extract(ctx context.Context, img v1.Image, w io.Writer, opts *ExtractOptions) error {
+	if opts.Heartbeat != nil {
+		hw := &heartbeatWriter{w: w}
+		stop := hw.start(opts.Heartbeat, opts.HeartbeatInterval)
+		defer stop()
+		w = hw
+	}
 	tarWriter := tar.NewWriter(w)
 	defer tarWriter.Close()
+	return extractInto(ctx, img, tarWriter, opts)
+}
 
-	fileMap := map[string]bool{}
+// ExtractInto writes the entries of img's flattened filesystem into tw, which
+// lets callers add their own entries before or after them, or control the
+// writer's format and buffering. It doesn't close tw.
+func ExtractInto(img v1.Image, tw *tar.Writer) error {
+	return extractInto(context.Background(), img, tw, &ExtractOptions{})
+}
+
+func extractInto(ctx context.Context, img v1.Image, tarWriter *tar.Writer, opts *ExtractOptions) error {
+	var written int64
+	return flattenImage(ctx, img, opts, func(header *tar.Header, r io.Reader) error {
+		// writeTarEntry copies exactly header.Size bytes, so checking the
+		// size up front catches a huge entry before it is copied.
+		if opts.MaxBytes > 0 && header.Size > opts.MaxBytes-written {
+			return fmt.Errorf("would exceed the limit of %d bytes", opts.MaxBytes)
+		}
+		written += header.Size
+		return writeTarEntry(tarWriter, header, r)
+	})
+}
 
+// ExtractError is the error returned when extracting an image fails while
+// reading one of its layers. It wraps the underlying error, e.g. a network
+// error from a remote layer, or io.ErrUnexpectedEOF from a truncated one.
+type ExtractError struct {
+	// Layer is the index of the layer in the image, from the bottom.
+	Layer int
+
+	// Name is the name of the last tar entry read from the layer, if any,
+	// which is usually the one being processed when the failure occurred.
+	Name string
+
+	Err error
+}
+
+func (e *ExtractError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("layer %d: %v", e.Layer, e.Err)
+	}
+	return fmt.Sprintf("layer %d, entry %q: %v", e.Layer, e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ExtractError) Unwrap() error {
+	return e.Err
+}
+
+// flattenImage calls write for each entry of img's flattened filesystem, with
+// a reader for the entry's contents, in the order set by opts. It stops with
+// ctx's error once ctx is done.
+func flattenImage(ctx context.Context, img v1.Image, opts *ExtractOptions, write func(*tar.Header, io.Reader) error) error {
 	layers, err := img.Layers()
 	if err != nil {
-		return fmt.Errorf("retrieving image layers: %v", err)
+		return fmt.Errorf("retrieving image layers: %w", err)
 	}
+	f := newFlattener(ctx, opts)
+	links := newLinkOrderer(write)
 	// we iterate through the layers in reverse order because it makes handling
 	// whiteout layers more efficient, since we can just keep track of the removed
 	// files as we see .wh. layers and ignore those in previous layers.
+	emit := links.emit
+	f.onHidden = links.materialize
+	var sp *spool
+	if opts.Order == DirectoryOrder || opts.Order == PathOrder {
+		if sp, err = newSpool(); err != nil {
+			return err
+		}
+		defer sp.Close()
+		emit = sp.add
+		f.onHidden = sp.addHidden
+	}
+	var p *progress
+	if opts.Progress != nil {
+		if p, err = newProgress(layers, opts.Progress); err != nil {
+			return err
+		}
+		f.onRead = p.advance
+	}
 	for i := len(layers) - 1; i >= 0; i-- {
-		layer := layers[i]
-		layerReader, err := layer.Uncompressed()
+		if p != nil {
+			p.startLayer(i)
+		}
+		if err := f.flattenLayer(i, layers[i], emit); err != nil {
+			return err
+		}
+	}
+	if sp != nil {
+		if err := sp.replay(opts.Order, links.emit); err != nil {
+			return err
+		}
+		if err := sp.replayHidden(links.materialize); err != nil {
+			return err
+		}
+	}
+	if err := links.flush(); err != nil {
+		return err
+	}
+	if p != nil {
+		p.report(1)
+	}
+	return nil
+}
+
+// progress estimates the fraction of an image's layers that have been read,
+// weighting each layer by its compressed size.
+type progress struct {
+	fn    func(float64)
+	sizes []int64
+	total int64
+
+	// done is the total size of the layers read so far. layer is the index
+	// of the layer being read, and read the uncompressed bytes read from it.
+	done, read int64
+	layer      int
+	last       float64
+}
+
+func newProgress(layers []v1.Layer, fn func(float64)) (*progress, error) {
+	p := &progress{fn: fn, layer: -1}
+	for _, l := range layers {
+		size, err := l.Size()
 		if err != nil {
-			return fmt.Errorf("reading layer contents: %v", err)
+			return nil, err
 		}
-		tarReader := tar.NewReader(layerReader)
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
+		p.sizes = append(p.sizes, size)
+		p.total += size
+	}
+	return p, nil
+}
+
+// startLayer records that the layers read so far are done, and that layer i
+// is being read.
+func (p *progress) startLayer(i int) {
+	if p.layer >= 0 {
+		p.done += p.sizes[p.layer]
+	}
+	p.layer, p.read = i, 0
+	p.update()
+}
+
+// advance records that n more uncompressed bytes of the current layer were
+// read.
+func (p *progress) advance(n int) {
+	p.read += int64(n)
+	p.update()
+}
+
+func (p *progress) update() {
+	if p.total == 0 {
+		return
+	}
+	done := p.done
+	if p.read < p.sizes[p.layer] {
+		done += p.read
+	} else {
+		done += p.sizes[p.layer]
+	}
+	p.report(float64(done) / float64(p.total))
+}
+
+// report calls fn with fraction, if it is more than previously reported.
+func (p *progress) report(fraction float64) {
+	if fraction > p.last {
+		p.last = fraction
+		p.fn(fraction)
+	}
+}
+
+// writeTarEntry writes header to tw, followed by exactly header.Size bytes of
+// contents from r, which must have that many.
+func writeTarEntry(tw *tar.Writer, header *tar.Header, r io.Reader) error {
+	if header.Size < 0 {
+		return fmt.Errorf("entry %q has negative size %d", header.Name, header.Size)
+	}
+	h := *header
+	h.Format = tarFormat(header)
+	if err := tw.WriteHeader(&h); err != nil {
+		return fmt.Errorf("writing header of %q: %w", header.Name, err)
+	}
+	if header.Size == 0 {
+		return nil
+	}
+	if n, err := io.CopyN(tw, r, header.Size); err != nil {
+		return fmt.Errorf("entry %q has %d bytes of contents, but claims %d: %w", header.Name, n, header.Size, err)
+	}
+	return nil
+}
+
+// tarFormat returns the format to write header in. The format of the layer
+// it was read from may not be able to hold all of it, e.g. a GNU header with
+// extended attributes, which would then fail to be written or lose its
+// ownership. So headers with PAX records or fields too long for USTAR are
+// written as PAX, and the others in whatever format fits them.
+func tarFormat(header *tar.Header) tar.Format {
+	if header.Format == tar.FormatPAX || len(header.PAXRecords) > 0 ||
+		len(header.Name) > 100 || len(header.Linkname) > 100 ||
+		len(header.Uname) > 32 || len(header.Gname) > 32 {
+		return tar.FormatPAX
+	}
+	return tar.FormatUnknown
+}
+
+// linkOrderer holds back hardlinks until their target has been emitted, since
+// walking the layers from the top down can otherwise emit a link before its
+// target, which some extractors reject.
+type linkOrderer struct {
+	next    func(*tar.Header, io.Reader) error
+	emitted map[string]bool
+	// pending holds the hardlinks waiting for each target.
+	pending map[string][]*tar.Header
+}
+
+func newLinkOrderer(next func(*tar.Header, io.Reader) error) *linkOrderer {
+	return &linkOrderer{
+		next:    next,
+		emitted: map[string]bool{},
+		pending: map[string][]*tar.Header{},
+	}
+}
+
+// emit passes header on, unless it is a hardlink whose target hasn't been
+// emitted yet.
+func (o *linkOrderer) emit(header *tar.Header, r io.Reader) error {
+	if header.Typeflag == tar.TypeLink {
+		if target := cleanPath(header.Linkname); !o.emitted[target] {
+			o.pending[target] = append(o.pending[target], header)
+			return nil
+		}
+	}
+	if err := o.next(header, r); err != nil {
+		return err
+	}
+	return o.markEmitted(header.Name)
+}
+
+// markEmitted records that name was emitted, and emits the hardlinks that
+// were waiting for it.
+func (o *linkOrderer) markEmitted(name string) error {
+	name = cleanPath(name)
+	o.emitted[name] = true
+	links := o.pending[name]
+	delete(o.pending, name)
+	for _, link := range links {
+		if err := o.next(link, strings.NewReader("")); err != nil {
+			return err
+		}
+		if err := o.markEmitted(link.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materialize emits the hardlinks waiting for header, a regular file that is
+// hidden from the flattened filesystem, as copies of it: the first one becomes
+// a regular file with its contents r, and the others link to that one.
+func (o *linkOrderer) materialize(header *tar.Header, r io.Reader) error {
+	target := cleanPath(header.Name)
+	links := o.pending[target]
+	if len(links) == 0 {
+		return nil
+	}
+	delete(o.pending, target)
+	first := links[0]
+	first.Typeflag = tar.TypeReg
+	first.Linkname = ""
+	first.Size = header.Size
+	first.Mode = header.Mode
+	if err := o.next(first, r); err != nil {
+		return err
+	}
+	if err := o.markEmitted(first.Name); err != nil {
+		return err
+	}
+	for _, link := range links[1:] {
+		link.Linkname = first.Name
+		if err := o.emit(link, strings.NewReader("")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush emits the hardlinks whose target is not in any layer, so that there
+// are no contents to copy. They become empty regular files.
+func (o *linkOrderer) flush() error {
+	for len(o.pending) > 0 {
+		targets := make([]string, 0, len(o.pending))
+		for target := range o.pending {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		links := o.pending[targets[0]]
+		delete(o.pending, targets[0])
+		for _, link := range links {
+			link.Typeflag = tar.TypeReg
+			link.Linkname = ""
+			link.Size = 0
+			if err := o.next(link, strings.NewReader("")); err != nil {
+				return err
 			}
-			if err != nil {
-				return fmt.Errorf("reading tar: %v", err)
+			if err := o.markEmitted(link.Name); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			basename := filepath.Base(header.Name)
-			dirname := filepath.Dir(header.Name)
-			tombstone := strings.HasPrefix(basename, whiteoutPrefix)
-			if tombstone {
-				basename = basename[len(whiteoutPrefix):]
-			}
+// heartbeatWriter counts the bytes written through it, for reporting by a
+// concurrent heartbeat.
+type heartbeatWriter struct {
+	w io.Writer
+	n int64
+}
 
-			// check if we have seen value before
-			// if we're checking a directory, don't filepath.Join names
-			var name string
-			if header.Typeflag == tar.TypeDir {
-				name = header.Name
-			} else {
-				name = filepath.Join(dirname, basename)
-			}
+func (h *heartbeatWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	atomic.AddInt64(&h.n, int64(n))
+	return n, err
+}
 
-			if _, ok := fileMap[name]; ok {
-				continue
+// start calls fn with the number of bytes written every interval, until the
+// returned function is called.
+func (h *heartbeatWriter) start(fn func(int64), interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				fn(atomic.LoadInt64(&h.n))
+			case <-done:
+				return
 			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
 
-			// check for a whited out parent directory
-			if inWhiteoutDir(fileMap, name) {
-				continue
-			}
+// timeoutReader reads a layer in a goroutine of its own, so that reading can
+// be abandoned, and the layer closed, once the layer's timeout has passed or
+// the extraction's context is done.
+type timeoutReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-			// mark file as handled. non-directory implicitly tombstones
-			// any entries with a matching (or child) name
-			fileMap[name] = tombstone || !(header.Typeflag == tar.TypeDir)
-			if !tombstone {
-				tarWriter.WriteHeader(header)
-				if header.Size > 0 {
-					if _, err := io.Copy(tarWriter, tarReader); err != nil {
-						return err
-					}
-				}
+// newTimeoutReader starts reading rc, the contents of layer, which it closes
+// once reading is done or ctx, bounded by timeout, is done.
+func newTimeoutReader(ctx context.Context, rc io.ReadCloser, layer v1.Layer, timeout time.Duration) *timeoutReader {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	pr, pw := io.Pipe()
+	t := &timeoutReader{PipeReader: pr, cancel: cancel, done: make(chan struct{})}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, err := io.Copy(pw, rc)
+		pw.CloseWithError(err)
+	}()
+	go func() {
+		defer close(t.done)
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = layerTimeoutError(layer, timeout)
 			}
+			// Fail the reads of the pipe, and unblock the copy, whether
+			// it is writing to the pipe or reading from the layer.
+			pw.CloseWithError(err)
+		case <-copied:
 		}
-	}
+		rc.Close()
+		<-copied
+	}()
+	return t
+}
+
+// Close stops reading the layer and waits until it is closed.
+func (t *timeoutReader) Close() error {
+	t.cancel()
+	<-t.done
 	return nil
 }
 
-func inWhiteoutDir(fileMap map[string]bool, file string) bool {
+func layerTimeoutError(layer v1.Layer, timeout time.Duration) error {
+	name := "layer"
+	if digest, err := layer.Digest(); err == nil {
+		name = fmt.Sprintf("layer %v", digest)
+	}
+	return fmt.Errorf("%s timed out after %v", name, timeout)
+}
+
+// flattener resolves whiteouts and overwritten files across the layers of an
+// image, which must be passed to flattenLayer from the top layer down.
+type flattener struct {
+	ctx     context.Context
+	opts    *ExtractOptions
+	fileMap map[string]bool
+
+	// opaqueDirs holds the directories marked opaque by the layers
+	// flattened so far, whose contents in lower layers are hidden.
+	opaqueDirs map[string]bool
+
+	// opaque holds the directories marked opaque by the layer being
+	// flattened. They only apply to lower layers, so they are added to
+	// opaqueDirs once the layer is done.
+	opaque []string
+
+	// added journals the fileMap entries added by the layer being
+	// flattened, so that they can be rolled back if it fails.
+	added []string
+
+	// hiddenDirs caches whether each directory looked up by
+	// inWhiteoutDir is hidden, along with all of its parents, so that
+	// deep trees don't walk up to the root for every entry. It is reset
+	// whenever one of its directories gets hidden.
+	hiddenDirs map[string]bool
+
+	// onRead, if non-nil, is called with the number of uncompressed bytes
+	// of each read from a layer.
+	onRead func(n int)
+
+	// linkTargets holds the targets of the hardlinks emitted so far that
+	// haven't been emitted themselves.
+	linkTargets map[string]bool
+
+	// onHidden, if non-nil, is called with the regular files that are
+	// hidden from the flattened filesystem, e.g. by a whiteout, but that
+	// are the target of an emitted hardlink, so that the link can be
+	// given their contents.
+	onHidden func(*tar.Header, io.Reader) error
+
+	// onWhiteout and onShadowed, if non-nil, are called with the name of
+	// each whiteout that takes effect, and of each entry other than a
+	// whiteout that an upper layer hides, respectively.
+	onWhiteout func(name string)
+	onShadowed func(name string)
+
+	// entry is the name of the last entry read from the layer being
+	// flattened.
+	entry string
+}
+
+func newFlattener(ctx context.Context, opts *ExtractOptions) *flattener {
+	return &flattener{
+		ctx:         ctx,
+		opts:        opts,
+		fileMap:     map[string]bool{},
+		opaqueDirs:  map[string]bool{},
+		linkTargets: map[string]bool{},
+		hiddenDirs:  map[string]bool{},
+	}
+}
+
+// flattenLayer calls emit for every entry of layer, the i-th of the image,
+// that survives in the flattened filesystem, with a reader for the entry's
+// contents. Errors other than the context's are returned as *ExtractError.
+func (f *flattener) flattenLayer(i int, layer v1.Layer, emit func(*tar.Header, io.Reader) error) error {
+	f.entry = ""
+	err := f.flattenEntries(layer, emit)
+	if err == nil || err == f.ctx.Err() {
+		return err
+	}
+	return &ExtractError{Layer: i, Name: f.entry, Err: err}
+}
+
+func (f *flattener) flattenEntries(layer v1.Layer, emit func(*tar.Header, io.Reader) error) error {
+	f.added = f.added[:0]
+	f.opaque = f.opaque[:0]
+	layerReader, err := layer.Uncompressed()
+	if err != nil {
+		return fmt.Errorf("reading layer contents: %w", err)
+	}
+	if f.opts.LayerTimeout > 0 {
+		layerReader = newTimeoutReader(f.ctx, layerReader, layer, f.opts.LayerTimeout)
+	}
+	defer layerReader.Close()
+	var r io.Reader = layerReader
+	if f.onRead != nil {
+		r = &notifyingReader{r: r, fn: f.onRead}
+	}
+	var hasher hash.Hash
+	if f.opts.VerifyDiffIDs {
+		hasher = sha256.New()
+		r = io.TeeReader(r, hasher)
+	}
+	tarReader := tar.NewReader(r)
 	for {
-		if file == "" {
-			break
+		if err := f.ctx.Err(); err != nil {
+			return err
 		}
-		dirname := filepath.Dir(file)
-		if file == dirname {
+		header, err := tarReader.Next()
+		if err == io.EOF {
 			break
 		}
-		if val, ok := fileMap[dirname]; ok && val {
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		f.entry = header.Name
+
+		if isAUFSMetadata(header.Name) {
+			continue
+		}
+
+		// check if we have seen value before, under a normalized name so
+		// that e.g. "./data/" and the whiteout of "data" match
+		dirname, basename := path.Split(cleanPath(header.Name))
+		opaque := basename == whiteoutOpaqueDir
+		tombstone := strings.HasPrefix(basename, whiteoutPrefix)
+		if tombstone {
+			basename = basename[len(whiteoutPrefix):]
+		}
+
+		name := dirname + basename
+
+		if _, ok := f.fileMap[name]; ok || f.inWhiteoutDir(name) {
+			// the entry was overwritten, or whited out directly or
+			// through a parent directory
+			if f.onShadowed != nil && !tombstone {
+				f.onShadowed(name)
+			}
+			if f.onHidden != nil && !tombstone && header.Typeflag == tar.TypeReg && f.linkTargets[name] {
+				delete(f.linkTargets, name)
+				if err := f.onHidden(header, tarReader); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if opaque {
+			f.opaque = append(f.opaque, strings.TrimSuffix(dirname, "/"))
+		}
+
+		// mark file as handled. non-directory implicitly tombstones
+		// any entries with a matching (or child) name
+		if f.opts.MaxPaths > 0 && len(f.fileMap) >= f.opts.MaxPaths {
+			return fmt.Errorf("image has more than %d paths", f.opts.MaxPaths)
+		}
+		f.fileMap[name] = tombstone || !(header.Typeflag == tar.TypeDir)
+		f.added = append(f.added, name)
+		if _, ok := f.hiddenDirs[name]; ok && f.fileMap[name] {
+			f.hiddenDirs = map[string]bool{}
+		}
+		if f.onWhiteout != nil && tombstone && !opaque {
+			f.onWhiteout(name)
+		}
+		if f.opts.SkipPseudoFS && inPseudoFS(name) {
+			continue
+		}
+		if !tombstone || (opaque && f.opts.PreserveOpaqueMarkers) {
+			if f.opts.ModTime != nil {
+				header.ModTime = *f.opts.ModTime
+			}
+			if f.opts.StripLeadingDotSlash {
+				header.Name = strings.TrimPrefix(header.Name, "./")
+				if header.Name == "" {
+					continue
+				}
+				if header.Typeflag == tar.TypeLink {
+					header.Linkname = strings.TrimPrefix(header.Linkname, "./")
+				}
+			}
+			if f.opts.Filter != nil && !f.opts.Filter(header) {
+				continue
+			}
+			delete(f.linkTargets, name)
+			if header.Typeflag == tar.TypeLink {
+				f.linkTargets[cleanPath(header.Linkname)] = true
+			}
+			if err := emit(header, tarReader); err != nil {
+				return err
+			}
+		}
+	}
+	if hasher != nil {
+		// Hash whatever follows the end of the archive, too.
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return fmt.Errorf("reading layer contents: %w", err)
+		}
+		if err := verifyDiffID(layer, hasher); err != nil {
+			return err
+		}
+	}
+	for _, dir := range f.opaque {
+		f.opaqueDirs[dir] = true
+		if _, ok := f.hiddenDirs[dir]; ok {
+			f.hiddenDirs = map[string]bool{}
+		}
+	}
+	return nil
+}
+
+// notifyingReader calls fn with the number of bytes of each read.
+type notifyingReader struct {
+	r  io.Reader
+	fn func(int)
+}
+
+func (n *notifyingReader) Read(p []byte) (int, error) {
+	c, err := n.r.Read(p)
+	n.fn(c)
+	return c, err
+}
+
+// verifyDiffID returns an error unless hasher, which was fed the uncompressed
+// contents of layer, matches the layer's diff id.
+func verifyDiffID(layer v1.Layer, hasher hash.Hash) error {
+	want, err := layer.DiffID()
+	if err != nil {
+		return err
+	}
+	got := v1.Hash{
+		Algorithm: "sha256",
+		Hex:       hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if got != want {
+		return fmt.Errorf("layer contents have diff id %v, want %v", got, want)
+	}
+	return nil
+}
+
+// rollback forgets the entries recorded by the last call to flattenLayer.
+func (f *flattener) rollback() {
+	for _, name := range f.added {
+		delete(f.fileMap, name)
+	}
+	f.added = f.added[:0]
+	f.opaque = f.opaque[:0]
+	f.hiddenDirs = map[string]bool{}
+}
+
+// pseudoFSDirs holds the directories that container runtimes mount
+// pseudo-filesystems onto.
+var pseudoFSDirs = map[string]bool{
+	"dev":  true,
+	"proc": true,
+	"sys":  true,
+}
+
+// inPseudoFS returns whether name is contained in one of pseudoFSDirs.
+func inPseudoFS(name string) bool {
+	parts := strings.SplitN(cleanPath(name), "/", 2)
+	return len(parts) == 2 && pseudoFSDirs[parts[0]]
+}
+
+// isAUFSMetadata returns whether name is, or is contained in, an AUFS
+// metadata entry, which must not be mistaken for a whiteout.
+func isAUFSMetadata(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, whiteoutMetaPrefix) && part != whiteoutOpaqueDir {
 			return true
 		}
-		file = dirname
 	}
 	return false
 }
+
+// inWhiteoutDir returns whether file is contained in a directory that was
+// whited out, or replaced by a non-directory, according to fileMap, or that
+// is one of opaqueDirs. An empty opaque directory stands for the root.
+func (f *flattener) inWhiteoutDir(file string) bool {
+	if f.opaqueDirs[""] {
+		return true
+	}
+	if file == "" {
+		return false
+	}
+	dirname := filepath.Dir(file)
+	if file == dirname {
+		return false
+	}
+	return f.dirHidden(dirname)
+}
+
+// dirHidden returns whether dir, or one of its parents, was whited out,
+// replaced by a non-directory or marked opaque, caching the answer for dir
+// and for the parents it had to look up.
+func (f *flattener) dirHidden(dir string) bool {
+	if hidden, ok := f.hiddenDirs[dir]; ok {
+		return hidden
+	}
+	hidden := f.fileMap[dir] || f.opaqueDirs[dir]
+	if parent := filepath.Dir(dir); !hidden && parent != dir {
+		hidden = f.dirHidden(parent)
+	}
+	f.hiddenDirs[dir] = hidden
+	return hidden
+}
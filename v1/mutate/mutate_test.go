@@ -17,6 +17,7 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -25,10 +26,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
 	"github.com/google/go-containerregistry/v1/tarball"
 )
 
@@ -114,6 +118,9 @@ func TestWhiteoutDir(t *testing.T) {
 		"baz":      true,
 		"red/blue": true,
 	}
+	opaqueDirs := map[string]bool{
+		"etc": true,
+	}
 	var tests = []struct {
 		path     string
 		whiteout bool
@@ -123,16 +130,75 @@ func TestWhiteoutDir(t *testing.T) {
 		{"baz/bar/foo.txt", true},
 		{"red/green", false},
 		{"red/yellow.txt", false},
+		{"etc", false},
+		{"etc/passwd", true},
+		{"etc/ssl/certs", true},
 	}
 
+	f := newFlattener(context.Background(), &ExtractOptions{})
+	f.fileMap = fsMap
+	f.opaqueDirs = opaqueDirs
 	for _, tt := range tests {
-		whiteout := inWhiteoutDir(fsMap, tt.path)
+		whiteout := f.inWhiteoutDir(tt.path)
 		if whiteout != tt.whiteout {
 			t.Errorf("Whiteout %s: expected %v, but got %v", tt.path, tt.whiteout, whiteout)
 		}
 	}
 }
 
+func TestWhiteoutDirCache(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("d/e/g", "hidden by the opaque d"),
+		),
+		tarLayer(t,
+			regularFile("d/e/f", "kept"),
+			regularFile("d/.wh..wh..opq", ""),
+		),
+		tarLayer(t,
+			regularFile("a/b/x/one", "kept"),
+			regularFile("a/b", "replaces the directory"),
+			regularFile("a/b/x/two", "hidden by the file a/b"),
+		),
+	)
+
+	headers, _ := readEntries(t, Extract(img))
+	want := []string{"a/b/x/one", "a/b", "d/e/f"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("Extract() entries (-got, +want): %s", diff)
+	}
+}
+
+// deepTreeImage returns an image of 50k files spread across directories
+// nested ten deep, with a whiteout in each upper layer.
+func deepTreeImage(b *testing.B) v1.Image {
+	var layers []v1.Layer
+	for l := 0; l < 5; l++ {
+		files := []testFile{regularFile(fmt.Sprintf("l%d/.wh.gone", l), "")}
+		for i := 0; i < 10000; i++ {
+			dir := fmt.Sprintf("l%d", l)
+			for depth := 0; depth < 10; depth++ {
+				dir = fmt.Sprintf("%s/d%d", dir, (i>>uint(depth))&1)
+			}
+			files = append(files, regularFile(fmt.Sprintf("%s/f%d", dir, i), ""))
+		}
+		layers = append(layers, tarLayer(b, files...))
+	}
+	return imageFromLayers(b, layers...)
+}
+
+func BenchmarkExtractDeepTree(b *testing.B) {
+	img := deepTreeImage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc := Extract(img)
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			b.Fatalf("Extract: %v", err)
+		}
+		rc.Close()
+	}
+}
+
 func TestNoopCondition(t *testing.T) {
 	source := sourceImage(t)
 
@@ -209,6 +275,25 @@ func TestAppendLayers(t *testing.T) {
 	assertQueryingForLayerSucceeds(t, result, layers[1])
 }
 
+func TestAppendLayersHistory(t *testing.T) {
+	result, err := AppendLayers(empty.Image,
+		tarLayer(t, regularFile("a", "a")),
+		tarLayer(t, regularFile("b", "b")),
+	)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	history := getConfigFile(t, result).History
+	if got, want := len(history), 2; got != want {
+		t.Fatalf("len(History) = %d, want %d", got, want)
+	}
+	for i, h := range history {
+		if h.CreatedBy != AppendLayersCreatedBy || h.Created.IsZero() {
+			t.Errorf("History[%d] = %+v, want it created by %q with a time", i, h, AppendLayersCreatedBy)
+		}
+	}
+}
+
 func TestMutateConfig(t *testing.T) {
 	source := sourceImage(t)
 	cfg, err := source.ConfigFile()
@@ -395,3 +480,1312 @@ func (m mockLayer) Compressed() (io.ReadCloser, error) {
 func (m mockLayer) Uncompressed() (io.ReadCloser, error) {
 	return ioutil.NopCloser(strings.NewReader("uncompressed")), nil
 }
+
+// testFile describes a single entry of a layer built by tarLayer.
+type testFile struct {
+	hdr      tar.Header
+	contents string
+}
+
+func regularFile(name, contents string) testFile {
+	return testFile{
+		hdr: tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		},
+		contents: contents,
+	}
+}
+
+func directory(name string) testFile {
+	return testFile{
+		hdr: tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+		},
+	}
+}
+
+func symlink(name, target string) testFile {
+	return testFile{
+		hdr: tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeSymlink,
+			Linkname: target,
+			Mode:     0777,
+		},
+	}
+}
+
+func hardlink(name, target string) testFile {
+	return testFile{
+		hdr: tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeLink,
+			Linkname: target,
+			Mode:     0644,
+		},
+	}
+}
+
+// tarLayer returns an uncompressed tarball layer holding the provided files.
+func tarLayer(t testing.TB, files ...testFile) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := f.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", hdr.Name, err)
+		}
+		if _, err := io.WriteString(tw, f.contents); err != nil {
+			t.Fatalf("Write(%q): %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close: %v", err)
+	}
+
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+	return layer
+}
+
+// imageFromLayers returns an image consisting of the provided layers, base
+// layer first.
+func imageFromLayers(t testing.TB, layers ...v1.Layer) v1.Image {
+	t.Helper()
+
+	img, err := AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	return img
+}
+
+// readEntries reads the tar stream from rc, returning its headers in order
+// along with the contents of each entry keyed by name.
+func readEntries(t *testing.T, rc io.ReadCloser) ([]*tar.Header, map[string]string) {
+	t.Helper()
+	defer rc.Close()
+
+	var headers []*tar.Header
+	contents := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tr.Next: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %q: %v", hdr.Name, err)
+		}
+		headers = append(headers, hdr)
+		contents[hdr.Name] = string(b)
+	}
+	return headers, contents
+}
+
+// entryNames returns the names of the provided headers, in order.
+func entryNames(headers []*tar.Header) []string {
+	names := make([]string, 0, len(headers))
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestExtractSkipsAUFSMetadata(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("wh.aufs", "real file"),
+			regularFile("keep.txt", "keep"),
+		),
+		tarLayer(t,
+			regularFile(".wh..wh.aufs", ""),
+			directory(".wh..wh.plnk/"),
+			regularFile(".wh..wh.plnk/123.456", "hardlink"),
+			directory(".wh..wh.orph/"),
+			regularFile("app.txt", "app"),
+		),
+	)
+
+	_, contents := readEntries(t, Extract(img))
+	want := map[string]string{
+		"wh.aufs":  "real file",
+		"keep.txt": "keep",
+		"app.txt":  "app",
+	}
+	if diff := cmp.Diff(contents, want); diff != "" {
+		t.Errorf("Extract (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractPreserveOpaqueMarkers(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/old.conf", "old"),
+			regularFile("removed.txt", "removed"),
+		),
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/.wh..wh..opq", ""),
+			regularFile("etc/new.conf", "new"),
+			regularFile(".wh.removed.txt", ""),
+			regularFile("added.txt", "added"),
+		),
+	)
+
+	headers, _ := readEntries(t, ExtractWithOptions(img, &ExtractOptions{PreserveOpaqueMarkers: true}))
+	names := entryNames(headers)
+	var sawMarker bool
+	for _, name := range names {
+		switch name {
+		case "etc/.wh..wh..opq":
+			sawMarker = true
+		case ".wh.removed.txt", "removed.txt":
+			t.Errorf("whiteout of removed.txt was not resolved: %v", names)
+		}
+	}
+	if !sawMarker {
+		t.Errorf("opaque marker missing from %v", names)
+	}
+
+	headers, _ = readEntries(t, Extract(img))
+	for _, name := range entryNames(headers) {
+		if name == "etc/.wh..wh..opq" {
+			t.Errorf("Extract preserved the opaque marker without PreserveOpaqueMarkers")
+		}
+	}
+}
+
+func TestExtractOpaqueDir(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("etc/"),
+			regularFile("etc/old.conf", "old"),
+			directory("etc/ssl/"),
+			regularFile("etc/ssl/cert.pem", "cert"),
+			regularFile("etcetera", "sibling"),
+		),
+		tarLayer(t,
+			regularFile("etc/new.conf", "new"),
+			regularFile("etc/.wh..wh..opq", ""),
+			regularFile("etc/also.conf", "also"),
+		),
+		tarLayer(t,
+			regularFile("etc/top.conf", "top"),
+		),
+	)
+
+	headers, contents := readEntries(t, Extract(img))
+	want := map[string]string{
+		"etc/":          "",
+		"etc/top.conf":  "top",
+		"etc/new.conf":  "new",
+		"etc/also.conf": "also",
+		"etcetera":      "sibling",
+	}
+	if diff := cmp.Diff(contents, want); diff != "" {
+		t.Errorf("Extract (-got, +want) %s", diff)
+	}
+	// The opaque directory itself survives.
+	var sawDir bool
+	for _, hdr := range headers {
+		if hdr.Name == "etc/" && hdr.Typeflag == tar.TypeDir {
+			sawDir = true
+		}
+	}
+	if !sawDir {
+		t.Errorf("directory etc/ missing from %v", entryNames(headers))
+	}
+}
+
+func TestExtractOpaqueDirLayers(t *testing.T) {
+	opq := func(dir string) testFile { return regularFile(dir+"/.wh..wh..opq", "") }
+	for _, tc := range []struct {
+		name string
+		// layers, from the bottom up
+		layers [][]testFile
+		want   map[string]string
+	}{{
+		name: "child above opaque marker above child",
+		layers: [][]testFile{
+			{regularFile("a/c", "c")},
+			{opq("a")},
+			{regularFile("a/b", "b")},
+		},
+		want: map[string]string{"a/b": "b"},
+	}, {
+		name: "marker after its contents in the same layer",
+		layers: [][]testFile{
+			{regularFile("a/old", "old")},
+			{regularFile("a/new", "new"), opq("a")},
+		},
+		want: map[string]string{"a/new": "new"},
+	}, {
+		name: "nested directory contents",
+		layers: [][]testFile{
+			{regularFile("a/x/deep", "deep"), regularFile("ab", "sibling")},
+			{opq("a")},
+		},
+		want: map[string]string{"ab": "sibling"},
+	}, {
+		name: "nested opaque marker",
+		layers: [][]testFile{
+			{regularFile("a/1", "1"), regularFile("a/x/1", "1")},
+			{regularFile("a/2", "2"), regularFile("a/x/2", "2")},
+			{opq("a/x")},
+		},
+		want: map[string]string{"a/1": "1", "a/2": "2"},
+	}, {
+		name: "opaque twice",
+		layers: [][]testFile{
+			{regularFile("a/1", "1")},
+			{opq("a"), regularFile("a/2", "2")},
+			{opq("a"), regularFile("a/3", "3")},
+		},
+		want: map[string]string{"a/3": "3"},
+	}, {
+		name: "directory replaced above the marker",
+		layers: [][]testFile{
+			{regularFile("a/1", "1")},
+			{opq("a"), regularFile("a/2", "2")},
+			{regularFile("a", "file")},
+		},
+		want: map[string]string{"a": "file"},
+	}, {
+		name: "directory whited out above the marker",
+		layers: [][]testFile{
+			{regularFile("a/1", "1")},
+			{opq("a"), regularFile("a/2", "2")},
+			{regularFile(".wh.a", "")},
+		},
+		want: map[string]string{},
+	}, {
+		name: "whiteout inside an opaque directory",
+		layers: [][]testFile{
+			{regularFile("a/1", "1")},
+			{opq("a"), regularFile("a/2", "2"), regularFile("a/3", "3")},
+			{regularFile("a/.wh.2", "")},
+		},
+		want: map[string]string{"a/3": "3"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var layers []v1.Layer
+			for _, files := range tc.layers {
+				layers = append(layers, tarLayer(t, files...))
+			}
+			img := imageFromLayers(t, layers...)
+			for _, order := range []ExtractOrder{LayerOrder, DirectoryOrder, PathOrder} {
+				_, contents := readEntries(t, ExtractWithOptions(img, &ExtractOptions{Order: order}))
+				if diff := cmp.Diff(contents, tc.want); diff != "" {
+					t.Errorf("order %d: Extract (-got, +want) %s", order, diff)
+				}
+			}
+		})
+	}
+}
+
+// createdLayer is a layer that knows when it was created.
+type createdLayer struct {
+	v1.Layer
+	created time.Time
+}
+
+func (l createdLayer) Created() (v1.Time, error) {
+	return v1.Time{Time: l.created}, nil
+}
+
+func TestAppendEmptyHistoryCreated(t *testing.T) {
+	created := time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+	layer := tarLayer(t, regularFile("a", "a"))
+
+	before := time.Now()
+	result, err := Append(empty.Image,
+		Addendum{Layer: createdLayer{Layer: layer, created: created}},
+		Addendum{Layer: layer},
+		Addendum{Layer: layer, History: v1.History{CreatedBy: "explicit"}},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	after := time.Now()
+
+	history := getConfigFile(t, result).History
+	if got := history[0].Created.Time; !got.Equal(created) {
+		t.Errorf("history[0].Created = %v, want %v", got, created)
+	}
+	if got := history[1].Created.Time; got.Before(before) || got.After(after) {
+		t.Errorf("history[1].Created = %v, want between %v and %v", got, before, after)
+	}
+	if got := history[2]; got != (v1.History{CreatedBy: "explicit"}) {
+		t.Errorf("history[2] = %v, want it unchanged", got)
+	}
+}
+
+func TestAppendAtTime(t *testing.T) {
+	base, err := Append(empty.Image, Addendum{Layer: tarLayer(t, regularFile("base", "base"))})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	stamp := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	set := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	result, err := AppendAtTime(base, stamp,
+		Addendum{Layer: tarLayer(t, regularFile("a", "a"))},
+		Addendum{Layer: tarLayer(t, regularFile("b", "b")), History: v1.History{CreatedBy: "ADD b"}},
+		Addendum{Layer: createdLayer{Layer: tarLayer(t, regularFile("c", "c")), created: time.Now()}},
+		Addendum{Layer: tarLayer(t, regularFile("d", "d")), History: v1.History{Created: v1.Time{Time: set}}},
+	)
+	if err != nil {
+		t.Fatalf("AppendAtTime: %v", err)
+	}
+
+	want := []v1.History{
+		getConfigFile(t, base).History[0],
+		{Created: v1.Time{Time: stamp}},
+		{Created: v1.Time{Time: stamp}, CreatedBy: "ADD b"},
+		{Created: v1.Time{Time: stamp}},
+		{Created: v1.Time{Time: set}},
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).History, want); diff != "" {
+		t.Errorf("History (-got, +want) %s", diff)
+	}
+}
+
+func TestAddHistory(t *testing.T) {
+	stamp := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	base, err := AppendAtTime(empty.Image, stamp, Addendum{Layer: tarLayer(t, regularFile("base", "base"))})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	env := v1.History{Created: v1.Time{Time: stamp}, CreatedBy: "ENV A=b", Author: "me"}
+	result, err := AddHistory(base, env)
+	if err != nil {
+		t.Fatalf("AddHistory: %v", err)
+	}
+	if diff := cmp.Diff(getManifest(t, result).Layers, getManifest(t, base).Layers); diff != "" {
+		t.Errorf("AddHistory changed the layers (-got, +want) %s", diff)
+	}
+
+	// A layer appended afterwards has a history entry of its own, even if
+	// it claims to be empty.
+	result, err = AppendAtTime(result, stamp, Addendum{
+		Layer:   tarLayer(t, regularFile("a", "a")),
+		History: v1.History{Comment: "adds a", EmptyLayer: true},
+	})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	want := []v1.History{
+		{Created: v1.Time{Time: stamp}},
+		{Created: v1.Time{Time: stamp}, CreatedBy: "ENV A=b", Author: "me", EmptyLayer: true},
+		{Created: v1.Time{Time: stamp}, Comment: "adds a"},
+	}
+	if diff := cmp.Diff(getConfigFile(t, result).History, want); diff != "" {
+		t.Errorf("History (-got, +want) %s", diff)
+	}
+
+	// Images without history get a blank entry per layer first.
+	cf := getConfigFile(t, base).DeepCopy()
+	cf.History = nil
+	noHistory, err := ConfigFile(base, cf)
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	result, err = AddHistory(noHistory, env)
+	if err != nil {
+		t.Fatalf("AddHistory: %v", err)
+	}
+	want = []v1.History{{}, {Created: v1.Time{Time: stamp}, CreatedBy: "ENV A=b", Author: "me", EmptyLayer: true}}
+	if diff := cmp.Diff(getConfigFile(t, result).History, want); diff != "" {
+		t.Errorf("History without a base history (-got, +want) %s", diff)
+	}
+
+	cf.History = []v1.History{{Comment: "one"}, {Comment: "two"}}
+	misaligned, err := ConfigFile(base, cf)
+	if err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	if _, err := AddHistory(misaligned, env); err == nil {
+		t.Error("AddHistory with more history entries than layers = nil error, want error")
+	}
+}
+
+func TestAppendCreatedAnnotation(t *testing.T) {
+	base, err := Append(empty.Image, Addendum{Layer: tarLayer(t, regularFile("base", "base"))})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	opts := &AppendOptions{
+		CreatedAnnotation: "com.example.appended",
+		CreatedValue:      "2018-05-01T00:00:00Z",
+	}
+	result, err := AppendWithOptions(base, opts,
+		Addendum{Layer: tarLayer(t, regularFile("a", "a"))},
+		Addendum{Layer: tarLayer(t, regularFile("b", "b"))},
+	)
+	if err != nil {
+		t.Fatalf("AppendWithOptions: %v", err)
+	}
+
+	m := getManifest(t, result)
+	if got := m.Layers[0].Annotations; got != nil {
+		t.Errorf("base layer annotations = %v, want none", got)
+	}
+	want := map[string]string{"com.example.appended": "2018-05-01T00:00:00Z"}
+	for i, l := range m.Layers[1:] {
+		if diff := cmp.Diff(l.Annotations, want); diff != "" {
+			t.Errorf("layer %d annotations (-got, +want) %s", i+1, diff)
+		}
+	}
+
+	result, err = AppendWithOptions(base, &AppendOptions{CreatedAnnotation: AnnotationCreated},
+		Addendum{Layer: tarLayer(t, regularFile("a", "a"))})
+	if err != nil {
+		t.Fatalf("AppendWithOptions: %v", err)
+	}
+	value := getManifest(t, result).Layers[1].Annotations[AnnotationCreated]
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		t.Errorf("default created annotation %q: %v", value, err)
+	}
+}
+
+func TestAppendOnLayer(t *testing.T) {
+	base, err := Append(empty.Image, Addendum{Layer: tarLayer(t, regularFile("base", "base"))})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	var got []v1.Descriptor
+	opts := &AppendOptions{
+		CreatedAnnotation: "com.example.appended",
+		CreatedValue:      "2018-05-01T00:00:00Z",
+		OnLayer: func(d v1.Descriptor) {
+			got = append(got, d)
+			// Changes made by the callback don't leak into the image.
+			d.Annotations["com.example.appended"] = "changed"
+		},
+	}
+	result, err := AppendWithOptions(base, opts,
+		Addendum{Layer: tarLayer(t, regularFile("a", "a"))},
+		Addendum{Layer: tarLayer(t, regularFile("b", "b"))},
+	)
+	if err != nil {
+		t.Fatalf("AppendWithOptions: %v", err)
+	}
+
+	want := getManifest(t, result).Layers[1:]
+	if len(got) != len(want) {
+		t.Fatalf("OnLayer called %d times, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if want[i].Annotations["com.example.appended"] != "2018-05-01T00:00:00Z" {
+			t.Errorf("layer %d annotations = %v, callback changes leaked", i+1, want[i].Annotations)
+		}
+		got[i].Annotations = want[i].Annotations
+		if diff := cmp.Diff(got[i], want[i]); diff != "" {
+			t.Errorf("OnLayer descriptor %d (-got, +want) %s", i, diff)
+		}
+	}
+}
+
+func TestPrepend(t *testing.T) {
+	base, err := Append(empty.Image,
+		Addendum{Layer: tarLayer(t, regularFile("app", "app"), regularFile("shared", "app")), History: v1.History{CreatedBy: "app"}},
+		Addendum{Layer: tarLayer(t, regularFile(".wh.agent.conf", "")), History: v1.History{CreatedBy: "cleanup"}},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	cfg := getConfigFile(t, base).Config.DeepCopy()
+	cfg.Env = []string{"A=b"}
+	if base, err = Config(base, *cfg); err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	agent := tarLayer(t, regularFile("agent", "agent"), regularFile("agent.conf", "conf"), regularFile("shared", "agent"))
+	result, err := Prepend(base, Addendum{Layer: agent, History: v1.History{CreatedBy: "agent"}})
+	if err != nil {
+		t.Fatalf("Prepend: %v", err)
+	}
+
+	baseManifest := getManifest(t, base).DeepCopy()
+	m := getManifest(t, result)
+	agentDigest, err := agent.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if len(m.Layers) != 3 || m.Layers[0].Digest != agentDigest {
+		t.Fatalf("Prepend layers = %v, want the agent layer first", m.Layers)
+	}
+	if diff := cmp.Diff(m.Layers[1:], baseManifest.Layers); diff != "" {
+		t.Errorf("base layers (-got, +want) %s", diff)
+	}
+	cf := getConfigFile(t, result)
+	var createdBy []string
+	for _, h := range cf.History {
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	if diff := cmp.Diff(createdBy, []string{"agent", "app", "cleanup"}); diff != "" {
+		t.Errorf("history (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(cf.Config.Env, []string{"A=b"}); diff != "" {
+		t.Errorf("Env (-got, +want) %s", diff)
+	}
+
+	// The agent's files are masked by base's layers.
+	files, err := ExtractMap(result)
+	if err != nil {
+		t.Fatalf("ExtractMap: %v", err)
+	}
+	want := map[string][]byte{
+		"agent":  []byte("agent"),
+		"app":    []byte("app"),
+		"shared": []byte("app"),
+	}
+	if diff := cmp.Diff(files, want); diff != "" {
+		t.Errorf("ExtractMap (-got, +want) %s", diff)
+	}
+
+	// Nothing of base is changed.
+	if diff := cmp.Diff(getManifest(t, base), baseManifest); diff != "" {
+		t.Errorf("base manifest changed (-got, +want) %s", diff)
+	}
+	if got, err := Prepend(base); err != nil || got != base {
+		t.Errorf("Prepend() = %v, %v; want base", got, err)
+	}
+}
+
+func TestAppendDedup(t *testing.T) {
+	shared := tarLayer(t, regularFile("shared", "shared"))
+	base, err := Append(empty.Image, Addendum{Layer: shared, History: v1.History{CreatedBy: "base"}})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	other := tarLayer(t, regularFile("other", "other"))
+	result, err := AppendDedup(base,
+		Addendum{Layer: shared, History: v1.History{CreatedBy: "again"}},
+		Addendum{Layer: other, History: v1.History{CreatedBy: "other"}},
+		Addendum{Layer: other},
+	)
+	if err != nil {
+		t.Fatalf("AppendDedup: %v", err)
+	}
+
+	var want []v1.Hash
+	for _, l := range []v1.Layer{shared, other} {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		want = append(want, d)
+	}
+	var got []v1.Hash
+	for _, d := range getManifest(t, result).Layers {
+		got = append(got, d.Digest)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("manifest layers (-got, +want) %s", diff)
+	}
+	cf := getConfigFile(t, result)
+	if got, want := len(cf.RootFS.DiffIDs), 2; got != want {
+		t.Errorf("len(DiffIDs) = %d, want %d", got, want)
+	}
+	wantHistory := []v1.History{
+		{CreatedBy: "base"},
+		{CreatedBy: "again", EmptyLayer: true},
+		{CreatedBy: "other"},
+	}
+	if diff := cmp.Diff(cf.History, wantHistory); diff != "" {
+		t.Errorf("history (-got, +want) %s", diff)
+	}
+
+	if got, err := AppendDedup(base, Addendum{Layer: shared}); err != nil || got != base {
+		t.Errorf("AppendDedup(duplicate) = %v, %v; want base", got, err)
+	}
+	if got, err := Append(base, Addendum{Layer: shared}); err != nil || len(getManifest(t, got).Layers) != 2 {
+		t.Errorf("Append(duplicate) = %v, %v; want the layer appended", got, err)
+	}
+}
+
+func TestAppendOnWhiteoutOnly(t *testing.T) {
+	deletion := tarLayer(t,
+		directory("etc/"),
+		regularFile("etc/.wh.passwd", ""),
+		regularFile("var/.wh..wh..opq", ""),
+	)
+	layers := []v1.Layer{
+		tarLayer(t, regularFile("etc/passwd", "root")),
+		deletion,
+		tarLayer(t, regularFile("etc/.wh.group", ""), regularFile("etc/shadow", "")),
+		tarLayer(t, directory("empty/")),
+	}
+	var adds []Addendum
+	for _, l := range layers {
+		adds = append(adds, Addendum{Layer: l})
+	}
+
+	var got []int
+	opts := &AppendOptions{
+		OnWhiteoutOnly: func(i int, d v1.Descriptor) {
+			got = append(got, i)
+			if want, err := deletion.Digest(); err != nil || d.Digest != want {
+				t.Errorf("OnWhiteoutOnly descriptor digest = %v, want %v", d.Digest, want)
+			}
+		},
+	}
+	if _, err := AppendWithOptions(empty.Image, opts, adds...); err != nil {
+		t.Fatalf("AppendWithOptions: %v", err)
+	}
+	if diff := cmp.Diff(got, []int{1}); diff != "" {
+		t.Errorf("OnWhiteoutOnly indexes (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractWithLimit(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("a", strings.Repeat("a", 10))),
+		tarLayer(t, directory("dir/"), regularFile("dir/b", strings.Repeat("b", 20))),
+	)
+
+	for _, tc := range []struct {
+		limit   int64
+		wantErr string
+	}{
+		{limit: 30},
+		{limit: 29, wantErr: `layer 0, entry "a": would exceed the limit of 29 bytes`},
+		{limit: 15, wantErr: `layer 1, entry "dir/b": would exceed the limit of 15 bytes`},
+	} {
+		rc := ExtractWithLimit(img, tc.limit)
+		_, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("ExtractWithLimit(%d): %v", tc.limit, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("ExtractWithLimit(%d): got %v, want %q", tc.limit, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExtractContext(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("a", "a"), regularFile("big", strings.Repeat("x", 1<<20))),
+		tarLayer(t, regularFile("b", "b")),
+	)
+
+	headers, _ := readEntries(t, ExtractContext(context.Background(), img))
+	if diff := cmp.Diff(entryNames(headers), []string{"b", "a", "big"}); diff != "" {
+		t.Errorf("ExtractContext (-got, +want) %s", diff)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := ExtractContext(ctx, img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	cancel()
+	// Whatever was already in flight, the stream ends with the error.
+	if _, err := io.Copy(ioutil.Discard, rc); err != context.Canceled {
+		t.Errorf("reading after cancel: got %v, want %v", err, context.Canceled)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, ExtractContext(ctx, img)); err != context.Canceled {
+		t.Errorf("ExtractContext with a done context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestExtractHeartbeat(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t, regularFile("big", strings.Repeat("x", 1<<20))))
+
+	var (
+		mu    sync.Mutex
+		beats []int64
+		done  bool
+	)
+	rc := ExtractWithOptions(img, &ExtractOptions{
+		HeartbeatInterval: time.Millisecond,
+		Heartbeat: func(written int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if done {
+				t.Error("Heartbeat called after extraction finished")
+			}
+			beats = append(beats, written)
+		},
+	})
+	// Read slowly, so that the heartbeat fires while the file is copied.
+	buf := make([]byte, 64<<10)
+	for {
+		time.Sleep(2 * time.Millisecond)
+		if _, err := rc.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	rc.Close()
+	mu.Lock()
+	done = true
+	mu.Unlock()
+
+	if len(beats) == 0 {
+		t.Fatal("Heartbeat was never called")
+	}
+	for i := 1; i < len(beats); i++ {
+		if beats[i] < beats[i-1] {
+			t.Errorf("heartbeats went backwards: %v", beats)
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+// unreadableLayer fails if its contents are read.
+type unreadableLayer struct {
+	v1.Layer
+}
+
+func (unreadableLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.New("compressed contents were read")
+}
+
+func (unreadableLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.New("uncompressed contents were read")
+}
+
+func TestAppendDryRun(t *testing.T) {
+	base := imageFromLayers(t, tarLayer(t, regularFile("base", "base")))
+	layer := tarLayer(t, regularFile("a", "a"))
+	add := Addendum{Layer: unreadableLayer{layer}, History: v1.History{CreatedBy: "dry run"}}
+
+	m, cf, err := AppendDryRun(base, add)
+	if err != nil {
+		t.Fatalf("AppendDryRun: %v", err)
+	}
+	img, err := Append(base, Addendum{Layer: layer, History: add.History})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if diff := cmp.Diff(m, getManifest(t, img)); diff != "" {
+		t.Errorf("Manifest (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(cf, getConfigFile(t, img)); diff != "" {
+		t.Errorf("ConfigFile (-got, +want) %s", diff)
+	}
+}
+
+// slowLayer blocks reads of its contents until unblock is closed, or until
+// they are closed, which is recorded by closing closed.
+type slowLayer struct {
+	v1.Layer
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func (l slowLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return slowReader{rc, l.unblock, l.closed}, nil
+}
+
+type slowReader struct {
+	io.ReadCloser
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.unblock:
+		return r.ReadCloser.Read(p)
+	case <-r.closed:
+		return 0, errors.New("read of a closed layer")
+	}
+}
+
+func (r slowReader) Close() error {
+	close(r.closed)
+	return r.ReadCloser.Close()
+}
+
+func TestExtractLayerTimeout(t *testing.T) {
+	fast := tarLayer(t, regularFile("fast", "fast"))
+	slow := slowLayer{
+		Layer:   tarLayer(t, regularFile("slow", "slow")),
+		unblock: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	defer close(slow.unblock)
+	img := imageFromLayers(t, fast, slow)
+	digest, err := slow.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+
+	rc := ExtractWithOptions(img, &ExtractOptions{LayerTimeout: 10 * time.Millisecond})
+	defer rc.Close()
+	_, err = ioutil.ReadAll(rc)
+	if err == nil {
+		t.Fatal("ReadAll() = nil error, want timeout")
+	}
+	if !strings.Contains(err.Error(), digest.String()) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("ReadAll() = %v, want a timeout naming layer %v", err, digest)
+	}
+	// Extraction only fails once the slow layer is closed.
+	select {
+	case <-slow.closed:
+	default:
+		t.Error("the slow layer wasn't closed")
+	}
+
+	_, contents := readEntries(t, ExtractWithOptions(imageFromLayers(t, fast), &ExtractOptions{LayerTimeout: time.Minute}))
+	if diff := cmp.Diff(contents, map[string]string{"fast": "fast"}); diff != "" {
+		t.Errorf("Extract with a generous timeout (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractHardlinkOrder(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("target", "contents"),
+			regularFile("removed", "removed"),
+		),
+		tarLayer(t,
+			// Both links refer to files from the layer below, which
+			// Extract only reaches afterwards.
+			hardlink("link", "target"),
+			hardlink("chained", "link"),
+			hardlink("dangling", "removed"),
+			hardlink("nowhere", "missing"),
+			regularFile(".wh.removed", ""),
+		),
+	)
+
+	headers, contents := readEntries(t, Extract(img))
+	seen := map[string]bool{}
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeLink && !seen[hdr.Linkname] {
+			t.Errorf("hardlink %q was emitted before its target %q: %v", hdr.Name, hdr.Linkname, entryNames(headers))
+		}
+		seen[hdr.Name] = true
+	}
+	if diff := cmp.Diff(entryNames(headers), []string{"target", "link", "chained", "dangling", "nowhere"}); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	// A link to a whited out file becomes a copy of it.
+	if hdr := headers[3]; hdr.Typeflag != tar.TypeReg || contents[hdr.Name] != "removed" {
+		t.Errorf("hardlink to a whited out file = %v, want a regular file with its contents", hdr)
+	}
+	// A link to a file that is in no layer becomes an empty file.
+	if hdr := headers[4]; hdr.Typeflag != tar.TypeReg || contents[hdr.Name] != "" {
+		t.Errorf("dangling hardlink = %v, want an empty regular file", hdr)
+	}
+}
+
+func TestExtractHardlinkToWhiteout(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("lib/"),
+			regularFile("lib/libc.so.6", "libc"),
+		),
+		tarLayer(t,
+			hardlink("bin/libc-a", "lib/libc.so.6"),
+			hardlink("bin/libc-b", "lib/libc.so.6"),
+			symlink("bin/sym", "../lib/libc.so.6"),
+			symlink("bin/gone", "../lib"),
+		),
+		tarLayer(t,
+			regularFile(".wh.lib", ""),
+			regularFile("bin/.wh.gone", ""),
+		),
+	)
+
+	for _, order := range []ExtractOrder{LayerOrder, DirectoryOrder, PathOrder} {
+		headers, contents := readEntries(t, ExtractWithOptions(img, &ExtractOptions{Order: order}))
+		byName := map[string]*tar.Header{}
+		for _, hdr := range headers {
+			byName[hdr.Name] = hdr
+		}
+		if _, ok := byName["lib/libc.so.6"]; ok {
+			t.Errorf("order %d: whited out file was extracted: %v", order, entryNames(headers))
+		}
+		if _, ok := byName["bin/gone"]; ok {
+			t.Errorf("order %d: whited out symlink was extracted: %v", order, entryNames(headers))
+		}
+		// The first link takes the contents, and the second keeps
+		// sharing them with it.
+		if hdr := byName["bin/libc-a"]; hdr == nil || hdr.Typeflag != tar.TypeReg || contents["bin/libc-a"] != "libc" {
+			t.Errorf("order %d: bin/libc-a = %v, want a copy of the whited out file", order, hdr)
+		}
+		if hdr := byName["bin/libc-b"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "bin/libc-a" {
+			t.Errorf("order %d: bin/libc-b = %v, want a link to bin/libc-a", order, hdr)
+		}
+		// Symlinks are left alone, even when they dangle.
+		if hdr := byName["bin/sym"]; hdr == nil || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "../lib/libc.so.6" {
+			t.Errorf("order %d: bin/sym = %v, want it unchanged", order, hdr)
+		}
+	}
+}
+
+func TestExtractEmptyDirectories(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("data/"),
+			directory("./cache/"),
+			directory("removed/"),
+		),
+		tarLayer(t,
+			regularFile("app", "app"),
+			regularFile(".wh.removed", ""),
+			regularFile(".wh.cache", ""),
+		),
+	)
+
+	headers, _ := readEntries(t, Extract(img))
+	want := []string{"app", "data/"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("Extract (-got, +want) %s", diff)
+	}
+}
+
+// hugeLayer returns a layer with an entry that claims a huge size, but whose
+// contents are cut short.
+func hugeLayer(t *testing.T) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "huge", Typeflag: tar.TypeReg, Mode: 0644, Size: 1 << 40}); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := io.WriteString(tw, "not quite a terabyte"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Don't close tw, which would complain about the missing bytes.
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+	return layer
+}
+
+func TestExtractHugeSize(t *testing.T) {
+	img := imageFromLayers(t, hugeLayer(t))
+	rc := Extract(img)
+	defer rc.Close()
+	n, err := io.Copy(ioutil.Discard, rc)
+	if err == nil || !strings.Contains(err.Error(), `entry "huge"`) {
+		t.Errorf("Extract() = %v, want an error about entry \"huge\"", err)
+	}
+	if n > 1<<20 {
+		t.Errorf("Extract() produced %d bytes before failing", n)
+	}
+}
+
+func TestWriteTarEntry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		size     int64
+		contents string
+		wantErr  bool
+	}{
+		{"exact", 3, "abc", false},
+		{"empty", 0, "", false},
+		{"negative", -1, "", true},
+		{"short", 10, "abc", true},
+	} {
+		tw := tar.NewWriter(ioutil.Discard)
+		err := writeTarEntry(tw, &tar.Header{Name: test.name, Typeflag: tar.TypeReg, Size: test.size}, strings.NewReader(test.contents))
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("writeTarEntry(%s) = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestExtractOwnership(t *testing.T) {
+	owned := regularFile("home/builder/file", "file")
+	owned.hdr.Uid, owned.hdr.Gid = 1000, 1001
+	owned.hdr.Uname, owned.hdr.Gname = "builder", "builders"
+	xattr := regularFile("bin/ping", "ping")
+	xattr.hdr.Uid, xattr.hdr.Gid = 100000, 100000
+	xattr.hdr.PAXRecords = map[string]string{"SCHILY.xattr.security.capability": "cap_net_raw+ep"}
+	long := regularFile("home/someone/file", "file")
+	long.hdr.Uname = strings.Repeat("u", 40)
+	long.hdr.Gname = strings.Repeat("g", 40)
+	img := imageFromLayers(t, tarLayer(t, owned, xattr, long))
+
+	rc := Extract(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	got := map[string]tar.Header{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got[header.Name] = *header
+	}
+	for _, want := range []tar.Header{owned.hdr, xattr.hdr, long.hdr} {
+		h := got[want.Name]
+		if h.Uid != want.Uid || h.Gid != want.Gid || h.Uname != want.Uname || h.Gname != want.Gname {
+			t.Errorf("%s: ownership = %d:%d %s:%s, want %d:%d %s:%s", want.Name,
+				h.Uid, h.Gid, h.Uname, h.Gname, want.Uid, want.Gid, want.Uname, want.Gname)
+		}
+	}
+	if got, want := got["bin/ping"].PAXRecords["SCHILY.xattr.security.capability"], "cap_net_raw+ep"; got != want {
+		t.Errorf("bin/ping capability = %q, want %q", got, want)
+	}
+}
+
+func TestWriteTarEntryFormat(t *testing.T) {
+	// A header read as GNU can't be written back as GNU once it has PAX
+	// records, or an owner name too long for the GNU format.
+	for _, header := range []*tar.Header{{
+		Name:       "xattr",
+		Typeflag:   tar.TypeReg,
+		Format:     tar.FormatGNU,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"},
+	}, {
+		Name:     "owner",
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+		Uname:    strings.Repeat("u", 40),
+	}} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := writeTarEntry(tw, header, strings.NewReader("")); err != nil {
+			t.Errorf("writeTarEntry(%s): %v", header.Name, err)
+			continue
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		got, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if got.Format != tar.FormatPAX {
+			t.Errorf("%s: format = %v, want PAX", header.Name, got.Format)
+		}
+		if header.Format == tar.FormatPAX {
+			t.Errorf("%s: writeTarEntry modified the header", header.Name)
+		}
+	}
+}
+
+func TestAppendExpectedDiffID(t *testing.T) {
+	layer := tarLayer(t, regularFile("a", "a"))
+	diffID, err := layer.DiffID()
+	if err != nil {
+		t.Fatalf("DiffID: %v", err)
+	}
+	if _, err := Append(empty.Image, Addendum{Layer: layer, ExpectedDiffID: &diffID}); err != nil {
+		t.Errorf("Append with matching diff id: %v", err)
+	}
+
+	wrong, err := v1.NewHash("sha256:" + strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatalf("NewHash: %v", err)
+	}
+	_, err = Append(empty.Image,
+		Addendum{Layer: layer, ExpectedDiffID: &diffID},
+		Addendum{Layer: layer, ExpectedDiffID: &wrong},
+	)
+	if err == nil {
+		t.Fatal("Append with mismatched diff id = nil error, want error")
+	}
+	if got, want := err.Error(), fmt.Sprintf("layer 1 has diff id %v, expected %v", diffID, wrong); got != want {
+		t.Errorf("Append() = %q, want %q", got, want)
+	}
+}
+
+// truncatedLayer is a layer whose uncompressed contents stop after n bytes.
+type truncatedLayer struct {
+	v1.Layer
+	n int64
+}
+
+func (l truncatedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, l.n), rc}, nil
+}
+
+func TestExtractErrorLayer(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("base.txt", "base")),
+		truncatedLayer{tarLayer(t,
+			regularFile("small.txt", "small"),
+			regularFile("big.bin", strings.Repeat("x", 2048)),
+		), 3 * 512},
+		tarLayer(t, regularFile("top.txt", "top")),
+	)
+
+	_, err := io.Copy(ioutil.Discard, Extract(img))
+	var extractErr *ExtractError
+	if !errors.As(err, &extractErr) {
+		t.Fatalf("Extract() = %v, want an *ExtractError", err)
+	}
+	if got, want := extractErr.Layer, 1; got != want {
+		t.Errorf("ExtractError.Layer = %d, want %d", got, want)
+	}
+	if got, want := extractErr.Name, "big.bin"; got != want {
+		t.Errorf("ExtractError.Name = %q, want %q", got, want)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Extract() = %v, want it to wrap io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestExtractMaxPaths(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 1000; i++ {
+		files = append(files, regularFile(fmt.Sprintf("dir%d/file%d", i%10, i), ""))
+	}
+	img := imageFromLayers(t, tarLayer(t, files[:500]...), tarLayer(t, files[500:]...))
+
+	rc := ExtractWithOptions(img, &ExtractOptions{MaxPaths: 100})
+	defer rc.Close()
+	_, err := io.Copy(ioutil.Discard, rc)
+	if got, want := fmt.Sprint(err), `layer 1, entry "dir0/file600": image has more than 100 paths`; got != want {
+		t.Errorf("ExtractWithOptions(MaxPaths: 100) = %q, want %q", got, want)
+	}
+
+	headers, _ := readEntries(t, ExtractWithOptions(img, &ExtractOptions{MaxPaths: 1000}))
+	if got, want := len(headers), 1000; got != want {
+		t.Errorf("ExtractWithOptions(MaxPaths: 1000) got %d entries, want %d", got, want)
+	}
+}
+
+func TestExtractProgress(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t, regularFile("small", "small")),
+		tarLayer(t, regularFile("big", strings.Repeat("x", 1<<20))),
+		tarLayer(t, regularFile("medium", strings.Repeat("y", 1<<16))),
+	)
+
+	var fractions []float64
+	rc := ExtractWithOptions(img, &ExtractOptions{
+		Progress: func(fraction float64) {
+			fractions = append(fractions, fraction)
+		},
+	})
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	rc.Close()
+
+	if len(fractions) < 3 {
+		t.Fatalf("Progress called %d times, want at least once per layer", len(fractions))
+	}
+	for i, f := range fractions {
+		if f < 0 || f > 1 || (i > 0 && f <= fractions[i-1]) {
+			t.Fatalf("Progress fractions are not increasing within [0, 1]: %v", fractions)
+		}
+	}
+	if got := fractions[len(fractions)-1]; got != 1 {
+		t.Errorf("final Progress = %v, want 1", got)
+	}
+}
+
+func TestAppendKeepsLayersInSync(t *testing.T) {
+	base := imageFromLayers(t, tarLayer(t, regularFile("base", "base")))
+	var adds []Addendum
+	for i := 0; i < 10; i++ {
+		adds = append(adds, Addendum{
+			Layer:   tarLayer(t, regularFile(fmt.Sprintf("file%d", i), fmt.Sprint(i))),
+			History: v1.History{CreatedBy: fmt.Sprintf("layer %d", i)},
+		})
+	}
+	img, err := Append(base, adds...)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	m := getManifest(t, img)
+	cf := getConfigFile(t, img)
+	if len(m.Layers) != len(cf.RootFS.DiffIDs) || len(cf.History) != len(cf.RootFS.DiffIDs) {
+		t.Fatalf("got %d manifest layers, %d diff ids and %d history entries", len(m.Layers), len(cf.RootFS.DiffIDs), len(cf.History))
+	}
+	for i, add := range adds {
+		j := i + 1
+		diffID, err := add.Layer.DiffID()
+		if err != nil {
+			t.Fatalf("DiffID: %v", err)
+		}
+		digest, err := add.Layer.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		if cf.RootFS.DiffIDs[j] != diffID || m.Layers[j].Digest != digest || cf.History[j] != add.History {
+			t.Errorf("layer %d: got diff id %v, digest %v and history %v; want %v, %v and %v",
+				j, cf.RootFS.DiffIDs[j], m.Layers[j].Digest, cf.History[j], diffID, digest, add.History)
+		}
+	}
+}
+
+func TestExtractStripLeadingDotSlash(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("./"),
+			directory("./etc/"),
+			regularFile("./etc/passwd", "root"),
+			regularFile("./etc/removed", "removed"),
+			regularFile("./.hidden", "hidden"),
+		),
+		tarLayer(t,
+			regularFile("etc/.wh.removed", ""),
+			hardlink("./etc/passwd-", "./etc/passwd"),
+			regularFile("plain", "plain"),
+		),
+	)
+
+	headers, _ := readEntries(t, ExtractWithOptions(img, &ExtractOptions{StripLeadingDotSlash: true}))
+	want := []string{"plain", "etc/", "etc/passwd", "etc/passwd-", ".hidden"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	for _, hdr := range headers {
+		if hdr.Name == "etc/passwd-" && hdr.Linkname != "etc/passwd" {
+			t.Errorf("hardlink target = %q, want %q", hdr.Linkname, "etc/passwd")
+		}
+	}
+
+	headers, _ = readEntries(t, Extract(img))
+	want = []string{"plain", "./", "./etc/", "./etc/passwd", "./etc/passwd-", "./.hidden"}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("Extract without StripLeadingDotSlash (-got, +want) %s", diff)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// ExtractOrder is the order in which the entries of a flattened filesystem
+// are produced.
+type ExtractOrder int
+
+const (
+	// LayerOrder produces entries as they are encountered, walking the
+	// layers from the top down. It needs no extra storage. The order only
+	// depends on the contents of the layers, so it is reproducible too.
+	LayerOrder ExtractOrder = iota
+
+	// DirectoryOrder groups the entries of each directory together, with
+	// directories in sorted order and entries sorted within them, which
+	// makes for reproducible output that compresses better. The contents
+	// of the filesystem are spooled to a temporary file to reorder them.
+	DirectoryOrder
+
+	// PathOrder sorts the entries by their cleaned path, like "tar
+	// --sort=name", for tools that expect a flattened tar to be sorted by
+	// name. Like DirectoryOrder, it spools the contents of the filesystem
+	// to a temporary file.
+	PathOrder
+)
+
+// spool holds the entries of a flattened filesystem, with their contents in
+// a temporary file, so that they can be replayed in a different order.
+type spool struct {
+	f       *os.File
+	size    int64
+	entries []spoolEntry
+
+	// hidden holds the entries that are not part of the filesystem, but
+	// whose contents hardlinks may need.
+	hidden []spoolEntry
+}
+
+type spoolEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+func newSpool() (*spool, error) {
+	f, err := ioutil.TempFile("", "mutate-extract")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f}, nil
+}
+
+// add records header, and copies its contents from r.
+func (s *spool) add(header *tar.Header, r io.Reader) error {
+	s.entries = append(s.entries, spoolEntry{header, s.size})
+	return s.copy(header, r)
+}
+
+// addHidden records header as a hidden entry, and copies its contents from r.
+func (s *spool) addHidden(header *tar.Header, r io.Reader) error {
+	s.hidden = append(s.hidden, spoolEntry{header, s.size})
+	return s.copy(header, r)
+}
+
+func (s *spool) copy(header *tar.Header, r io.Reader) error {
+	if header.Size <= 0 {
+		return nil
+	}
+	n, err := io.CopyN(s.f, r, header.Size)
+	s.size += n
+	return err
+}
+
+// replay calls emit for each recorded entry, in order, which is
+// DirectoryOrder or PathOrder.
+func (s *spool) replay(order ExtractOrder, emit func(*tar.Header, io.Reader) error) error {
+	// For DirectoryOrder, sort by parent directory first, with top-level
+	// entries in "" so that every directory sorts before the group of its
+	// own entries.
+	type key struct{ dir, name string }
+	keys := make(map[*tar.Header]key, len(s.entries))
+	for _, e := range s.entries {
+		name := cleanPath(e.header.Name)
+		dir, _ := path.Split(name)
+		if order == PathOrder {
+			dir = ""
+		}
+		keys[e.header] = key{dir, name}
+	}
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		ki, kj := keys[s.entries[i].header], keys[s.entries[j].header]
+		if ki.dir != kj.dir {
+			return ki.dir < kj.dir
+		}
+		return ki.name < kj.name
+	})
+	return s.emitAll(s.entries, emit)
+}
+
+// replayHidden calls fn for each recorded hidden entry, in the order they
+// were added.
+func (s *spool) replayHidden(fn func(*tar.Header, io.Reader) error) error {
+	return s.emitAll(s.hidden, fn)
+}
+
+func (s *spool) emitAll(entries []spoolEntry, emit func(*tar.Header, io.Reader) error) error {
+	for _, e := range entries {
+		if err := emit(e.header, s.contents(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contents returns a reader for the contents of e.
+func (s *spool) contents(e spoolEntry) io.Reader {
+	size := e.header.Size
+	if size < 0 {
+		size = 0
+	}
+	return io.NewSectionReader(s.f, e.offset, size)
+}
+
+// Close removes the temporary file.
+func (s *spool) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
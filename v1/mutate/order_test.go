@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+)
+
+func TestExtractDirectoryOrder(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("usr/"),
+			directory("usr/lib/"),
+			regularFile("usr/lib/b.so", "b"),
+			directory("etc/"),
+			regularFile("etc/passwd", "root"),
+			regularFile("z", "z"),
+		),
+		tarLayer(t,
+			regularFile("usr/lib/a.so", "a"),
+			hardlink("usr/lib/c.so", "etc/hosts"),
+			regularFile("a", "a"),
+			regularFile("etc/hosts", "localhost"),
+		),
+	)
+
+	headers, contents := readEntries(t, ExtractWithOptions(img, &ExtractOptions{Order: DirectoryOrder}))
+	want := []string{
+		"a", "etc/", "usr/", "z",
+		"etc/hosts", "etc/passwd",
+		"usr/lib/",
+		"usr/lib/a.so", "usr/lib/b.so", "usr/lib/c.so",
+	}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	_, layerContents := readEntries(t, Extract(img))
+	if diff := cmp.Diff(contents, layerContents); diff != "" {
+		t.Errorf("contents differ from LayerOrder (-got, +want) %s", diff)
+	}
+}
+
+func TestExtractPathOrder(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			directory("usr/"),
+			directory("usr/lib/"),
+			regularFile("usr/lib/b.so", "b"),
+			directory("etc/"),
+			regularFile("etc/passwd", "root"),
+			regularFile("etc.txt", "etc"),
+		),
+		tarLayer(t,
+			regularFile("usr/lib/a.so", "a"),
+			regularFile("a", "a"),
+			regularFile("etc/hosts", "localhost"),
+		),
+	)
+
+	extract := func() []byte {
+		rc := ExtractWithOptions(img, &ExtractOptions{Order: PathOrder})
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return b
+	}
+	first := extract()
+	headers, _ := readEntries(t, ioutil.NopCloser(bytes.NewReader(first)))
+	want := []string{
+		"a", "etc/", "etc.txt", "etc/hosts", "etc/passwd",
+		"usr/", "usr/lib/", "usr/lib/a.so", "usr/lib/b.so",
+	}
+	if diff := cmp.Diff(entryNames(headers), want); diff != "" {
+		t.Errorf("entries (-got, +want) %s", diff)
+	}
+	if !bytes.Equal(extract(), first) {
+		t.Error("two extractions differ")
+	}
+}
+
+// realisticImage returns an image whose layers each add files of several
+// kinds across a shared set of directories, as a series of builds would.
+func realisticImage(b *testing.B) v1.Image {
+	r := rand.New(rand.NewSource(1))
+	kinds := map[string]func(int) string{
+		"src":  func(i int) string { return fmt.Sprintf("package p%d\n\nfunc F%d() int {\n\treturn %d\n}\n", i, i, i) },
+		"etc":  func(i int) string { return fmt.Sprintf("key%d = value%d\nenabled = true\n", i, i) },
+		"data": func(int) string { return fmt.Sprintf("%x", r.Int63()) },
+	}
+	var layers []v1.Layer
+	for l := 0; l < 5; l++ {
+		var files []testFile
+		for i := 0; i < 200; i++ {
+			for _, kind := range []string{"src", "etc", "data"} {
+				contents := strings.Repeat(kinds[kind](i), 8)
+				files = append(files, regularFile(fmt.Sprintf("%s/l%d/f%d", kind, i%10, l*1000+i), contents))
+			}
+		}
+		layers = append(layers, tarLayer(b, files...))
+	}
+	return imageFromLayers(b, layers...)
+}
+
+func BenchmarkExtractOrder(b *testing.B) {
+	img := realisticImage(b)
+	for _, order := range []struct {
+		name  string
+		order ExtractOrder
+	}{{"layer", LayerOrder}, {"directory", DirectoryOrder}, {"path", PathOrder}} {
+		b.Run(order.name, func(b *testing.B) {
+			var compressed countingWriter
+			for i := 0; i < b.N; i++ {
+				compressed = countingWriter{w: ioutil.Discard}
+				zw := gzip.NewWriter(&compressed)
+				rc := ExtractWithOptions(img, &ExtractOptions{Order: order.order})
+				if _, err := io.Copy(zw, rc); err != nil {
+					b.Fatalf("Extract: %v", err)
+				}
+				rc.Close()
+				if err := zw.Close(); err != nil {
+					b.Fatalf("gzip: %v", err)
+				}
+			}
+			b.ReportMetric(float64(compressed.n), "gzip-bytes")
+		})
+	}
+}
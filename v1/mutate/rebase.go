@@ -25,6 +25,22 @@ type RebaseOptions struct {
 	// TODO(jasonhall): Rebase seam hint.
 }
 
+// RebaseMismatchError is returned by Rebase when the original image is not
+// based on the old base image: the layer at Index of the original image has
+// diff id Actual, where the old base has diff id Expected.
+type RebaseMismatchError struct {
+	Index            int
+	Expected, Actual v1.Hash
+}
+
+func (e *RebaseMismatchError) Error() string {
+	return fmt.Sprintf("image is not based on the old base: layer %d has diff id %v, expected %v", e.Index, e.Actual, e.Expected)
+}
+
+// Rebase returns a copy of orig in which the layers of oldBase, which must be
+// the first layers of orig, are replaced with the layers of newBase. The
+// history of oldBase is replaced with the history of newBase the same way,
+// including entries for empty layers.
 func Rebase(orig, oldBase, newBase v1.Image, opts *RebaseOptions) (v1.Image, error) {
 	// Verify that oldBase's layers are present in orig, otherwise orig is
 	// not based on oldBase at all.
@@ -32,30 +48,22 @@ func Rebase(orig, oldBase, newBase v1.Image, opts *RebaseOptions) (v1.Image, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to get layers for original: %v", err)
 	}
-	oldBaseLayers, err := oldBase.Layers()
+	origConfig, err := orig.ConfigFile()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get config for original: %v", err)
 	}
-	if len(oldBaseLayers) > len(origLayers) {
-		return nil, fmt.Errorf("image %q is not based on %q (too few layers)", orig, oldBase)
+	oldConfig, err := oldBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config for old base: %v", err)
 	}
-	for i, l := range oldBaseLayers {
-		oldLayerDigest, err := l.Digest()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get digest of layer %d of %q: %v", i, oldBase, err)
-		}
-		origLayerDigest, err := origLayers[i].Digest()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get digest of layer %d of %q: %v", i, orig, err)
-		}
-		if oldLayerDigest != origLayerDigest {
-			return nil, fmt.Errorf("image %q is not based on %q (layer %d mismatch)", orig, oldBase, i)
-		}
+	oldDiffIDs, origDiffIDs := oldConfig.RootFS.DiffIDs, origConfig.RootFS.DiffIDs
+	if len(oldDiffIDs) > len(origDiffIDs) {
+		return nil, fmt.Errorf("image is not based on the old base: it has %d layers, the old base has %d", len(origDiffIDs), len(oldDiffIDs))
 	}
-
-	origConfig, err := orig.ConfigFile()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get config for original: %v", err)
+	for i, diffID := range oldDiffIDs {
+		if origDiffIDs[i] != diffID {
+			return nil, &RebaseMismatchError{Index: i, Expected: diffID, Actual: origDiffIDs[i]}
+		}
 	}
 
 	// Stitch together an image that contains:
@@ -66,7 +74,6 @@ func Rebase(orig, oldBase, newBase v1.Image, opts *RebaseOptions) (v1.Image, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to create empty image with original config: %v", err)
 	}
-	// Get new base layers and config for history.
 	newBaseLayers, err := newBase.Layers()
 	if err != nil {
 		return nil, fmt.Errorf("could not get new base layers for new base: %v", err)
@@ -75,26 +82,90 @@ func Rebase(orig, oldBase, newBase v1.Image, opts *RebaseOptions) (v1.Image, err
 	if err != nil {
 		return nil, fmt.Errorf("could not get config for new base: %v", err)
 	}
-	// Add new base layers.
-	for i := range newBaseLayers {
-		rebasedImage, err = Append(rebasedImage, Addendum{
-			Layer:   newBaseLayers[i],
-			History: newConfig.History[i],
+	newManifest, err := newBase.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest for new base: %v", err)
+	}
+	origManifest, err := orig.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest for original: %v", err)
+	}
+
+	if len(newManifest.Layers) != len(newBaseLayers) {
+		return nil, fmt.Errorf("new base has %d layers, but its manifest has %d", len(newBaseLayers), len(newManifest.Layers))
+	}
+	if len(origManifest.Layers) != len(origLayers) {
+		return nil, fmt.Errorf("original has %d layers, but its manifest has %d", len(origLayers), len(origManifest.Layers))
+	}
+	start := len(oldDiffIDs)
+	if len(origLayers) < start {
+		return nil, fmt.Errorf("image is not based on the old base: it has %d layers, the old base has %d", len(origLayers), start)
+	}
+
+	var adds []Addendum
+	for i, l := range newBaseLayers {
+		adds = append(adds, Addendum{
+			Layer:       l,
+			Annotations: newManifest.Layers[i].Annotations,
 		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to append layer %d of new base layers", i)
-		}
 	}
-	// Add original layers above the old base.
-	start := len(oldBaseLayers)
-	for i := range origLayers[start:] {
-		rebasedImage, err = Append(rebasedImage, Addendum{
-			Layer:   origLayers[start+i],
-			History: origConfig.History[start+i],
+	for i, l := range origLayers[start:] {
+		adds = append(adds, Addendum{
+			Layer:       l,
+			Annotations: origManifest.Layers[start+i].Annotations,
 		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to append layer %d of original layers", i)
+	}
+	rebasedImage, err = Append(rebasedImage, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append layers: %v", err)
+	}
+
+	// History has entries for empty layers too, so it can't be appended
+	// along with the layers above.
+	history := append([]v1.History{}, newConfig.History...)
+	history = append(history, historyAbove(origConfig.History, oldConfig.History, start)...)
+	m, err := rebasedImage.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := rebasedImage.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.History = history
+	return configFile(rebasedImage, m, cf)
+}
+
+// historyAbove returns the entries of history, the history of an image, that
+// come after those of base, the history of its base image of the given number
+// of layers.
+func historyAbove(history, base []v1.History, layers int) []v1.History {
+	// The history of an image normally starts with that of its base, which
+	// keeps any trailing entries for empty layers of the base with it.
+	if len(base) <= len(history) && nonEmptyLayers(history[:len(base)]) == layers {
+		return history[len(base):]
+	}
+	// Otherwise, skip the entries of the base's layers.
+	for i, h := range history {
+		if layers == 0 {
+			return history[i:]
+		}
+		if !h.EmptyLayer {
+			layers--
+		}
+	}
+	return nil
+}
+
+// nonEmptyLayers returns the number of entries of history that are for
+// actual layers.
+func nonEmptyLayers(history []v1.History) int {
+	n := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			n++
 		}
 	}
-	return rebasedImage, nil
+	return n
 }
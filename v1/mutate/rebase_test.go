@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/v1"
 	"github.com/google/go-containerregistry/v1/random"
 )
@@ -116,3 +117,166 @@ func TestRebase(t *testing.T) {
 		}
 	}
 }
+
+// TestRebaseAnnotations tests that the annotations of the re-applied layers
+// survive a rebase.
+func TestRebaseAnnotations(t *testing.T) {
+	oldBase, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image (oldBase): %v", err)
+	}
+	top, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image (top): %v", err)
+	}
+	topLayers, err := top.Layers()
+	if err != nil {
+		t.Fatalf("top.Layers: %v", err)
+	}
+	orig, err := Append(oldBase,
+		Addendum{Layer: topLayers[0], Annotations: map[string]string{"layer": "first"}},
+		Addendum{Layer: topLayers[1]},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	newBase, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image (newBase): %v", err)
+	}
+
+	rebased, err := Rebase(orig, oldBase, newBase, nil)
+	if err != nil {
+		t.Fatalf("Rebase: %v", err)
+	}
+	m, err := rebased.Manifest()
+	if err != nil {
+		t.Fatalf("rebased.Manifest: %v", err)
+	}
+	if got, want := len(m.Layers), 3; got != want {
+		t.Fatalf("Rebased image contained %d layers, want %d", got, want)
+	}
+	if got, want := m.Layers[1].Annotations["layer"], "first"; got != want {
+		t.Errorf("Layer 1 annotation = %q, want %q", got, want)
+	}
+	if got := m.Layers[2].Annotations; got != nil {
+		t.Errorf("Layer 2 annotations = %v, want none", got)
+	}
+}
+
+// TestRebaseMismatch tests that rebasing an image onto a base it isn't based
+// on reports where they differ.
+func TestRebaseMismatch(t *testing.T) {
+	oldBase := imageFromLayers(t, tarLayer(t, regularFile("a", "a")), tarLayer(t, regularFile("b", "b")))
+	orig := imageFromLayers(t, tarLayer(t, regularFile("a", "a")), tarLayer(t, regularFile("c", "c")), tarLayer(t, regularFile("d", "d")))
+	newBase := imageFromLayers(t, tarLayer(t, regularFile("e", "e")))
+
+	_, err := Rebase(orig, oldBase, newBase, nil)
+	merr, ok := err.(*RebaseMismatchError)
+	if !ok {
+		t.Fatalf("Rebase: got error %v, want a *RebaseMismatchError", err)
+	}
+	want := &RebaseMismatchError{
+		Index:    1,
+		Expected: getConfigFile(t, oldBase).RootFS.DiffIDs[1],
+		Actual:   getConfigFile(t, orig).RootFS.DiffIDs[1],
+	}
+	if diff := cmp.Diff(merr, want); diff != "" {
+		t.Errorf("Rebase error (-got, +want) %s", diff)
+	}
+
+	if _, err := Rebase(oldBase, orig, newBase, nil); err == nil {
+		t.Error("Rebase onto a base with more layers: got nil error")
+	}
+}
+
+// TestRebaseHistory tests that history entries for empty layers move along
+// with the layers they are interleaved with.
+func TestRebaseHistory(t *testing.T) {
+	withHistory := func(img v1.Image, history ...v1.History) v1.Image {
+		cf := getConfigFile(t, img).DeepCopy()
+		cf.History = history
+		img, err := configFile(img, getManifest(t, img), cf)
+		if err != nil {
+			t.Fatalf("configFile: %v", err)
+		}
+		return img
+	}
+	a, b := tarLayer(t, regularFile("a", "a")), tarLayer(t, regularFile("b", "b"))
+	oldBase := withHistory(imageFromLayers(t, a),
+		v1.History{CreatedBy: "old a"},
+		v1.History{CreatedBy: "old env", EmptyLayer: true},
+	)
+	orig := withHistory(imageFromLayers(t, a, b),
+		v1.History{CreatedBy: "old a"},
+		v1.History{CreatedBy: "old env", EmptyLayer: true},
+		v1.History{CreatedBy: "orig cmd", EmptyLayer: true},
+		v1.History{CreatedBy: "orig b"},
+	)
+	newBase := withHistory(imageFromLayers(t, tarLayer(t, regularFile("c", "c"))),
+		v1.History{CreatedBy: "new env", EmptyLayer: true},
+		v1.History{CreatedBy: "new c"},
+	)
+
+	rebased, err := Rebase(orig, oldBase, newBase, nil)
+	if err != nil {
+		t.Fatalf("Rebase: %v", err)
+	}
+	var got []string
+	for _, h := range getConfigFile(t, rebased).History {
+		got = append(got, h.CreatedBy)
+	}
+	want := []string{"new env", "new c", "orig cmd", "orig b"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("rebased history (-got, +want) %s", diff)
+	}
+	if got, want := len(getConfigFile(t, rebased).RootFS.DiffIDs), 2; got != want {
+		t.Errorf("rebased image has %d layers, want %d", got, want)
+	}
+}
+
+// droppedLayerImage is an image whose manifest lacks its last layer, as a
+// malformed image's could.
+type droppedLayerImage struct {
+	v1.Image
+}
+
+func (i droppedLayerImage) Manifest() (*v1.Manifest, error) {
+	m, err := i.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.Layers = m.Layers[:len(m.Layers)-1]
+	return m, nil
+}
+
+func TestRebaseMalformed(t *testing.T) {
+	oldBase, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatalf("random.Image (oldBase): %v", err)
+	}
+	top, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image (top): %v", err)
+	}
+	topLayers, err := top.Layers()
+	if err != nil {
+		t.Fatalf("top.Layers: %v", err)
+	}
+	orig, err := AppendLayers(oldBase, topLayers...)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	newBase, err := random.Image(100, 3)
+	if err != nil {
+		t.Fatalf("random.Image (newBase): %v", err)
+	}
+
+	if _, err := Rebase(orig, oldBase, droppedLayerImage{newBase}, nil); err == nil {
+		t.Error("Rebase with a malformed new base: expected an error")
+	}
+	if _, err := Rebase(droppedLayerImage{orig}, oldBase, newBase, nil); err == nil {
+		t.Error("Rebase with a malformed original: expected an error")
+	}
+}
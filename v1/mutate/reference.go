@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"errors"
+	"io"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// errReferenceLayer is returned when attempting to read the contents of a
+// layer that only references a blob.
+var errReferenceLayer = errors.New("layer contents are not available for a reference-only layer")
+
+// describable is implemented by layers that know their own descriptor, which
+// Append uses as the basis for the manifest entry it produces.
+type describable interface {
+	Descriptor() (*v1.Descriptor, error)
+}
+
+type referenceLayer struct {
+	desc   v1.Descriptor
+	diffID v1.Hash
+}
+
+var _ v1.Layer = (*referenceLayer)(nil)
+var _ describable = (*referenceLayer)(nil)
+
+// ReferenceLayer returns a v1.Layer that is described solely by the provided
+// descriptor and diff id, with no readable content.
+//
+// This is useful for appending layers whose blobs already exist in another
+// repository, so that the resulting manifest references them and the blobs
+// can be cross-mounted at push time instead of being uploaded again. Since
+// the config file's rootfs is keyed by diff id, the caller must supply it.
+func ReferenceLayer(desc v1.Descriptor, diffID v1.Hash) v1.Layer {
+	return &referenceLayer{
+		desc:   *desc.DeepCopy(),
+		diffID: diffID,
+	}
+}
+
+// Digest returns the digest of the referenced blob.
+func (rl *referenceLayer) Digest() (v1.Hash, error) {
+	return rl.desc.Digest, nil
+}
+
+// DiffID returns the diff id supplied for the referenced blob.
+func (rl *referenceLayer) DiffID() (v1.Hash, error) {
+	return rl.diffID, nil
+}
+
+// Size returns the size of the referenced blob.
+func (rl *referenceLayer) Size() (int64, error) {
+	return rl.desc.Size, nil
+}
+
+// Compressed always fails, since the blob's contents are not available.
+func (rl *referenceLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errReferenceLayer
+}
+
+// Uncompressed always fails, since the blob's contents are not available.
+func (rl *referenceLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errReferenceLayer
+}
+
+// Descriptor returns a copy of the descriptor this layer was created from.
+func (rl *referenceLayer) Descriptor() (*v1.Descriptor, error) {
+	return rl.desc.DeepCopy(), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/random"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+func TestAppendReferenceLayer(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	desc := v1.Descriptor{
+		MediaType: types.DockerForeignLayer,
+		Size:      1234,
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		URLs:      []string{"https://example.com/layer.tar.gz"},
+	}
+	diffID := v1.Hash{Algorithm: "sha256", Hex: "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"}
+	layer := ReferenceLayer(desc, diffID)
+
+	result, err := AppendLayers(base, layer)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+
+	m := getManifest(t, result)
+	if got, want := len(m.Layers), 2; got != want {
+		t.Fatalf("len(Layers) = %d, want %d", got, want)
+	}
+	if diff := cmp.Diff(m.Layers[1], desc); diff != "" {
+		t.Errorf("appended descriptor (-got, +want) %s", diff)
+	}
+
+	cf := getConfigFile(t, result)
+	if got := cf.RootFS.DiffIDs[1]; got != diffID {
+		t.Errorf("DiffIDs[1] = %v, want %v", got, diffID)
+	}
+
+	assertLayerOrderMatchesConfig(t, result)
+	assertLayerOrderMatchesManifest(t, result)
+	assertQueryingForLayerSucceeds(t, result, layer)
+}
+
+func TestReferenceLayerContents(t *testing.T) {
+	layer := ReferenceLayer(v1.Descriptor{Size: 1}, v1.Hash{})
+
+	for _, open := range []func() (io.ReadCloser, error){layer.Compressed, layer.Uncompressed} {
+		rc, err := open()
+		if err == nil {
+			ioutil.ReadAll(rc)
+			rc.Close()
+			t.Errorf("expected an error reading a reference-only layer")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+)
+
+// The platform of the image returned by Scratch.
+const (
+	ScratchOS           = "linux"
+	ScratchArchitecture = "amd64"
+)
+
+// Scratch returns a valid image with no layers, think: FROM scratch, on top
+// of which Append and AppendLayers can build an image from nothing.
+//
+// Its config has an empty "layers" RootFS and the platform given by ScratchOS
+// and ScratchArchitecture.
+func Scratch() (v1.Image, error) {
+	m, err := empty.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := empty.Image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.OS = ScratchOS
+	cf.Architecture = ScratchArchitecture
+	cf.RootFS.Type = "layers"
+	return configFile(empty.Image, m, cf)
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/v1/partial"
+)
+
+func TestScratch(t *testing.T) {
+	img, err := Scratch()
+	if err != nil {
+		t.Fatalf("Scratch: %v", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if got, want := len(m.Layers), 0; got != want {
+		t.Errorf("len(Layers) = %d, want %d", got, want)
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatalf("RawConfigFile: %v", err)
+	}
+	if got, want := m.Config.Size, int64(len(raw)); got != want {
+		t.Errorf("Config.Size = %d, want %d", got, want)
+	}
+	if _, err := img.Digest(); err != nil {
+		t.Errorf("Digest: %v", err)
+	}
+
+	cf := getConfigFile(t, img)
+	if cf.OS != ScratchOS || cf.Architecture != ScratchArchitecture {
+		t.Errorf("platform = %s/%s, want %s/%s", cf.OS, cf.Architecture, ScratchOS, ScratchArchitecture)
+	}
+	if got, want := cf.RootFS.Type, "layers"; got != want {
+		t.Errorf("RootFS.Type = %q, want %q", got, want)
+	}
+
+	layer := tarLayer(t, regularFile("foo", "foo"))
+	img, err = AppendLayers(img, layer)
+	if err != nil {
+		t.Fatalf("AppendLayers: %v", err)
+	}
+	diffIDs, err := partial.DiffIDs(img)
+	if err != nil {
+		t.Fatalf("DiffIDs: %v", err)
+	}
+	if got, want := len(diffIDs), 1; got != want {
+		t.Errorf("len(DiffIDs) = %d, want %d", got, want)
+	}
+	if got := getConfigFile(t, img).OS; got != ScratchOS {
+		t.Errorf("OS after AppendLayers = %q, want %q", got, ScratchOS)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/partial"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+var (
+	// ErrNotComputed is returned by the methods of a StreamLayer, and of
+	// an image it was appended to, that need the layer's contents before
+	// they have been read through Compressed. It is partial.ErrNotComputed,
+	// which the writers check for.
+	ErrNotComputed = partial.ErrNotComputed
+
+	// ErrConsumed is returned by StreamLayer.Compressed once its stream
+	// has already been read.
+	ErrConsumed = errors.New("stream was already consumed")
+)
+
+// StreamLayer is a v1.Layer whose contents come from a stream of
+// uncompressed tar, which is only read, and compressed, as the layer is
+// written out. Its digest, diff id and size are computed along the way, so
+// the contents are never held in memory.
+//
+// The stream can only be read once, through Compressed, and Digest, DiffID
+// and Size return ErrNotComputed until it has been read to the end.
+// Uncompressed is not supported. A StreamLayer has no media type of its own:
+// Append gives it the gzipped layer type that suits the image's manifest.
+type StreamLayer struct {
+	blob io.ReadCloser
+
+	mu       sync.Mutex
+	consumed bool
+	done     bool
+	digest   v1.Hash
+	diffID   v1.Hash
+	size     int64
+}
+
+var _ v1.Layer = (*StreamLayer)(nil)
+
+// NewStreamLayer returns a StreamLayer reading uncompressed tar from blob,
+// which it closes once read.
+func NewStreamLayer(blob io.ReadCloser) *StreamLayer {
+	return &StreamLayer{blob: blob}
+}
+
+// Digest implements v1.Layer.
+func (l *StreamLayer) Digest() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		return v1.Hash{}, ErrNotComputed
+	}
+	return l.digest, nil
+}
+
+// DiffID implements v1.Layer.
+func (l *StreamLayer) DiffID() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		return v1.Hash{}, ErrNotComputed
+	}
+	return l.diffID, nil
+}
+
+// Size implements v1.Layer.
+func (l *StreamLayer) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		return 0, ErrNotComputed
+	}
+	return l.size, nil
+}
+
+// Uncompressed implements v1.Layer. It is not supported.
+func (l *StreamLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.New("a StreamLayer can only be read compressed")
+}
+
+// Compressed implements v1.Layer. It returns the gzipped stream, which can
+// only be read once.
+func (l *StreamLayer) Compressed() (io.ReadCloser, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.consumed {
+		return nil, ErrConsumed
+	}
+	l.consumed = true
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(l.compress(pw))
+	}()
+	return &streamReader{pr: pr, done: done}, nil
+}
+
+// compress writes the gzipped stream to w, and records its digest, diff id
+// and size once it is complete. It closes the blob once done with it.
+func (l *StreamLayer) compress(w io.Writer) error {
+	defer l.blob.Close()
+	diffID := sha256.New()
+	digest := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(w, digest)}
+	zw := gzip.NewWriter(cw)
+	if _, err := io.Copy(io.MultiWriter(zw, diffID), l.blob); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.digest = sha256Hash(digest)
+	l.diffID = sha256Hash(diffID)
+	l.size = cw.n
+	l.done = true
+	return nil
+}
+
+func sha256Hash(h hash.Hash) v1.Hash {
+	return v1.Hash{
+		Algorithm: "sha256",
+		Hex:       hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// streamReader reads the compressed stream of a StreamLayer. Closing it
+// stops the compression early, and waits for it to be done with the blob.
+type streamReader struct {
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+func (r *streamReader) Close() error {
+	err := r.pr.Close()
+	<-r.done
+	return err
+}
+
+// streamingImage is the result of appending layers, such as StreamLayers,
+// whose digests aren't known until they have been read. It lists its layers
+// right away, so that they can be written out, but only computes its
+// manifest and config file once every layer has been read.
+type streamingImage struct {
+	base v1.Image
+	opts *AppendOptions
+	adds []Addendum
+
+	mu       sync.Mutex
+	computed v1.Image
+}
+
+var _ v1.Image = (*streamingImage)(nil)
+
+// hasUncomputedLayer reports whether any of adds is a layer whose diff id
+// isn't known yet.
+func hasUncomputedLayer(adds []Addendum) bool {
+	for _, add := range adds {
+		if _, err := add.Layer.DiffID(); err == ErrNotComputed {
+			return true
+		}
+	}
+	return false
+}
+
+// compute returns the image with the adds appended, or ErrNotComputed if
+// some of them haven't been read yet.
+func (i *streamingImage) compute() (v1.Image, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.computed != nil {
+		return i.computed, nil
+	}
+	if hasUncomputedLayer(i.adds) {
+		return nil, ErrNotComputed
+	}
+	img, err := AppendWithOptions(i.base, i.opts, i.adds...)
+	if err != nil {
+		return nil, err
+	}
+	i.computed = img
+	return img, nil
+}
+
+// Layers implements v1.Image. Unlike the rest of its methods, it doesn't
+// wait for the layers to be read.
+func (i *streamingImage) Layers() ([]v1.Layer, error) {
+	if img, err := i.compute(); err == nil {
+		return img.Layers()
+	}
+	ls, err := i.base.Layers()
+	if err != nil {
+		return nil, err
+	}
+	ls = append([]v1.Layer(nil), ls...)
+	for _, add := range i.adds {
+		ls = append(ls, add.Layer)
+	}
+	return ls, nil
+}
+
+// MediaType implements v1.Image.
+func (i *streamingImage) MediaType() (types.MediaType, error) {
+	if img, err := i.compute(); err == nil {
+		return img.MediaType()
+	}
+	return i.base.MediaType()
+}
+
+// BlobSet implements v1.Image.
+func (i *streamingImage) BlobSet() (map[v1.Hash]struct{}, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.BlobSet()
+}
+
+// ConfigName implements v1.Image.
+func (i *streamingImage) ConfigName() (v1.Hash, error) {
+	img, err := i.compute()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.ConfigName()
+}
+
+// ConfigFile implements v1.Image.
+func (i *streamingImage) ConfigFile() (*v1.ConfigFile, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.ConfigFile()
+}
+
+// RawConfigFile implements v1.Image.
+func (i *streamingImage) RawConfigFile() ([]byte, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawConfigFile()
+}
+
+// Digest implements v1.Image.
+func (i *streamingImage) Digest() (v1.Hash, error) {
+	img, err := i.compute()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.Digest()
+}
+
+// Manifest implements v1.Image.
+func (i *streamingImage) Manifest() (*v1.Manifest, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.Manifest()
+}
+
+// RawManifest implements v1.Image.
+func (i *streamingImage) RawManifest() ([]byte, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawManifest()
+}
+
+// LayerByDigest implements v1.Image.
+func (i *streamingImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.LayerByDigest(h)
+}
+
+// LayerByDiffID implements v1.Image.
+func (i *streamingImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.LayerByDiffID(h)
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/name"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/random"
+	"github.com/google/go-containerregistry/v1/tarball"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// streamLayer returns a StreamLayer of a single file, along with its
+// uncompressed contents.
+func streamLayer(t *testing.T) (*StreamLayer, []byte) {
+	rc, err := tarLayer(t, regularFile("app", "app")).Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed: %v", err)
+	}
+	contents, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return NewStreamLayer(ioutil.NopCloser(bytes.NewReader(contents))), contents
+}
+
+func TestStreamLayer(t *testing.T) {
+	layer, contents := streamLayer(t)
+
+	if _, err := layer.Digest(); err != ErrNotComputed {
+		t.Errorf("Digest before reading: got %v, want ErrNotComputed", err)
+	}
+	if _, err := layer.DiffID(); err != ErrNotComputed {
+		t.Errorf("DiffID before reading: got %v, want ErrNotComputed", err)
+	}
+	if _, err := layer.Size(); err != ErrNotComputed {
+		t.Errorf("Size before reading: got %v, want ErrNotComputed", err)
+	}
+
+	img, err := Append(empty.Image, Addendum{Layer: layer, History: v1.History{CreatedBy: "stream"}})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := img.Manifest(); err != ErrNotComputed {
+		t.Errorf("Manifest before reading: got %v, want ErrNotComputed", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	if len(layers) != 1 || layers[0] != v1.Layer(layer) {
+		t.Fatalf("Layers = %v, want the stream layer", layers)
+	}
+
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	compressed, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := layer.Compressed(); err != ErrConsumed {
+		t.Errorf("Compressed again: got %v, want ErrConsumed", err)
+	}
+
+	digest, size, err := v1.SHA256(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("SHA256: %v", err)
+	}
+	diffID, _, err := v1.SHA256(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatalf("SHA256: %v", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if got := m.Layers[0]; got.Digest != digest || got.Size != size {
+		t.Errorf("manifest layer = %v, %d; want %v, %d", got.Digest, got.Size, digest, size)
+	}
+	cf := getConfigFile(t, img)
+	if diff := cmp.Diff(cf.RootFS.DiffIDs, []v1.Hash{diffID}); diff != "" {
+		t.Errorf("DiffIDs (-got, +want) %s", diff)
+	}
+	if got, want := cf.History[0].CreatedBy, "stream"; got != want {
+		t.Errorf("History[0].CreatedBy = %q, want %q", got, want)
+	}
+}
+
+func TestStreamLayerTarball(t *testing.T) {
+	layer, contents := streamLayer(t)
+	img, err := Append(empty.Image, Addendum{Layer: layer})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	tag, err := name.NewTag("gcr.io/foo/bar:latest", name.StrictValidation)
+	if err != nil {
+		t.Fatalf("NewTag: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tarball.Write(tag, img, nil, &buf); err != nil {
+		t.Fatalf("tarball.Write: %v", err)
+	}
+
+	got, err := tarball.Image(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}, &tag)
+	if err != nil {
+		t.Fatalf("tarball.Image: %v", err)
+	}
+	gotConfig, err := got.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	wantConfig, err := img.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	if gotConfig != wantConfig {
+		t.Errorf("ConfigName = %v, want %v", gotConfig, wantConfig)
+	}
+
+	layers, err := got.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("len(Layers) = %d, want 1", len(layers))
+	}
+	gotDigest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	wantDigest, err := layer.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if gotDigest != wantDigest {
+		t.Errorf("layer Digest = %v, want %v", gotDigest, wantDigest)
+	}
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed: %v", err)
+	}
+	defer rc.Close()
+	gotContents, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(gotContents, contents) {
+		t.Error("layer contents differ from the stream")
+	}
+}
+
+func TestStreamLayerOCI(t *testing.T) {
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	oci, err := MediaType(base, types.OCIManifestSchema1)
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	layer, _ := streamLayer(t)
+	img, err := AppendWithOptions(oci, &AppendOptions{ValidateMediaTypes: true}, Addendum{Layer: layer})
+	if err != nil {
+		t.Fatalf("AppendWithOptions: %v", err)
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	rc.Close()
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if got, want := m.Layers[len(m.Layers)-1].MediaType, types.OCILayer; got != want {
+		t.Errorf("MediaType = %v, want %v", got, want)
+	}
+}
+
+func TestStreamLayerValidation(t *testing.T) {
+	oci, err := MediaType(empty.Image, types.OCIManifestSchema1)
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	layer, _ := streamLayer(t)
+	opts := &AppendOptions{ValidateMediaTypes: true}
+	if _, err := AppendWithOptions(oci, opts, Addendum{Layer: layer, MediaType: types.DockerLayer}); err == nil {
+		t.Error("AppendWithOptions of a Docker layer to an OCI image: got nil, want error")
+	}
+
+	opts = &AppendOptions{OnWhiteoutOnly: func(int, v1.Descriptor) {}}
+	if _, err := AppendWithOptions(empty.Image, opts, Addendum{Layer: layer}); err == nil {
+		t.Error("AppendWithOptions with OnWhiteoutOnly: got nil, want error")
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestStreamLayerClose(t *testing.T) {
+	_, contents := streamLayer(t)
+
+	blob := &closeRecorder{Reader: bytes.NewReader(contents)}
+	rc, err := NewStreamLayer(blob).Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if !blob.closed {
+		t.Error("blob still open once the stream was read")
+	}
+	rc.Close()
+
+	blob = &closeRecorder{Reader: bytes.NewReader(contents)}
+	if rc, err = NewStreamLayer(blob).Compressed(); err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !blob.closed {
+		t.Error("blob still open once the stream was closed")
+	}
+}
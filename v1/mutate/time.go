@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/tarball"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// Time returns a copy of img in which every timestamp is t, for reproducible
+// builds: the creation time of the config and of each history entry, and the
+// modification time of every entry of every layer.
+//
+// Rewriting the layers changes their diff ids and digests, which are
+// recomputed as Append does. Layers are read uncompressed, whether or not
+// they are stored compressed, and recompressed with gzip; their descriptors
+// keep their annotations, and a media type of the same kind, e.g.
+// types.OCILayer for an uncompressed OCI layer.
+func Time(img v1.Image, t time.Time) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	descriptors := m.Layers
+	if len(descriptors) != len(layers) {
+		return nil, fmt.Errorf("image has %d layers, but its manifest has %d", len(layers), len(descriptors))
+	}
+	m.Layers = nil
+	cf = cf.DeepCopy()
+	cf.Created = v1.Time{Time: t}
+	for i := range cf.History {
+		cf.History[i].Created = v1.Time{Time: t}
+	}
+	history := cf.History
+	cf.RootFS.DiffIDs = nil
+	cf.History = nil
+
+	result, err := configFile(empty.Image, m, cf)
+	if err != nil {
+		return nil, err
+	}
+	adds := make([]Addendum, 0, len(layers))
+	for i, layer := range layers {
+		layer, err := timeLayer(layer, t)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, Addendum{
+			Layer:       layer,
+			MediaType:   gzipLayerType(m.MediaType, descriptors[i].MediaType),
+			Annotations: descriptors[i].Annotations,
+			// Non-empty, so that Append leaves it alone; it is
+			// replaced by the original history below.
+			History: v1.History{Created: v1.Time{Time: t}},
+		})
+	}
+	if result, err = Append(result, adds...); err != nil {
+		return nil, err
+	}
+
+	// The original history may contain entries for empty layers, so it
+	// can only be put back once every layer has been appended.
+	if m, err = result.Manifest(); err != nil {
+		return nil, err
+	}
+	if cf, err = result.ConfigFile(); err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.History = history
+	return configFile(result, m, cf)
+}
+
+// gzipLayerTypes maps layer media types to that of the same kind of layer
+// once recompressed with gzip. Foreign layers become regular ones, since
+// their rewritten contents aren't found at their URLs.
+var gzipLayerTypes = map[types.MediaType]types.MediaType{
+	types.DockerLayer:                    types.DockerLayer,
+	types.DockerUncompressedLayer:        types.DockerLayer,
+	types.DockerForeignLayer:             types.DockerLayer,
+	types.OCILayer:                       types.OCILayer,
+	types.OCIUncompressedLayer:           types.OCILayer,
+	types.OCIRestrictedLayer:             types.OCILayer,
+	types.OCIUncompressedRestrictedLayer: types.OCILayer,
+}
+
+// gzipLayerType returns the media type of a layer of type mt, in a manifest
+// of type manifestType, once recompressed with gzip. Unknown layer types get
+// the gzip layer type of the manifest's kind.
+func gzipLayerType(manifestType, mt types.MediaType) types.MediaType {
+	if gz, ok := gzipLayerTypes[mt]; ok {
+		return gz
+	}
+	if manifestType == types.OCIManifestSchema1 {
+		return types.OCILayer
+	}
+	return types.DockerLayer
+}
+
+// timeLayer returns a copy of layer in which the modification time of every
+// entry is t.
+func timeLayer(layer v1.Layer, t time.Time) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			defer rc.Close()
+			pw.CloseWithError(rewriteModTimes(rc, pw, t))
+		}()
+		return pr, nil
+	})
+}
+
+// rewriteModTimes copies the tar archive in r to w, setting the modification
+// time of every entry to t.
+func rewriteModTimes(r io.Reader, w io.Writer, t time.Time) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		header.ModTime = t
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		if err := writeTarEntry(tw, header, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Canonical returns a copy of img whose config is stripped of the fields that
+// record how and when it was built rather than what it contains, so that
+// functionally identical images have the same digest: the creation time,
+// container, container config and docker version, and the creation time,
+// command and author of each history entry.
+//
+// The layers are left untouched, including the timestamps of their entries;
+// compose Canonical with Time to normalize those too.
+func Canonical(img v1.Image) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.Created = v1.Time{}
+	cf.Container = ""
+	cf.ContainerConfig = v1.Config{}
+	cf.DockerVersion = ""
+	for i := range cf.History {
+		cf.History[i].Created = v1.Time{}
+		cf.History[i].CreatedBy = ""
+		cf.History[i].Author = ""
+	}
+	return configFile(img, m, cf)
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/tarball"
+	"github.com/google/go-containerregistry/v1/types"
+)
+
+// gzipLayer returns a layer whose contents are stored gzip-compressed.
+func gzipLayer(t *testing.T, files ...testFile) v1.Layer {
+	t.Helper()
+
+	rc, err := tarLayer(t, files...).Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed: %v", err)
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, rc); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatalf("LayerFromOpener: %v", err)
+	}
+	return layer
+}
+
+func TestTime(t *testing.T) {
+	older := regularFile("a", "a")
+	older.hdr.ModTime = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := regularFile("b", "b")
+	newer.hdr.ModTime = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	img, err := Append(imageFromLayers(t),
+		Addendum{Layer: tarLayer(t, older), History: v1.History{CreatedBy: "ADD a", Created: v1.Time{Time: time.Now()}}},
+		Addendum{Layer: gzipLayer(t, newer), History: v1.History{CreatedBy: "ADD b", Created: v1.Time{Time: time.Now()}}},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	cf := getConfigFile(t, img).DeepCopy()
+	cf.History = append(cf.History, v1.History{CreatedBy: "ENV x=y", EmptyLayer: true, Created: v1.Time{Time: time.Now()}})
+	img, err = configFile(img, getManifest(t, img), cf)
+	if err != nil {
+		t.Fatalf("configFile: %v", err)
+	}
+
+	epoch := time.Unix(0, 0).UTC()
+	result, err := Time(img, epoch)
+	if err != nil {
+		t.Fatalf("Time: %v", err)
+	}
+
+	rcf := getConfigFile(t, result)
+	if !rcf.Created.Time.Equal(epoch) {
+		t.Errorf("Created = %v, want %v", rcf.Created, epoch)
+	}
+	if got, want := len(rcf.History), 3; got != want {
+		t.Fatalf("len(History) = %d, want %d", got, want)
+	}
+	for i, h := range rcf.History {
+		if !h.Created.Time.Equal(epoch) || h.CreatedBy != cf.History[i].CreatedBy || h.EmptyLayer != cf.History[i].EmptyLayer {
+			t.Errorf("History[%d] = %v, want %v at %v", i, h, cf.History[i], epoch)
+		}
+	}
+
+	headers, _ := readEntries(t, Extract(result))
+	if len(headers) != 2 {
+		t.Fatalf("got %d entries, want 2", len(headers))
+	}
+	for _, hdr := range headers {
+		if !hdr.ModTime.Equal(epoch) {
+			t.Errorf("%s ModTime = %v, want %v", hdr.Name, hdr.ModTime, epoch)
+		}
+	}
+
+	// The rewritten layers are consistent with the manifest and config.
+	layers, err := result.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	m := getManifest(t, result)
+	for i, l := range layers {
+		diffID, err := l.DiffID()
+		if err != nil {
+			t.Fatalf("DiffID: %v", err)
+		}
+		digest, err := l.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		if diffID != rcf.RootFS.DiffIDs[i] || digest != m.Layers[i].Digest {
+			t.Errorf("layer %d: diff id %v and digest %v don't match the image", i, diffID, digest)
+		}
+	}
+	configName, err := result.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	if m.Config.Digest != configName {
+		t.Errorf("manifest config digest = %v, want %v", m.Config.Digest, configName)
+	}
+
+	// Timestamps are the only source of difference.
+	again, err := Time(img, epoch)
+	if err != nil {
+		t.Fatalf("Time: %v", err)
+	}
+	d1, err := result.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	d2, err := again.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if d1 != d2 {
+		t.Errorf("Time is not reproducible: %v != %v", d1, d2)
+	}
+}
+
+func TestTimeOCI(t *testing.T) {
+	base, err := MediaType(imageFromLayers(t, tarLayer(t, regularFile("a", "a"))), types.OCIManifestSchema1)
+	if err != nil {
+		t.Fatalf("MediaType: %v", err)
+	}
+	anns := map[string]string{"com.example.layer": "b"}
+	img, err := Append(base, Addendum{
+		Layer:       tarLayer(t, regularFile("b", "b")),
+		MediaType:   types.OCIUncompressedLayer,
+		Annotations: anns,
+	})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	result, err := Time(img, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("Time: %v", err)
+	}
+	m := getManifest(t, result)
+	if got, want := m.MediaType, types.OCIManifestSchema1; got != want {
+		t.Errorf("MediaType = %q, want %q", got, want)
+	}
+	for i, l := range m.Layers {
+		if got, want := l.MediaType, types.OCILayer; got != want {
+			t.Errorf("layer %d MediaType = %q, want %q", i, got, want)
+		}
+	}
+	if diff := cmp.Diff(m.Layers[1].Annotations, anns); diff != "" {
+		t.Errorf("layer annotations (-got, +want) %s", diff)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	layer := tarLayer(t, regularFile("a", "a"))
+	build := func(when time.Time, by string) v1.Image {
+		img, err := Append(imageFromLayers(t), Addendum{
+			Layer: layer,
+			History: v1.History{
+				Author:    by,
+				Created:   v1.Time{Time: when},
+				CreatedBy: "COPY a / # " + by,
+				Comment:   "kept",
+			},
+		})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		cf := getConfigFile(t, img).DeepCopy()
+		cf.Created = v1.Time{Time: when}
+		cf.Container = by
+		cf.ContainerConfig = v1.Config{Hostname: by}
+		cf.DockerVersion = "18.0" + by
+		cf.Config = v1.Config{Cmd: []string{"/a"}}
+		img, err = configFile(img, getManifest(t, img), cf)
+		if err != nil {
+			t.Fatalf("configFile: %v", err)
+		}
+		return img
+	}
+	one, err := Canonical(build(time.Now(), "1"))
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	two, err := Canonical(build(time.Now().Add(time.Hour), "2"))
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+
+	d1, err := one.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	d2, err := two.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if d1 != d2 {
+		t.Errorf("Canonical digests differ: %v != %v", d1, d2)
+	}
+
+	cf := getConfigFile(t, one)
+	want := []v1.History{{Comment: "kept"}}
+	if diff := cmp.Diff(cf.History, want); diff != "" {
+		t.Errorf("History (-got, +want) %s", diff)
+	}
+	if diff := cmp.Diff(cf.Config, v1.Config{Cmd: []string{"/a"}}); diff != "" {
+		t.Errorf("Config (-got, +want) %s", diff)
+	}
+	configName, err := one.ConfigName()
+	if err != nil {
+		t.Fatalf("ConfigName: %v", err)
+	}
+	if got := getManifest(t, one).Config.Digest; got != configName {
+		t.Errorf("manifest config digest = %v, want %v", got, configName)
+	}
+
+	// Layers are untouched.
+	want1, err := layer.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if got := getManifest(t, one).Layers[0].Digest; got != want1 {
+		t.Errorf("layer digest = %v, want %v", got, want1)
+	}
+}
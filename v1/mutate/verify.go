@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// AnomalyKind is the kind of problem that VerifyRootFS found.
+type AnomalyKind string
+
+const (
+	// DanglingSymlink is a symlink whose target doesn't exist, or that
+	// leads to too many other symlinks.
+	DanglingSymlink AnomalyKind = "dangling symlink"
+
+	// MissingLinkTarget is a hardlink whose target doesn't exist.
+	MissingLinkTarget AnomalyKind = "hardlink to missing target"
+
+	// UselessWhiteout is a whiteout of a file that no lower layer has.
+	UselessWhiteout AnomalyKind = "whiteout of missing file"
+)
+
+// Anomaly is a problem found in the flattened filesystem of an image.
+type Anomaly struct {
+	Kind AnomalyKind
+
+	// Layer is the index of the layer with the offending entry, and Path
+	// the cleaned name of the entry or, for whiteouts, of the file that
+	// it deletes.
+	Layer int
+	Path  string
+
+	// Target is the target of links, as recorded in the entry.
+	Target string
+}
+
+func (a Anomaly) String() string {
+	if a.Target != "" {
+		return fmt.Sprintf("layer %d: %s %s -> %s", a.Layer, a.Kind, a.Path, a.Target)
+	}
+	return fmt.Sprintf("layer %d: %s %s", a.Layer, a.Kind, a.Path)
+}
+
+// RootFSError is returned by VerifyRootFS, listing what it found.
+type RootFSError struct {
+	Anomalies []Anomaly
+}
+
+func (e *RootFSError) Error() string {
+	msgs := make([]string, len(e.Anomalies))
+	for i, a := range e.Anomalies {
+		msgs[i] = a.String()
+	}
+	return fmt.Sprintf("root filesystem has %d anomalies: %s", len(e.Anomalies), strings.Join(msgs, "; "))
+}
+
+// VerifyRootFS flattens img the way Extract does, and returns a *RootFSError
+// if its filesystem has dangling symlinks, hardlinks to missing targets, or
+// whiteouts of files that no lower layer has. These are harmless to most
+// runtimes, but usually point at a bug in the tool that built img.
+func VerifyRootFS(img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("retrieving image layers: %w", err)
+	}
+
+	var (
+		layer     int
+		entries   = map[string]*tar.Header{}
+		layerOf   = map[string]int{}
+		whiteouts = map[string]int{}
+	)
+	f := newFlattener(context.Background(), &ExtractOptions{})
+	f.onWhiteout = func(name string) {
+		whiteouts[name] = layer
+	}
+	f.onShadowed = func(name string) {
+		// Hiding anything at or under a whiteout's name justifies it.
+		for p := name; p != "."; p = path.Dir(p) {
+			delete(whiteouts, p)
+		}
+	}
+	for layer = len(layers) - 1; layer >= 0; layer-- {
+		if err := f.flattenLayer(layer, layers[layer], func(header *tar.Header, _ io.Reader) error {
+			name := cleanPath(header.Name)
+			entries[name] = header
+			layerOf[name] = layer
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Directories can be implied by the files in them.
+	exists := map[string]bool{"": true}
+	for name := range entries {
+		for p := name; p != "." && !exists[p]; p = path.Dir(p) {
+			exists[p] = true
+		}
+	}
+
+	var anomalies []Anomaly
+	for name, header := range entries {
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			target := header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			if resolved, ok := resolveSymlinks(entries, target); !ok || !exists[resolved] {
+				anomalies = append(anomalies, Anomaly{Kind: DanglingSymlink, Layer: layerOf[name], Path: name, Target: header.Linkname})
+			}
+		case tar.TypeLink:
+			if _, ok := entries[cleanPath(header.Linkname)]; !ok {
+				anomalies = append(anomalies, Anomaly{Kind: MissingLinkTarget, Layer: layerOf[name], Path: name, Target: header.Linkname})
+			}
+		}
+	}
+	for name, layer := range whiteouts {
+		anomalies = append(anomalies, Anomaly{Kind: UselessWhiteout, Layer: layer, Path: name})
+	}
+	if len(anomalies) == 0 {
+		return nil
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].Path != anomalies[j].Path {
+			return anomalies[i].Path < anomalies[j].Path
+		}
+		return anomalies[i].Kind < anomalies[j].Kind
+	})
+	return &RootFSError{Anomalies: anomalies}
+}
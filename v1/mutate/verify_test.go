@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVerifyRootFS(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("etc/passwd", "root"),
+			regularFile("usr/bin/sh", "sh"),
+			regularFile("var/cache/apt/pkgcache.bin", "cache"),
+		),
+		tarLayer(t,
+			regularFile("etc/.wh.passwd", ""),
+			regularFile("var/.wh.cache", ""),
+			symlink("bin", "usr/bin"),
+			symlink("usr/local/bin/sh", "/bin/sh"),
+			symlink("root", "/"),
+			hardlink("usr/bin/bash", "usr/bin/sh"),
+		),
+	)
+	if err := VerifyRootFS(img); err != nil {
+		t.Errorf("VerifyRootFS: %v", err)
+	}
+}
+
+func TestVerifyRootFSAnomalies(t *testing.T) {
+	img := imageFromLayers(t,
+		tarLayer(t,
+			regularFile("etc/passwd", "root"),
+			regularFile("etc/shadow", "root"),
+		),
+		tarLayer(t,
+			regularFile("etc/.wh.group", ""),
+			regularFile("etc/.wh.shadow", ""),
+			symlink("etc/mtab", "/proc/mounts"),
+			symlink("loop/a", "b"),
+			symlink("loop/b", "a"),
+			hardlink("etc/passwd-", "etc/shadow"),
+			hardlink("etc/passwd.bak", "etc/passwd"),
+		),
+	)
+	err := VerifyRootFS(img)
+	rerr, ok := err.(*RootFSError)
+	if !ok {
+		t.Fatalf("VerifyRootFS: got %v, want a *RootFSError", err)
+	}
+	want := []Anomaly{
+		{Kind: UselessWhiteout, Layer: 1, Path: "etc/group"},
+		{Kind: DanglingSymlink, Layer: 1, Path: "etc/mtab", Target: "/proc/mounts"},
+		{Kind: MissingLinkTarget, Layer: 1, Path: "etc/passwd-", Target: "etc/shadow"},
+		{Kind: DanglingSymlink, Layer: 1, Path: "loop/a", Target: "b"},
+		{Kind: DanglingSymlink, Layer: 1, Path: "loop/b", Target: "a"},
+	}
+	if diff := cmp.Diff(rerr.Anomalies, want); diff != "" {
+		t.Errorf("VerifyRootFS anomalies (-got, +want) %s", diff)
+	}
+	if got, want := want[0].String(), "layer 1: whiteout of missing file etc/group"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/v1"
+)
+
+// zipModTime is the modification time of every entry written by
+// ExtractZipReproducible: the earliest time zip files can represent.
+var zipModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ExtractZipReproducible returns a zip archive of img's flattened filesystem,
+// which is byte for byte the same for images with the same files, however
+// they are split across layers and whenever they were built.
+//
+// To that end, entries are sorted by path, every modification time is set to
+// 1980-01-01T00:00:00Z, and only the permission bits of the modes are kept,
+// zip having no notion of owners. Directories are stored with a trailing
+// slash, symlinks as entries whose contents are their target, and hardlinks as
+// copies of their target, since zip has no hardlinks. Other special files,
+// such as devices, are left out.
+//
+// The flattened filesystem is spooled to a temporary file to sort it.
+func ExtractZipReproducible(img v1.Image) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(extractZip(img, pw))
+	}()
+	return pr
+}
+
+func extractZip(img v1.Image, w io.Writer) error {
+	sp, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	if err := flattenImage(context.Background(), img, &ExtractOptions{}, sp.add); err != nil {
+		return err
+	}
+
+	entries := make(map[string]spoolEntry, len(sp.entries))
+	names := make([]string, 0, len(sp.entries))
+	for _, e := range sp.entries {
+		name := cleanPath(e.header.Name)
+		if name == "" {
+			continue
+		}
+		switch e.header.Typeflag {
+		case tar.TypeDir:
+			name += "/"
+		case tar.TypeReg, tar.TypeRegA, tar.TypeLink, tar.TypeSymlink:
+		default:
+			continue
+		}
+		entries[name] = e
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		e := entries[name]
+		fh := &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: zipModTime,
+		}
+		var r io.Reader = strings.NewReader("")
+		switch e.header.Typeflag {
+		case tar.TypeSymlink:
+			r = strings.NewReader(e.header.Linkname)
+		case tar.TypeLink:
+			target, ok := linkTarget(entries, e)
+			if ok {
+				r = sp.contents(target)
+			}
+			fh.Method = zip.Deflate
+		case tar.TypeReg, tar.TypeRegA:
+			r = sp.contents(e)
+			fh.Method = zip.Deflate
+		}
+		fh.SetMode(e.header.FileInfo().Mode())
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, r); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// linkTarget returns the regular file that the hardlink e refers to, through
+// any chain of hardlinks.
+func linkTarget(entries map[string]spoolEntry, e spoolEntry) (spoolEntry, bool) {
+	for i := 0; i < len(entries) && e.header.Typeflag == tar.TypeLink; i++ {
+		target, ok := entries[cleanPath(e.header.Linkname)]
+		if !ok {
+			return spoolEntry{}, false
+		}
+		e = target
+	}
+	return e, e.header.Typeflag != tar.TypeLink
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// withModTime returns file with its modification time set to t.
+func withModTime(file testFile, t time.Time) testFile {
+	file.hdr.ModTime = t
+	return file
+}
+
+func readZip(t *testing.T, b []byte) []string {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	var listing []string
+	for _, f := range zr.File {
+		if !f.Modified.Equal(zipModTime) {
+			t.Errorf("%s modified at %v, want %v", f.Name, f.Modified, zipModTime)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open(%s): %v", f.Name, err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll(%s): %v", f.Name, err)
+		}
+		listing = append(listing, fmt.Sprintf("%s %v %q", f.Name, f.Mode(), contents))
+	}
+	return listing
+}
+
+func TestExtractZipReproducible(t *testing.T) {
+	then := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	img := imageFromLayers(t,
+		tarLayer(t,
+			withModTime(directory("usr/"), then),
+			withModTime(directory("usr/bin/"), then),
+			withModTime(regularFile("usr/bin/tool", "tool"), then),
+			withModTime(regularFile("removed", "removed"), then),
+		),
+		tarLayer(t,
+			withModTime(regularFile("usr/bin/tool", "new tool"), then),
+			withModTime(hardlink("usr/bin/alias", "usr/bin/tool"), then),
+			withModTime(symlink("bin", "usr/bin"), then),
+			withModTime(regularFile("a-file", "a"), then),
+			regularFile(".wh.removed", ""),
+		),
+	)
+	// The same files, in one layer, in another order, at another time.
+	now := time.Now()
+	same := imageFromLayers(t,
+		tarLayer(t,
+			withModTime(symlink("bin", "usr/bin"), now),
+			withModTime(regularFile("a-file", "a"), now),
+			withModTime(directory("usr/"), now),
+			withModTime(directory("usr/bin/"), now),
+			withModTime(regularFile("usr/bin/alias", "new tool"), now),
+			withModTime(regularFile("usr/bin/tool", "new tool"), now),
+		),
+	)
+
+	got, err := ioutil.ReadAll(ExtractZipReproducible(img))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	// Golden listing of the archive.
+	want := []string{
+		`a-file -rw-r--r-- "a"`,
+		`bin Lrwxrwxrwx "usr/bin"`,
+		`usr/ drwxr-xr-x ""`,
+		`usr/bin/ drwxr-xr-x ""`,
+		`usr/bin/alias -rw-r--r-- "new tool"`,
+		`usr/bin/tool -rw-r--r-- "new tool"`,
+	}
+	if diff := cmp.Diff(readZip(t, got), want); diff != "" {
+		t.Errorf("ExtractZipReproducible (-got, +want) %s", diff)
+	}
+
+	again, err := ioutil.ReadAll(ExtractZipReproducible(same))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, again) {
+		t.Error("ExtractZipReproducible is not byte for byte the same for the same files")
+	}
+}
+
+func TestExtractZipReproducibleSkipsSpecialFiles(t *testing.T) {
+	img := imageFromLayers(t, tarLayer(t,
+		regularFile("file", "file"),
+		testFile{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testFile{hdr: tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}},
+	))
+
+	got, err := ioutil.ReadAll(ExtractZipReproducible(img))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if diff := cmp.Diff(readZip(t, got), []string{`file -rw-r--r-- "file"`}); diff != "" {
+		t.Errorf("ExtractZipReproducible (-got, +want) %s", diff)
+	}
+}
@@ -15,9 +15,16 @@
 package partial
 
 import (
+	"errors"
+
 	"github.com/google/go-containerregistry/v1/types"
 )
 
+// ErrNotComputed is returned by the methods of a layer, and of an image built
+// from it, whose values are only known once the layer has been read, such as
+// a mutate.StreamLayer. Writers read such layers before the rest of the image.
+var ErrNotComputed = errors.New("value not computed until the stream is consumed")
+
 // imageCore is the core set of properties without which we cannot build a v1.Image
 type imageCore interface {
 	// RawConfigFile returns the serialized bytes of this image's config file.
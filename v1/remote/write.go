@@ -25,6 +25,7 @@ import (
 	"github.com/google/go-containerregistry/authn"
 	"github.com/google/go-containerregistry/name"
 	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/partial"
 	"github.com/google/go-containerregistry/v1/remote/transport"
 )
 
@@ -56,24 +57,68 @@ func Write(ref name.Reference, img v1.Image, auth authn.Authenticator, t http.Ro
 		options: wo,
 	}
 
+	// Layers that only know their digests once they have been read, such
+	// as a mutate.StreamLayer, are uploaded first, since the rest of the
+	// image, starting with its BlobSet(), depends on them.
+	ls, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	var streamed []v1.Layer
+	for _, l := range ls {
+		if _, err := l.Digest(); err == partial.ErrNotComputed {
+			streamed = append(streamed, l)
+		}
+	}
+	if err := uploadAll(len(streamed), func(i int) error {
+		return w.uploadStream(streamed[i])
+	}); err != nil {
+		return err
+	}
+
 	bs, err := img.BlobSet()
 	if err != nil {
 		return err
 	}
+	// The streamed layers are already uploaded, and can't be read again.
+	for _, l := range streamed {
+		h, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		delete(bs, h)
+	}
+	var blobs []v1.Hash
+	for h := range bs {
+		blobs = append(blobs, h)
+	}
+	if err := uploadAll(len(blobs), func(i int) error {
+		return w.uploadOne(blobs[i])
+	}); err != nil {
+		return err
+	}
 
-	// Spin up go routines to publish each of the members of BlobSet(),
-	// and use an error channel to collect their results.
+	// With all of the constituent elements uploaded, upload the manifest
+	// to commit the image.
+	return w.commitImage()
+}
+
+// uploadAll calls upload with each index up to n, in parallel, and returns
+// the first error encountered once they have all completed.
+func uploadAll(n int, upload func(int) error) error {
+	// Spin up go routines to publish each of the blobs, and use an error
+	// channel to collect their results.
 	errCh := make(chan error)
 	defer close(errCh)
-	for h := range bs {
-		go func(h v1.Hash) {
-			errCh <- w.uploadOne(h)
-		}(h)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errCh <- upload(i)
+		}(i)
 	}
 
 	// Now wait for all of the blob uploads to complete.
 	var errors []error
-	for _ = range bs {
+	for i := 0; i < n; i++ {
 		if err := <-errCh; err != nil {
 			errors = append(errors, err)
 		}
@@ -82,10 +127,7 @@ func Write(ref name.Reference, img v1.Image, auth authn.Authenticator, t http.Ro
 		// Return the first error we encountered.
 		return errors[0]
 	}
-
-	// With all of the constituent elements uploaded, upload the manifest
-	// to commit the image.
-	return w.commitImage()
+	return nil
 }
 
 // writer writes the elements of an image to a remote image reference.
@@ -126,24 +168,26 @@ func (w *writer) nextLocation(resp *http.Response) (string, error) {
 // which that layer might be read. On failure, an error is returned.
 // On success, the layer was either mounted (nothing more to do) or a blob
 // upload was initiated and the body of that blob should be sent to the returned
-// location.
+// location. A zero h, for a blob whose hash isn't known yet, skips the mount.
 func (w *writer) initiateUpload(h v1.Hash) (location string, mounted bool, err error) {
 	u := w.url(fmt.Sprintf("/v2/%s/blobs/uploads/", w.ref.Context().RepositoryStr()))
-	uv := url.Values{
-		"mount": []string{h.String()},
-	}
-	var from []string
-	for _, m := range w.options.MountPaths {
-		from = append(from, m.RepositoryStr())
-	}
-	// We currently avoid HEAD because it's semi-redundant with the mount that is part
-	// of initiating the blob upload.  GCR will perform an existence check on the initiation
-	// if "mount" is specified, even if no "from" sources are specified.  If this turns out
-	// to not be broadly applicable then we should replace mounts without "from"s with a HEAD.
-	if len(from) > 0 {
-		uv["from"] = from
+	if h != (v1.Hash{}) {
+		uv := url.Values{
+			"mount": []string{h.String()},
+		}
+		var from []string
+		for _, m := range w.options.MountPaths {
+			from = append(from, m.RepositoryStr())
+		}
+		// We currently avoid HEAD because it's semi-redundant with the mount that is part
+		// of initiating the blob upload.  GCR will perform an existence check on the initiation
+		// if "mount" is specified, even if no "from" sources are specified.  If this turns out
+		// to not be broadly applicable then we should replace mounts without "from"s with a HEAD.
+		if len(from) > 0 {
+			uv["from"] = from
+		}
+		u.RawQuery = uv.Encode()
 	}
-	u.RawQuery = uv.Encode()
 
 	// Make the request to initiate the blob upload.
 	resp, err := w.client.Post(u.String(), "application/json", nil)
@@ -173,11 +217,7 @@ func (w *writer) initiateUpload(h v1.Hash) (location string, mounted bool, err e
 // streamBlob streams the contents of the blob to the specified location.
 // On failure, this will return an error.  On success, this will return the location
 // header indicating how to commit the streamed blob.
-func (w *writer) streamBlob(h v1.Hash, streamLocation string) (commitLocation string, err error) {
-	l, err := w.img.LayerByDigest(h)
-	if err != nil {
-		return "", err
-	}
+func (w *writer) streamBlob(l v1.Layer, streamLocation string) (commitLocation string, err error) {
 	blob, err := l.Compressed()
 	if err != nil {
 		return "", err
@@ -238,11 +278,39 @@ func (w *writer) uploadOne(h v1.Hash) error {
 		return nil
 	}
 
-	location, err = w.streamBlob(h, location)
+	l, err := w.img.LayerByDigest(h)
+	if err != nil {
+		return err
+	}
+	location, err = w.streamBlob(l, location)
+	if err != nil {
+		return err
+	}
+
+	if err := w.commitBlob(h, location); err != nil {
+		return err
+	}
+	log.Printf("pushed blob %v", h)
+	return nil
+}
+
+// uploadStream performs a complete upload of a layer whose digest is only
+// known once it has been read, so it can't be mounted.
+func (w *writer) uploadStream(l v1.Layer) error {
+	location, _, err := w.initiateUpload(v1.Hash{})
 	if err != nil {
 		return err
 	}
 
+	location, err = w.streamBlob(l, location)
+	if err != nil {
+		return err
+	}
+
+	h, err := l.Digest()
+	if err != nil {
+		return err
+	}
 	if err := w.commitBlob(h, location); err != nil {
 		return err
 	}
@@ -29,6 +29,8 @@ import (
 	"github.com/google/go-containerregistry/authn"
 	"github.com/google/go-containerregistry/name"
 	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/mutate"
 	"github.com/google/go-containerregistry/v1/random"
 	"github.com/google/go-containerregistry/v1/remote/transport"
 )
@@ -327,7 +329,11 @@ func TestStreamBlob(t *testing.T) {
 
 	streamLocation := w.url(expectedPath)
 
-	commitLocation, err := w.streamBlob(h, streamLocation.String())
+	l, err := img.LayerByDigest(h)
+	if err != nil {
+		t.Fatalf("LayerByDigest() = %v", err)
+	}
+	commitLocation, err := w.streamBlob(l, streamLocation.String())
 	if err != nil {
 		t.Errorf("streamBlob() = %v", err)
 	}
@@ -550,3 +556,79 @@ func TestWriteWithErrors(t *testing.T) {
 		t.Errorf("Write(); (-want +got) = %s", diff)
 	}
 }
+
+func TestWriteStreamLayer(t *testing.T) {
+	layer := mutate.NewStreamLayer(ioutil.NopCloser(bytes.NewReader([]byte("contents"))))
+	img, err := mutate.Append(empty.Image, mutate.Addendum{Layer: layer})
+	if err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	expectedRepo := "write/stream"
+	initiatePath := fmt.Sprintf("/v2/%s/blobs/uploads/", expectedRepo)
+	streamPath := "/upload/stream"
+	commitPath := "/upload/commit"
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/latest", expectedRepo)
+
+	var streamed []byte
+	var committed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case initiatePath:
+			if r.URL.Query().Get("mount") != "" {
+				// The config is mounted.
+				http.Error(w, "Mounted", http.StatusCreated)
+				return
+			}
+			w.Header().Set("Location", streamPath)
+			http.Error(w, "Initiated", http.StatusAccepted)
+		case streamPath:
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("ReadAll(Body) = %v", err)
+			}
+			streamed = b
+			w.Header().Set("Location", commitPath)
+			http.Error(w, "Accepted", http.StatusAccepted)
+		case commitPath:
+			committed = r.URL.Query().Get("digest")
+			http.Error(w, "Created", http.StatusCreated)
+		case manifestPath:
+			if r.Method != http.MethodPut {
+				t.Errorf("Method; got %v, want %v", r.Method, http.MethodPut)
+			}
+			http.Error(w, "Created", http.StatusCreated)
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo), name.WeakValidation)
+	if err != nil {
+		t.Fatalf("NewTag() = %v", err)
+	}
+
+	if err := Write(tag, img, authn.Anonymous, http.DefaultTransport, WriteOptions{}); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	h, err := layer.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	if committed != h.String() {
+		t.Errorf("committed digest; got %v, want %v", committed, h)
+	}
+	got, _, err := v1.SHA256(bytes.NewReader(streamed))
+	if err != nil {
+		t.Fatalf("SHA256() = %v", err)
+	}
+	if got != h {
+		t.Errorf("streamed digest; got %v, want %v", got, h)
+	}
+}
@@ -20,10 +20,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/google/go-containerregistry/name"
 	"github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/partial"
 )
 
 // WriteOptions are used to expose optional information to guide or
@@ -49,31 +51,22 @@ func WriteToFile(p string, tag name.Tag, img v1.Image, wo *WriteOptions) error {
 // One manifest.json file at the top level containing information about several images.
 // One file for each layer, named after the layer's SHA.
 // One file for the config blob, named after its SHA.
+//
+// Layers that only know their digest and size once they have been read, such
+// as a mutate.StreamLayer, are spooled to a temporary file first, since tar
+// needs the size of each file up front.
 func Write(tag name.Tag, img v1.Image, wo *WriteOptions, w io.Writer) error {
 	tf := tar.NewWriter(w)
 	defer tf.Close()
 
-	// Write the config.
-	cfgName, err := img.ConfigName()
-	if err != nil {
-		return err
-	}
-	cfgBlob, err := img.RawConfigFile()
-	if err != nil {
-		return err
-	}
-	if err := writeTarEntry(tf, cfgName.String(), bytes.NewReader(cfgBlob), int64(len(cfgBlob))); err != nil {
-		return err
-	}
-
-	// Write the layers.
+	// Write the layers first, since the config may depend on them.
 	layers, err := img.Layers()
 	if err != nil {
 		return err
 	}
 	layerFiles := make([]string, len(layers))
 	for i, l := range layers {
-		d, err := l.Digest()
+		r, d, blobSize, err := compressedLayer(l)
 		if err != nil {
 			return err
 		}
@@ -89,18 +82,24 @@ func Write(tag name.Tag, img v1.Image, wo *WriteOptions, w io.Writer) error {
 		// https://www.gnu.org/software/gzip/manual/html_node/Overview.html
 		layerFiles[i] = fmt.Sprintf("%s.tar.gz", hex)
 
-		r, err := l.Compressed()
-		if err != nil {
-			return err
-		}
-		blobSize, err := l.Size()
+		err = writeTarEntry(tf, layerFiles[i], r, blobSize)
+		r.Close()
 		if err != nil {
 			return err
 		}
+	}
 
-		if err := writeTarEntry(tf, layerFiles[i], r, blobSize); err != nil {
-			return err
-		}
+	// Write the config.
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	cfgBlob, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tf, cfgName.String(), bytes.NewReader(cfgBlob), int64(len(cfgBlob))); err != nil {
+		return err
 	}
 
 	// Generate the tar descriptor and write it.
@@ -118,6 +117,76 @@ func Write(tag name.Tag, img v1.Image, wo *WriteOptions, w io.Writer) error {
 	return writeTarEntry(tf, "manifest.json", bytes.NewReader(tdBytes), int64(len(tdBytes)))
 }
 
+// compressedLayer returns the compressed contents of l, along with its digest
+// and size. If l only knows them once it has been read, its contents are
+// spooled to a temporary file, which is removed on Close.
+func compressedLayer(l v1.Layer) (io.ReadCloser, v1.Hash, int64, error) {
+	d, err := l.Digest()
+	if err == partial.ErrNotComputed {
+		return spoolLayer(l)
+	} else if err != nil {
+		return nil, v1.Hash{}, 0, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, v1.Hash{}, 0, err
+	}
+	r, err := l.Compressed()
+	if err != nil {
+		return nil, v1.Hash{}, 0, err
+	}
+	return r, d, size, nil
+}
+
+// spoolLayer copies the compressed contents of l to a temporary file, and
+// returns it, rewound, along with the digest and size of l.
+func spoolLayer(l v1.Layer) (io.ReadCloser, v1.Hash, int64, error) {
+	r, err := l.Compressed()
+	if err != nil {
+		return nil, v1.Hash{}, 0, err
+	}
+	defer r.Close()
+
+	f, err := ioutil.TempFile("", "layer")
+	if err != nil {
+		return nil, v1.Hash{}, 0, err
+	}
+	tf := &tempFile{f}
+	if _, err := io.Copy(f, r); err != nil {
+		tf.Close()
+		return nil, v1.Hash{}, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tf.Close()
+		return nil, v1.Hash{}, 0, err
+	}
+
+	d, err := l.Digest()
+	if err != nil {
+		tf.Close()
+		return nil, v1.Hash{}, 0, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		tf.Close()
+		return nil, v1.Hash{}, 0, err
+	}
+	return tf, d, size, nil
+}
+
+// tempFile is a temporary file that is removed on Close.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
 // write a file to the provided writer with a corresponding tar header
 func writeTarEntry(tf *tar.Writer, path string, r io.Reader, size int64) error {
 	hdr := &tar.Header{